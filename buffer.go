@@ -0,0 +1,39 @@
+package log
+
+import "sync"
+
+// maxBufferSize is the capacity above which buffers are not returned to the
+// pool, so that a few large entries do not pin memory.
+const maxBufferSize = 64 * 1024
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return &Buffer{B: make([]byte, 0, 1024)}
+	},
+}
+
+// Buffer is a byte slice retrieved from a pool, meant to be used with the
+// append functions of encoders:
+//
+//	buf := log.GetBuffer()
+//	defer buf.Release()
+//	buf.B, err = enc.AppendEntry(buf.B, e)
+type Buffer struct {
+	B []byte
+}
+
+// GetBuffer retrieves an empty buffer from the pool.
+func GetBuffer() *Buffer {
+	buf := bufferPool.Get().(*Buffer)
+	buf.B = buf.B[:0]
+	return buf
+}
+
+// Release returns the buffer to the pool. The buffer must not be used
+// afterwards.
+func (b *Buffer) Release() {
+	if cap(b.B) > maxBufferSize {
+		return
+	}
+	bufferPool.Put(b)
+}
@@ -0,0 +1,46 @@
+package log
+
+import "time"
+
+// start time of the program.
+var start = time.Now()
+
+// Clock provides the time to loggers and handlers.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// Start returns the time the clock started. Handlers use it to output
+	// times relative to the start of the program.
+	Start() time.Time
+	// AfterFunc calls f once the duration elapsed on the clock, unless the
+	// returned timer is stopped before.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a timer started with Clock.AfterFunc.
+type Timer interface {
+	// Stop prevents the timer from firing. It returns false if the timer
+	// already fired or was stopped.
+	Stop() bool
+}
+
+// SystemClock is the default clock, based on the system time.
+var SystemClock Clock = systemClock{}
+
+// systemClock implementation.
+type systemClock struct{}
+
+// Now returns the current time, see the package-level Now.
+func (systemClock) Now() time.Time {
+	return Now()
+}
+
+// Start returns the time the program started.
+func (systemClock) Start() time.Time {
+	return start
+}
+
+// AfterFunc calls f in its own goroutine, see time.AfterFunc.
+func (systemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
@@ -0,0 +1,193 @@
+// Package ecs implements an encoder writing entries as JSON documents in the
+// Elastic Common Schema (ECS), recognized by the Kibana logs app and
+// dashboards:
+//
+//	{"@timestamp":"2020-01-02T03:04:05.006Z","log.level":"error","message":"upload failed","ecs.version":"1.6.0","error.message":"unauthorized","labels":{"user":"tj"}}
+//
+// The encoder can be used with the json and es handlers:
+//
+//	log.SetHandler(json.NewWithEncoder(os.Stdout, ecs.New(&ecs.Config{})))
+package ecs
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/eluv-io/apexlog-go"
+)
+
+// assert interface compliance.
+var _ log.Encoder = (*Encoder)(nil)
+
+// Version is the ECS version written in the "ecs.version" field.
+const Version = "1.6.0"
+
+// Config for the encoder.
+type Config struct {
+	Static     log.Fields // Static are ECS fields added to all entries, like "service.name"
+	EscapeHTML bool       // EscapeHTML escapes HTML characters in strings
+}
+
+// Encoder maps entries to ECS fields:
+//
+//   - Timestamp, Level and Message to "@timestamp", "log.level" and "message"
+//   - the error set with WithError to "error.message", "error.type" and
+//     "error.stack_trace" if the error carries a stack trace
+//   - the "duration" field set with WithDuration to "event.duration", in
+//     nanoseconds
+//   - the "source" field of errors with a stack trace to "log.origin.function",
+//     "log.origin.file.name" and "log.origin.file.line"
+//   - all other fields to "labels", replacing dots in their names with
+//     underscores.
+type Encoder struct {
+	config *Config
+	json   log.JSONEncoder
+}
+
+// New returns a new encoder.
+func New(config *Config) *Encoder {
+	return &Encoder{
+		config: config,
+		json:   log.JSONEncoder{EscapeHTML: config.EscapeHTML},
+	}
+}
+
+// stackTracer is implemented by errors of github.com/pkg/errors.
+type stackTracer interface {
+	StackTrace() errors.StackTrace
+}
+
+// AppendEntry implements log.Encoder.
+func (enc *Encoder) AppendEntry(dst []byte, e *log.Entry) ([]byte, error) {
+	js := enc.json
+
+	var err error
+	dst = append(dst, '{')
+	dst = js.AppendKey(dst, "@timestamp")
+	dst = js.AppendTime(dst, e.Timestamp.UTC())
+	dst = append(dst, ',')
+	dst = js.AppendKey(dst, "log.level")
+	dst = js.AppendString(dst, e.Level.String())
+	dst = append(dst, ',')
+	dst = js.AppendKey(dst, "message")
+	dst = js.AppendString(dst, e.Message)
+	dst = append(dst, ',')
+	dst = js.AppendKey(dst, "ecs.version")
+	dst = js.AppendString(dst, Version)
+
+	if cause := e.Err(); cause != nil {
+		dst = append(dst, ',')
+		dst = js.AppendKey(dst, "error.message")
+		dst = js.AppendString(dst, cause.Error())
+		dst = append(dst, ',')
+		dst = js.AppendKey(dst, "error.type")
+		dst = js.AppendString(dst, fmt.Sprintf("%T", errors.Cause(cause)))
+		if st, ok := cause.(stackTracer); ok {
+			dst = append(dst, ',')
+			dst = js.AppendKey(dst, "error.stack_trace")
+			dst = js.AppendString(dst, strings.TrimPrefix(fmt.Sprintf("%+v", st.StackTrace()), "\n"))
+		}
+	}
+
+	labels := 0
+	for _, f := range e.Fields {
+		if isLabel(f) {
+			labels++
+			continue
+		}
+		switch f.Name {
+		case "error":
+			if e.Err() == nil {
+				dst = append(dst, ',')
+				dst = js.AppendKey(dst, "error.message")
+				dst = js.AppendString(dst, fmt.Sprint(f.Value))
+			}
+		case "duration":
+			ns, _ := durationNanos(f.Value)
+			dst = append(dst, ',')
+			dst = js.AppendKey(dst, "event.duration")
+			dst = strconv.AppendInt(dst, ns, 10)
+		case "source":
+			fn, file, line, _ := log.ParseSource(f.Value.(string))
+			dst = append(dst, ',')
+			dst = js.AppendKey(dst, "log.origin.function")
+			dst = js.AppendString(dst, fn)
+			dst = append(dst, ',')
+			dst = js.AppendKey(dst, "log.origin.file.name")
+			dst = js.AppendString(dst, file)
+			dst = append(dst, ',')
+			dst = js.AppendKey(dst, "log.origin.file.line")
+			dst = strconv.AppendInt(dst, int64(line), 10)
+		}
+	}
+
+	for _, f := range enc.config.Static {
+		dst = append(dst, ',')
+		dst = js.AppendKey(dst, f.Name)
+		if dst, err = js.AppendValue(dst, f.Value); err != nil {
+			return dst, err
+		}
+	}
+
+	if labels > 0 {
+		dst = append(dst, ',')
+		dst = js.AppendKey(dst, "labels")
+		dst = append(dst, '{')
+		first := true
+		for _, f := range e.Fields {
+			if !isLabel(f) {
+				continue
+			}
+			if !first {
+				dst = append(dst, ',')
+			}
+			first = false
+			dst = js.AppendKey(dst, strings.Replace(f.Name, ".", "_", -1))
+			if dst, err = js.AppendValue(dst, f.Value); err != nil {
+				return dst, err
+			}
+		}
+		dst = append(dst, '}')
+	}
+
+	return append(dst, '}'), nil
+}
+
+// isLabel returns true if the field is not mapped to a dedicated ECS field.
+func isLabel(f *log.Field) bool {
+	switch f.Name {
+	case "error":
+		return false
+	case "duration":
+		_, ok := durationNanos(f.Value)
+		return !ok
+	case "source":
+		s, ok := f.Value.(string)
+		if !ok {
+			return true
+		}
+		_, _, _, ok = log.ParseSource(s)
+		return !ok
+	}
+	return true
+}
+
+// durationNanos returns the duration in nanoseconds of a "duration" field,
+// expressed in milliseconds by WithDuration.
+func durationNanos(v interface{}) (int64, bool) {
+	switch d := v.(type) {
+	case time.Duration:
+		return int64(d), true
+	case int64:
+		return d * int64(time.Millisecond), true
+	case int:
+		return int64(d) * int64(time.Millisecond), true
+	case float64:
+		return int64(d * float64(time.Millisecond)), true
+	}
+	return 0, false
+}
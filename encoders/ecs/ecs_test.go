@@ -0,0 +1,59 @@
+package ecs_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/eluv-io/apexlog-go"
+	"github.com/eluv-io/apexlog-go/encoders/ecs"
+	hjson "github.com/eluv-io/apexlog-go/handlers/json"
+	"github.com/eluv-io/apexlog-go/logtest"
+)
+
+func newLogger(buf *bytes.Buffer, config *ecs.Config) *log.Logger {
+	return &log.Logger{
+		Handler: hjson.NewWithEncoder(buf, ecs.New(config)),
+		Level:   log.InfoLevel,
+		Clock:   logtest.NewClock(time.Date(2020, 1, 2, 3, 4, 5, 6000000, time.UTC)),
+	}
+}
+
+func TestEncoder(t *testing.T) {
+	var buf bytes.Buffer
+	l := newLogger(&buf, &ecs.Config{Static: log.Fields{{Name: "service.name", Value: "api"}}})
+
+	l.WithField("user", "tj").WithField("http.method", "GET").WithDuration(1500 * time.Millisecond).Info("upload")
+
+	assert.Equal(t, `{"@timestamp":"2020-01-02T03:04:05.006Z","log.level":"info","message":"upload","ecs.version":"1.6.0","event.duration":1500000000,"service.name":"api","labels":{"user":"tj","http_method":"GET"}}
+`, buf.String())
+}
+
+func TestEncoder_error(t *testing.T) {
+	var buf bytes.Buffer
+	l := newLogger(&buf, &ecs.Config{})
+
+	l.WithError(errors.New("unauthorized")).Error("upload failed")
+
+	var doc map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &doc))
+	assert.Equal(t, "error", doc["log.level"])
+	assert.Equal(t, "unauthorized", doc["error.message"])
+	assert.Equal(t, "*errors.fundamental", doc["error.type"])
+	assert.Contains(t, doc["error.stack_trace"], "ecs_test.TestEncoder_error")
+	assert.Equal(t, "TestEncoder_error", doc["log.origin.function"])
+	assert.Contains(t, doc["log.origin.file.name"], "ecs_test.go")
+	assert.NotZero(t, doc["log.origin.file.line"])
+	assert.NotContains(t, doc, "labels")
+
+	// errors passed as key/values only have a message
+	buf.Reset()
+	l.Error("upload failed", errors.New("timeout"), "user", "tj")
+	assert.Equal(t, `{"@timestamp":"2020-01-02T03:04:05.006Z","log.level":"error","message":"upload failed","ecs.version":"1.6.0","error.message":"timeout","labels":{"user":"tj"}}
+`, buf.String())
+}
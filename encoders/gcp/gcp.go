@@ -0,0 +1,267 @@
+// Package gcp implements an encoder writing entries as JSON documents in the
+// structured logging format recognized by the Cloud Logging agent on GKE,
+// Cloud Run and App Engine:
+//
+//	{"severity":"ERROR","message":"upload failed","timestamp":"2020-01-02T03:04:05.006Z","logging.googleapis.com/trace":"projects/my-project/traces/4bf92f3577b34da6a3ce929d0e0e4736","user":"tj"}
+//
+// The encoder is used with the json handler writing to stdout:
+//
+//	log.SetHandler(json.NewWithEncoder(os.Stdout, gcp.New(&gcp.Config{ProjectID: "my-project"})))
+package gcp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eluv-io/apexlog-go"
+)
+
+// assert interface compliance.
+var _ log.Encoder = (*Encoder)(nil)
+
+// Special keys of the structured logging format.
+const (
+	SourceLocationKey = "logging.googleapis.com/sourceLocation"
+	TraceKey          = "logging.googleapis.com/trace"
+	SpanIDKey         = "logging.googleapis.com/spanId"
+	TraceSampledKey   = "logging.googleapis.com/trace_sampled"
+	HTTPRequestKey    = "httpRequest"
+)
+
+// StandardHTTPRequestFields maps the "http."-prefixed names of HTTP request
+// fields to the keys of the httpRequest object. Set it as
+// Config.HTTPRequestFields to opt in.
+var StandardHTTPRequestFields = map[string]string{
+	"http.method":        "requestMethod",
+	"http.url":           "requestUrl",
+	"http.status":        "status",
+	"http.user_agent":    "userAgent",
+	"http.remote_ip":     "remoteIp",
+	"http.referer":       "referer",
+	"http.protocol":      "protocol",
+	"http.latency":       "latency",
+	"http.request_size":  "requestSize",
+	"http.response_size": "responseSize",
+}
+
+// Config for the encoder.
+type Config struct {
+	ProjectID         string            // ProjectID prefixes trace IDs as "projects/<ProjectID>/traces/<trace>" (default: trace IDs are written as is)
+	TraceField        string            // TraceField is the field holding the trace ID (default: "trace_id")
+	SpanField         string            // SpanField is the field holding the span ID (default: "span_id")
+	SampledField      string            // SampledField is the field holding whether the trace is sampled (default: "trace_sampled")
+	HTTPRequestFields map[string]string // HTTPRequestFields maps fields to keys of the httpRequest object, e.g. StandardHTTPRequestFields (default: none)
+	EscapeHTML        bool              // EscapeHTML escapes HTML characters in strings
+}
+
+// defaults applies defaults to the config.
+func (c *Config) defaults() {
+	if c.TraceField == "" {
+		c.TraceField = "trace_id"
+	}
+
+	if c.SpanField == "" {
+		c.SpanField = "span_id"
+	}
+
+	if c.SampledField == "" {
+		c.SampledField = "trace_sampled"
+	}
+}
+
+// Encoder maps entries to the structured logging format:
+//
+//   - Level to "severity", Message to "message" and Timestamp to "timestamp"
+//   - the "source" field of errors with a stack trace to
+//     "logging.googleapis.com/sourceLocation"
+//   - the trace, span and sampled fields to "logging.googleapis.com/trace",
+//     "logging.googleapis.com/spanId" and "logging.googleapis.com/trace_sampled"
+//   - the fields of HTTPRequestFields to the "httpRequest" object
+//   - all other fields to top-level keys, which the agent stores in the
+//     jsonPayload of the log entry. Fields colliding with the keys above are
+//     prefixed with "fields.".
+type Encoder struct {
+	config *Config
+	json   log.JSONEncoder
+}
+
+// New returns a new encoder.
+func New(config *Config) *Encoder {
+	config.defaults()
+	return &Encoder{
+		config: config,
+		json:   log.JSONEncoder{EscapeHTML: config.EscapeHTML},
+	}
+}
+
+// Severity returns the Cloud Logging severity of the given level.
+func Severity(level log.Level) string {
+	switch level {
+	case log.TraceLevel, log.DebugLevel:
+		return "DEBUG"
+	case log.InfoLevel:
+		return "INFO"
+	case log.WarnLevel:
+		return "WARNING"
+	case log.ErrorLevel:
+		return "ERROR"
+	case log.FatalLevel:
+		return "CRITICAL"
+	}
+	return "DEFAULT"
+}
+
+// AppendEntry implements log.Encoder.
+func (enc *Encoder) AppendEntry(dst []byte, e *log.Entry) ([]byte, error) {
+	c := enc.config
+	js := enc.json
+
+	var err error
+	dst = append(dst, '{')
+	dst = js.AppendKey(dst, "severity")
+	dst = js.AppendString(dst, Severity(e.Level))
+	dst = append(dst, ',')
+	dst = js.AppendKey(dst, "message")
+	dst = js.AppendString(dst, e.Message)
+	dst = append(dst, ',')
+	dst = js.AppendKey(dst, "timestamp")
+	dst = js.AppendTime(dst, e.Timestamp.UTC())
+
+	httpRequest := false
+	for _, f := range e.Fields {
+		switch {
+		case f.Name == c.TraceField:
+			dst = append(dst, ',')
+			dst = js.AppendKey(dst, TraceKey)
+			dst = js.AppendString(dst, enc.trace(f.Value))
+			continue
+		case f.Name == c.SpanField:
+			dst = append(dst, ',')
+			dst = js.AppendKey(dst, SpanIDKey)
+			dst = js.AppendString(dst, toString(f.Value))
+			continue
+		case f.Name == c.SampledField:
+			if sampled, ok := f.Value.(bool); ok {
+				dst = append(dst, ',')
+				dst = js.AppendKey(dst, TraceSampledKey)
+				dst = strconv.AppendBool(dst, sampled)
+				continue
+			}
+		case f.Name == "source":
+			if s, ok := f.Value.(string); ok {
+				if function, file, line, ok := log.ParseSource(s); ok {
+					dst = append(dst, ',')
+					dst = js.AppendKey(dst, SourceLocationKey)
+					dst = append(dst, '{')
+					dst = js.AppendKey(dst, "file")
+					dst = js.AppendString(dst, file)
+					dst = append(dst, ',')
+					dst = js.AppendKey(dst, "line")
+					dst = js.AppendString(dst, strconv.Itoa(line))
+					dst = append(dst, ',')
+					dst = js.AppendKey(dst, "function")
+					dst = js.AppendString(dst, function)
+					dst = append(dst, '}')
+					continue
+				}
+			}
+		}
+		if _, ok := c.HTTPRequestFields[f.Name]; ok {
+			httpRequest = true
+			continue
+		}
+
+		dst = append(dst, ',')
+		if reserved(f.Name) {
+			dst = js.AppendKey(dst, "fields."+f.Name)
+		} else {
+			dst = js.AppendKey(dst, f.Name)
+		}
+		if dst, err = js.AppendValue(dst, f.Value); err != nil {
+			return dst, err
+		}
+	}
+
+	if httpRequest {
+		dst = append(dst, ',')
+		dst = js.AppendKey(dst, HTTPRequestKey)
+		dst = append(dst, '{')
+		first := true
+		for _, f := range e.Fields {
+			key, ok := c.HTTPRequestFields[f.Name]
+			if !ok {
+				continue
+			}
+			if !first {
+				dst = append(dst, ',')
+			}
+			first = false
+			dst = js.AppendKey(dst, key)
+			if dst, err = enc.appendHTTPValue(dst, key, f.Value); err != nil {
+				return dst, err
+			}
+		}
+		dst = append(dst, '}')
+	}
+
+	return append(dst, '}'), nil
+}
+
+// appendHTTPValue appends a value of the httpRequest object, converted to the
+// type expected for the given key.
+func (enc *Encoder) appendHTTPValue(dst []byte, key string, value interface{}) ([]byte, error) {
+	switch key {
+	case "latency":
+		// a duration in seconds with up to nine fractional digits: "1.5s"
+		var d time.Duration
+		switch v := value.(type) {
+		case time.Duration:
+			d = v
+		case int64:
+			// milliseconds, as set by WithDuration
+			d = time.Duration(v) * time.Millisecond
+		case int:
+			d = time.Duration(v) * time.Millisecond
+		default:
+			return enc.json.AppendString(dst, toString(value)), nil
+		}
+		return enc.json.AppendString(dst, strconv.FormatFloat(d.Seconds(), 'f', -1, 64)+"s"), nil
+	case "requestSize", "responseSize":
+		// int64 values are strings in the LogEntry JSON representation
+		return enc.json.AppendString(dst, toString(value)), nil
+	}
+	return enc.json.AppendValue(dst, value)
+}
+
+// trace returns the trace field value, prefixed with the project.
+func (enc *Encoder) trace(value interface{}) string {
+	trace := toString(value)
+	if enc.config.ProjectID == "" || strings.HasPrefix(trace, "projects/") {
+		return trace
+	}
+	return "projects/" + enc.config.ProjectID + "/traces/" + trace
+}
+
+// reserved returns true if name is a key of the structured logging format.
+func reserved(name string) bool {
+	switch name {
+	case "severity", "message", "timestamp", HTTPRequestKey:
+		return true
+	}
+	return strings.HasPrefix(name, "logging.googleapis.com/")
+}
+
+// toString returns the string representation of a value.
+func toString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case int:
+		return strconv.Itoa(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	}
+	return fmt.Sprint(value)
+}
@@ -0,0 +1,96 @@
+package gcp_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/eluv-io/apexlog-go"
+	"github.com/eluv-io/apexlog-go/encoders/gcp"
+	hjson "github.com/eluv-io/apexlog-go/handlers/json"
+	"github.com/eluv-io/apexlog-go/logtest"
+)
+
+func newLogger(buf *bytes.Buffer, config *gcp.Config) *log.Logger {
+	return &log.Logger{
+		Handler: hjson.NewWithEncoder(buf, gcp.New(config)),
+		Level:   log.TraceLevel,
+		Clock:   logtest.NewClock(time.Date(2020, 1, 2, 3, 4, 5, 6000000, time.UTC)),
+	}
+}
+
+func TestEncoder(t *testing.T) {
+	var buf bytes.Buffer
+	l := newLogger(&buf, &gcp.Config{ProjectID: "my-project", HTTPRequestFields: gcp.StandardHTTPRequestFields})
+
+	l.Info("request",
+		"trace_id", "4bf92f3577b34da6a3ce929d0e0e4736",
+		"span_id", "00f067aa0ba902b7",
+		"trace_sampled", true,
+		"http.method", "GET",
+		"http.url", "/upload",
+		"http.status", 200,
+		"http.latency", 1500*time.Millisecond,
+		"http.response_size", 1024,
+		"user", "tj",
+		"message", "collides")
+
+	assert.Equal(t, `{"severity":"INFO","message":"request","timestamp":"2020-01-02T03:04:05.006Z",`+
+		`"logging.googleapis.com/trace":"projects/my-project/traces/4bf92f3577b34da6a3ce929d0e0e4736",`+
+		`"logging.googleapis.com/spanId":"00f067aa0ba902b7","logging.googleapis.com/trace_sampled":true,`+
+		`"user":"tj","fields.message":"collides",`+
+		`"httpRequest":{"requestMethod":"GET","requestUrl":"/upload","status":200,"latency":"1.5s","responseSize":"1024"}}
+`, buf.String())
+}
+
+func TestEncoder_noHTTPRequest(t *testing.T) {
+	var buf bytes.Buffer
+	l := newLogger(&buf, &gcp.Config{})
+
+	l.Info("done", "status", "ok", "http.status", 200)
+
+	assert.Equal(t, `{"severity":"INFO","message":"done","timestamp":"2020-01-02T03:04:05.006Z","status":"ok","http.status":200}
+`, buf.String())
+}
+
+func TestEncoder_severity(t *testing.T) {
+	var buf bytes.Buffer
+	l := newLogger(&buf, &gcp.Config{})
+
+	l.Trace("a")
+	l.Debug("b")
+	l.Info("c")
+	l.Warn("d")
+	l.Error("e")
+
+	var severities []string
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var doc map[string]interface{}
+		require.NoError(t, dec.Decode(&doc))
+		severities = append(severities, doc["severity"].(string))
+	}
+	assert.Equal(t, []string{"DEBUG", "DEBUG", "INFO", "WARNING", "ERROR"}, severities)
+}
+
+func TestEncoder_sourceLocation(t *testing.T) {
+	var buf bytes.Buffer
+	l := newLogger(&buf, &gcp.Config{})
+
+	l.WithError(errors.New("boom")).Error("failed")
+
+	var doc map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &doc))
+	loc, ok := doc[gcp.SourceLocationKey].(map[string]interface{})
+	require.True(t, ok, buf.String())
+	assert.Equal(t, "TestEncoder_sourceLocation", loc["function"])
+	assert.Contains(t, loc["file"], "gcp_test.go")
+	assert.NotEmpty(t, loc["line"])
+	assert.Equal(t, "boom", doc["error"])
+	assert.NotContains(t, doc, "httpRequest")
+}
@@ -4,8 +4,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -14,10 +16,19 @@ var _ Interface = (*Entry)(nil)
 
 var entryPool sync.Pool
 
-// Now returns the current time.
+// Now returns the current time. It is used by the SystemClock.
+//
+// Deprecated: replacing Now affects all loggers, set a Clock on the Logger
+// instead.
 var Now = time.Now
 
 // Entry represents a single log entry.
+//
+// Entries returned by the WithXX functions never reference the entry they
+// derive from: the last fields added with WithField are stored inline, other
+// fields in immutable chunks and slices shared between derived entries.
+// Fields are only merged once a message is actually logged, and short chains
+// of WithField calls don't need to escape to the heap.
 type Entry struct {
 	Logger    *Logger   `json:"-"`
 	Fields    Fields    `json:"fields"`
@@ -25,12 +36,49 @@ type Entry struct {
 	Timestamp time.Time `json:"timestamp"`
 	Message   string    `json:"message"`
 	start     time.Time
-	fields    []Fields
+	fields    Fields              // fields is an immutable slice of fields, possibly shared
+	chunks    *fieldChunk         // chunks are the fields added with WithField after fields
+	kv        [inlineFields]Field // kv are the last fields added with WithField
+	nkv       int
+	err       error // err is the error set with WithError
 	pool      bool
+	refs      int32
+}
+
+// inlineFields is the number of fields added with WithField that are stored
+// in the entry itself.
+const inlineFields = 4
+
+// fieldChunk holds fields added with WithField that didn't fit in an entry.
+type fieldChunk struct {
+	prev *fieldChunk
+	kv   [inlineFields]Field
+}
+
+// appendFields appends copies of the fields of the chunk and its predecessors
+// to dst, starting with the oldest.
+func (c *fieldChunk) appendFields(dst Fields, pool bool) Fields {
+	if c == nil {
+		return dst
+	}
+	dst = c.prev.appendFields(dst, pool)
+	for i := range c.kv {
+		dst = append(dst, makeField(c.kv[i].Name, c.kv[i].Value, pool))
+	}
+	return dst
+}
+
+// count returns the number of fields of the chunk and its predecessors.
+func (c *fieldChunk) count() int {
+	n := 0
+	for ; c != nil; c = c.prev {
+		n += inlineFields
+	}
+	return n
 }
 
 // newEntry returns a new entry for the given `log`.
-// The entry is retrieved from the pool.
+// The entry is retrieved from the pool and holds a single reference.
 func newEntry(log *Logger) *Entry {
 	var e *Entry
 	if v := entryPool.Get(); v != nil {
@@ -39,6 +87,7 @@ func newEntry(log *Logger) *Entry {
 		e = new(Entry)
 	}
 	e.pool = true
+	e.refs = 1
 	e.reset(log)
 	return e
 }
@@ -52,39 +101,100 @@ func NewEntry(log *Logger) *Entry {
 func (e *Entry) reset(l *Logger) {
 	e.Logger = l
 	e.Fields = nil
-	e.fields = nil
+	e.Message = ""
+	e.err = nil
 }
 
-// Release the entry to the pool if it was retrieved from it.
-// The function is public such that asynchronous handlers can call it.
-func (e *Entry) Release() {
+// Retain adds a reference to the entry and returns it.
+//
+// Entries passed to handlers are pooled and released once HandleLog returns.
+// Handlers keeping an entry after HandleLog returned - for later processing
+// or output - must retain it and call Release once done with it. Retaining an
+// entry retains its fields.
+func (e *Entry) Retain() *Entry {
 	if e.pool {
-		e.releaseFields()
-		e.reset(nil)
-		entryPool.Put(e)
+		atomic.AddInt32(&e.refs, 1)
 	}
+	return e
 }
 
-func (e *Entry) appendFields(fields Fielder) []Fields {
-	f := make([]Fields, 0)
-	f = append(f, e.fields...)
-	if fields != nil {
-		f = append(f, fields.Fields())
+// Release removes a reference to the entry. The entry and its fields are
+// returned to the pool once the last reference is released, and must not be
+// used afterwards.
+func (e *Entry) Release() {
+	if !e.pool {
+		return
+	}
+	refs := atomic.AddInt32(&e.refs, -1)
+	if refs > 0 {
+		return
 	}
-	return f
+	if refs < 0 {
+		panic("log: entry released more times than retained")
+	}
+	e.releaseFields()
+	e.reset(nil)
+	entryPool.Put(e)
+}
+
+// Clone returns a copy of the entry with copies of its fields. The copy is not
+// pooled: it doesn't need to be retained nor released.
+func (e *Entry) Clone() *Entry {
+	ret := &Entry{
+		Logger:    e.Logger,
+		Level:     e.Level,
+		Timestamp: e.Timestamp,
+		Message:   e.Message,
+		err:       e.err,
+	}
+	if e.Fields != nil {
+		ret.Fields = make(Fields, len(e.Fields))
+		for i, f := range e.Fields {
+			ret.Fields[i] = &Field{Name: f.Name, Value: f.Value}
+		}
+	}
+	return ret
 }
 
 // WithFields returns a new entry with `fields` set.
 func (e *Entry) WithFields(fields Fielder) *Entry {
-	return &Entry{
+	var f Fields
+	if fields != nil {
+		f = fields.Fields()
+	}
+	ret := &Entry{
 		Logger: e.Logger,
-		fields: e.appendFields(fields),
+		err:    e.err,
+	}
+	if len(e.fields) == 0 && e.chunks == nil && e.nkv == 0 {
+		ret.fields = f
+	} else {
+		more := len(e.fields) + e.chunks.count() + e.nkv + len(f)
+		ret.fields = append(e.appendFields(make(Fields, 0, more), false), f...)
 	}
+	return ret
 }
 
 // WithField returns a new entry with the `key` and `value` set.
+//
+// Note: the function is kept simple enough to be inlined by the compiler,
+// which lets it allocate the returned entry on the stack when possible.
 func (e *Entry) WithField(key string, value interface{}) *Entry {
-	return e.WithFields(Fields{&Field{Name: key, Value: value}})
+	ret := &Entry{
+		Logger: e.Logger,
+		fields: e.fields,
+		chunks: e.chunks,
+		kv:     e.kv,
+		nkv:    e.nkv,
+		err:    e.err,
+	}
+	if ret.nkv == inlineFields {
+		ret.chunks = &fieldChunk{prev: e.chunks, kv: e.kv}
+		ret.nkv = 0
+	}
+	ret.kv[ret.nkv] = Field{Name: key, Value: value}
+	ret.nkv++
+	return ret
 }
 
 // WithDuration returns a new entry with the "duration" field set
@@ -103,6 +213,7 @@ func (e *Entry) WithError(err error) *Entry {
 	}
 
 	ctx := e.WithField("error", err.Error())
+	ctx.err = err
 
 	if s, ok := err.(stackTracer); ok {
 		frame := s.StackTrace()[0]
@@ -126,6 +237,32 @@ func (e *Entry) WithError(err error) *Entry {
 	return ctx
 }
 
+// ParseSource parses the "source" field set by WithError for errors carrying
+// a stack trace, formatted as "function: file:line".
+func ParseSource(source string) (function, file string, line int, ok bool) {
+	i := strings.Index(source, ": ")
+	if i < 0 {
+		return "", "", 0, false
+	}
+	function, loc := source[:i], source[i+2:]
+	j := strings.LastIndex(loc, ":")
+	if j < 0 {
+		return "", "", 0, false
+	}
+	line, err := strconv.Atoi(loc[j+1:])
+	if err != nil {
+		return "", "", 0, false
+	}
+	return function, loc[:j], line, true
+}
+
+// Err returns the error set with WithError, if any. It gives encoders access
+// to the original error - for instance to its stack trace - while the "error"
+// field only holds its message.
+func (e *Entry) Err() error {
+	return e.err
+}
+
 // convert converts fields depending on their type.
 // For example, it converts instances of "error" to strings, since errors are
 // marshalled to "{}" by the standard json library...
@@ -141,10 +278,12 @@ func convert(val interface{}) interface{} {
 	return val
 }
 
-func (e *Entry) withKvFields(args ...interface{}) *Entry {
+// appendKvFields appends the fields corresponding to the given key/value
+// arguments to dst. Fields are retrieved from the pool if pool is true.
+func appendKvFields(dst Fields, args []interface{}, pool bool) Fields {
 	count := len(args)
-	if args == nil || count == 0 {
-		return e
+	if count == 0 {
+		return dst
 	}
 	if count == 1 {
 		if slice, ok := args[0].([]interface{}); ok {
@@ -157,152 +296,193 @@ func (e *Entry) withKvFields(args ...interface{}) *Entry {
 		}
 	}
 
-	f := make(Fields, 0, (count+1)/2)
 	for idx := 0; idx < count; idx++ {
 		_, ok := args[idx].(error)
 		if ok {
 			// an error value without key
-			f = append(f, newField("error", convert(args[idx])))
+			dst = append(dst, makeField("error", convert(args[idx]), pool))
 		} else if fields, ok := args[idx].(Fielder); ok {
-			f = append(f, fields.Fields()...)
+			for _, f := range fields.Fields() {
+				dst = append(dst, makeField(f.Name, f.Value, pool))
+			}
 		} else if field, ok := args[idx].(Field); ok {
-			f = append(f, &field)
+			dst = append(dst, makeField(field.Name, field.Value, pool))
 		} else if field, ok := args[idx].(*Field); ok {
-			f = append(f, field)
+			dst = append(dst, makeField(field.Name, field.Value, pool))
 		} else if idx+1 < count {
 			// there are (at least) two args left
 			key, ok := args[idx].(string)
 			if !ok {
 				key = fmt.Sprintf("%v", args[idx])
 			}
-			f = append(f, newField(key, convert(args[idx+1])))
+			dst = append(dst, makeField(key, convert(args[idx+1]), pool))
 			idx++
 		} else {
-			f = append(f, newField("unknown", convert(args[idx])))
+			dst = append(dst, makeField("unknown", convert(args[idx]), pool))
 		}
 	}
-	return e.WithFields(f)
+	return dst
+}
+
+// Enabled returns true if messages at the given level are logged by the
+// entry's logger.
+func (e *Entry) Enabled(level Level) bool {
+	return e.Logger.Enabled(level)
 }
 
 // Trace level message.
 func (e *Entry) Trace(msg string, fields ...interface{}) {
-	e.Logger.log(TraceLevel, e.withKvFields(fields...), msg)
+	if e.Logger.Enabled(TraceLevel) {
+		e.Logger.log(TraceLevel, e, msg, fields)
+	}
 }
 
 // Debug level message.
 func (e *Entry) Debug(msg string, fields ...interface{}) {
-	e.Logger.log(DebugLevel, e.withKvFields(fields...), msg)
+	if e.Logger.Enabled(DebugLevel) {
+		e.Logger.log(DebugLevel, e, msg, fields)
+	}
 }
 
 // Info level message.
 func (e *Entry) Info(msg string, fields ...interface{}) {
-	e.Logger.log(InfoLevel, e.withKvFields(fields...), msg)
+	if e.Logger.Enabled(InfoLevel) {
+		e.Logger.log(InfoLevel, e, msg, fields)
+	}
 }
 
 // Warn level message.
 func (e *Entry) Warn(msg string, fields ...interface{}) {
-	e.Logger.log(WarnLevel, e.withKvFields(fields...), msg)
+	if e.Logger.Enabled(WarnLevel) {
+		e.Logger.log(WarnLevel, e, msg, fields)
+	}
 }
 
 // Error level message.
 func (e *Entry) Error(msg string, fields ...interface{}) {
-	e.Logger.log(ErrorLevel, e.withKvFields(fields...), msg)
+	if e.Logger.Enabled(ErrorLevel) {
+		e.Logger.log(ErrorLevel, e, msg, fields)
+	}
 }
 
 // Fatal level message, followed by an exit.
 func (e *Entry) Fatal(msg string, fields ...interface{}) {
-	e.Logger.log(FatalLevel, e.withKvFields(fields...), msg)
+	if e.Logger.Enabled(FatalLevel) {
+		e.Logger.log(FatalLevel, e, msg, fields)
+	}
 	os.Exit(1)
 }
 
 // Tracef level formatted message.
 func (e *Entry) Tracef(msg string, v ...interface{}) {
-	e.Trace(fmt.Sprintf(msg, v...))
+	if e.Logger.Enabled(TraceLevel) {
+		e.Logger.log(TraceLevel, e, fmt.Sprintf(msg, v...), nil)
+	}
 }
 
 // Debugf level formatted message.
 func (e *Entry) Debugf(msg string, v ...interface{}) {
-	e.Debug(fmt.Sprintf(msg, v...))
+	if e.Logger.Enabled(DebugLevel) {
+		e.Logger.log(DebugLevel, e, fmt.Sprintf(msg, v...), nil)
+	}
 }
 
 // Infof level formatted message.
 func (e *Entry) Infof(msg string, v ...interface{}) {
-	e.Info(fmt.Sprintf(msg, v...))
+	if e.Logger.Enabled(InfoLevel) {
+		e.Logger.log(InfoLevel, e, fmt.Sprintf(msg, v...), nil)
+	}
 }
 
 // Warnf level formatted message.
 func (e *Entry) Warnf(msg string, v ...interface{}) {
-	e.Warn(fmt.Sprintf(msg, v...))
+	if e.Logger.Enabled(WarnLevel) {
+		e.Logger.log(WarnLevel, e, fmt.Sprintf(msg, v...), nil)
+	}
 }
 
 // Errorf level formatted message.
 func (e *Entry) Errorf(msg string, v ...interface{}) {
-	e.Error(fmt.Sprintf(msg, v...))
+	if e.Logger.Enabled(ErrorLevel) {
+		e.Logger.log(ErrorLevel, e, fmt.Sprintf(msg, v...), nil)
+	}
 }
 
 // Fatalf level formatted message, followed by an exit.
 func (e *Entry) Fatalf(msg string, v ...interface{}) {
-	e.Fatal(fmt.Sprintf(msg, v...))
+	if e.Logger.Enabled(FatalLevel) {
+		e.Logger.log(FatalLevel, e, fmt.Sprintf(msg, v...), nil)
+	}
+	os.Exit(1)
 }
 
 // Watch returns a new entry with a Stop method to fire off
 // a corresponding completion log, useful with defer.
 func (e *Entry) Watch(msg string) *Entry {
 	e.Info(msg)
-	v := e.WithFields(e.Fields)
+	v := e.WithFields(nil)
 	v.Message = msg
-	v.start = time.Now()
+	v.start = e.Clock().Now()
 	return v
 }
 
 // Stop should be used with Trace, to fire off the completion message. When
 // an `err` is passed the "error" field is set, and the log level is error.
 func (e *Entry) Stop(err *error) {
+	d := e.Clock().Now().Sub(e.start)
 	if err == nil || *err == nil {
-		e.WithDuration(time.Since(e.start)).Info(e.Message)
+		e.WithDuration(d).Info(e.Message)
 	} else {
-		e.WithDuration(time.Since(e.start)).WithError(*err).Error(e.Message)
+		e.WithDuration(d).WithError(*err).Error(e.Message)
 	}
 }
 
+// Clock returns the clock of the entry's logger. Handlers should use it for
+// all time-dependent output.
+func (e *Entry) Clock() Clock {
+	return e.Logger.clock()
+}
+
 // MergedFields returns the fields list collapsed into a single one.
 func (e *Entry) MergedFields() Fields {
-	f := Fields{}
+	return e.appendFields(Fields{}, false)
+}
 
-	for _, fields := range e.fields {
-		for _, v := range fields {
-			f = append(f, v)
-		}
+// appendFields appends copies of the fields of the entry to dst. Copies are
+// retrieved from the pool if pool is true.
+func (e *Entry) appendFields(dst Fields, pool bool) Fields {
+	for _, f := range e.fields {
+		dst = append(dst, makeField(f.Name, f.Value, pool))
 	}
-
-	return f
+	dst = e.chunks.appendFields(dst, pool)
+	for i := 0; i < e.nkv; i++ {
+		dst = append(dst, makeField(e.kv[i].Name, e.kv[i].Value, pool))
+	}
+	return dst
 }
 
-// finalize returns a copy of the Entry with Fields merged.
-func (e *Entry) finalize(level Level, msg string, pool bool) *Entry {
+// finalize returns a new Entry with the fields of e and the given key/value
+// arguments merged. If pool is true, the entry and its fields are retrieved
+// from the pool and must be released.
+func (e *Entry) finalize(level Level, msg string, kv []interface{}, pool bool) *Entry {
+	var ret *Entry
 	if pool {
-		// note: async entry cannot be taken from the pool since some handlers
-		//       (e.g. memory handler) keep entries
-		ret := newEntry(e.Logger)
-		ret.Fields = e.MergedFields()
-		ret.Level = level
-		ret.Message = msg
-		ret.Timestamp = Now()
-		return ret
-	}
-	return &Entry{
-		Logger:    e.Logger,
-		Fields:    e.MergedFields(),
-		Level:     level,
-		Message:   msg,
-		Timestamp: Now(),
+		ret = newEntry(e.Logger)
+	} else {
+		ret = NewEntry(e.Logger)
 	}
+	ret.Fields = make(Fields, 0, len(e.fields)+e.chunks.count()+e.nkv+(len(kv)+1)/2)
+	ret.Fields = e.appendFields(ret.Fields, pool)
+	ret.Fields = appendKvFields(ret.Fields, kv, pool)
+	ret.Level = level
+	ret.Message = msg
+	ret.Timestamp = e.Logger.clock().Now()
+	ret.err = e.err
+	return ret
 }
 
 func (e *Entry) releaseFields() {
-	for _, fields := range e.fields {
-		for _, f := range fields {
-			f.release()
-		}
+	for _, f := range e.Fields {
+		f.Release()
 	}
 }
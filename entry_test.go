@@ -18,7 +18,7 @@ func TestEntry_WithFields(t *testing.T) {
 
 	c := a.WithFields(Fields{{Name: "foo", Value: "hello"}, {Name: "bar", Value: "world"}})
 
-	e := c.finalize(InfoLevel, "upload", false)
+	e := c.finalize(InfoLevel, "upload", nil, false)
 	assert.Equal(t, e.Message, "upload")
 	assert.Equal(t, e.Fields, Fields{{Name: "foo", Value: "hello"}, {Name: "bar", Value: "world"}})
 	assert.Equal(t, e.Level, InfoLevel)
@@ -71,3 +71,60 @@ func (ef errFields) Error() string {
 func (ef errFields) Fields() Fields {
 	return Fields{{Name: "reason", Value: "timeout"}}
 }
+
+func TestEntry_WithField_many(t *testing.T) {
+	a := NewEntry(nil).WithFields(Fields{{Name: "f0", Value: 0}})
+	for i := 1; i < 11; i++ {
+		a = a.WithField(fmt.Sprintf("f%d", i), i)
+	}
+	b := a.WithField("f11", 11)
+	c := a.WithField("f11", "other")
+
+	expected := Fields{}
+	for i := 0; i < 12; i++ {
+		expected = append(expected, &Field{Name: fmt.Sprintf("f%d", i), Value: i})
+	}
+	assert.Equal(t, expected[:11], a.MergedFields())
+	assert.Equal(t, expected, b.MergedFields())
+
+	expected[11] = &Field{Name: "f11", Value: "other"}
+	assert.Equal(t, expected, c.MergedFields())
+
+	d := c.WithFields(Fields{{Name: "f12", Value: 12}})
+	expected = append(expected, &Field{Name: "f12", Value: 12})
+	assert.Equal(t, expected, d.MergedFields())
+}
+
+func TestEntry_Release(t *testing.T) {
+	e := NewEntry(nil).WithField("foo", "bar").finalize(InfoLevel, "upload", []interface{}{"k", "v"}, true)
+	f := e.Fields[0].Retain()
+
+	e.Retain()
+	e.Release()
+	assert.Equal(t, "upload", e.Message)
+
+	e.Release()
+	assert.Equal(t, "foo", f.Name, "retained field must survive its entry")
+	f.Release()
+
+	assert.Panics(t, e.Release)
+	assert.Panics(t, f.Release)
+
+	// entries and fields that are not pooled are not ref counted
+	n := NewEntry(nil)
+	n.Release()
+	n.Release()
+}
+
+func TestParseSource(t *testing.T) {
+	function, file, line, ok := ParseSource("main.run: /app/cmd/main.go:42")
+	assert.True(t, ok)
+	assert.Equal(t, "main.run", function)
+	assert.Equal(t, "/app/cmd/main.go", file)
+	assert.Equal(t, 42, line)
+
+	_, _, _, ok = ParseSource("main.go:42")
+	assert.False(t, ok)
+	_, _, _, ok = ParseSource("main.run: main.go")
+	assert.False(t, ok)
+}
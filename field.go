@@ -1,27 +1,23 @@
 package log
 
 import (
-	"bytes"
-	"encoding/json"
-	"fmt"
 	"sync"
+	"sync/atomic"
 )
 
-var (
-	fieldsPool        sync.Pool
-	encBufferPool     = newBufferPool()
-	defaultBufferSize = 1024
-)
+var fieldsPool sync.Pool
 
 type Field struct {
 	pool  bool
+	refs  int32
 	Name  string
 	Value interface{}
 }
 
 // newField returns a Field initialized with the given name and value.
-// The field is retrieved from a pool and will be released back to the pool once
-// logging occurred.
+// The field is retrieved from a pool and holds a single reference, owned by
+// the entry it is added to: it is released back to the pool together with the
+// entry.
 func newField(name string, value interface{}) *Field {
 	var e *Field
 	if v := fieldsPool.Get(); v != nil {
@@ -30,84 +26,48 @@ func newField(name string, value interface{}) *Field {
 		e = new(Field)
 	}
 	e.pool = true
+	e.refs = 1
 	e.Reset(name, value)
 	return e
 }
 
-func (f *Field) release() {
-	if f.pool {
-		f.Reset("", nil)
-		fieldsPool.Put(f)
+// makeField returns a Field initialized with the given name and value, taken
+// from the pool if pool is true.
+func makeField(name string, value interface{}, pool bool) *Field {
+	if pool {
+		return newField(name, value)
 	}
+	return &Field{Name: name, Value: value}
 }
 
-func (f *Field) Reset(name string, value interface{}) {
-	f.Name = name
-	f.Value = value
-}
-
-func (f *Field) _toJSON() ([]byte, error) {
-	val, err := json.Marshal(f.Value)
-	if err != nil {
-		return nil, err
+// Retain adds a reference to the field and returns it. Handlers keeping a
+// field - but not its entry - after HandleLog returned must retain it and call
+// Release once done with it.
+func (f *Field) Retain() *Field {
+	if f.pool {
+		atomic.AddInt32(&f.refs, 1)
 	}
-	s := fmt.Sprintf("\"%s\":%v", f.Name, string(val))
-	return []byte(s), nil
+	return f
 }
 
-func (f *Field) toJSON() ([]byte, error) {
-	bp := encBufferPool.get()
-	defer bp.release()
-	buf := bytes.NewBuffer(bp.bs)
-
-	enc := json.NewEncoder(buf)
-	enc.SetEscapeHTML(false)
-	err := enc.Encode(f.Value)
-	if err != nil {
-		return nil, err
+// Release removes a reference to the field. The field is returned to the pool
+// once the last reference is released, and must not be used afterwards.
+func (f *Field) Release() {
+	if !f.pool {
+		return
 	}
-	s := fmt.Sprintf("\"%s\": %v", f.Name, string(buf.Bytes()))
-	return []byte(s), nil
-}
-
-// bufferPool is a pool of buffers
-type bufferPool struct {
-	p *sync.Pool
-}
-
-// newBufferPool constructs a new BufferPool.
-func newBufferPool() bufferPool {
-	return bufferPool{p: &sync.Pool{
-		New: func() interface{} {
-			return &buffer{bs: make([]byte, 0, defaultBufferSize)}
-		},
-	}}
-}
-
-// Get retrieves a buffer from the pool, creating one if necessary.
-func (p bufferPool) get() *buffer {
-	buf := p.p.Get().(*buffer)
-	buf.reset()
-	buf.pool = p
-	return buf
-}
-
-func (p bufferPool) put(buf *buffer) {
-	p.p.Put(buf)
-}
-
-// buffer is a wrapper around a byte slice.
-type buffer struct {
-	bs   []byte
-	pool bufferPool
-}
-
-// reset resets the underlying byte slice.
-func (b *buffer) reset() {
-	b.bs = b.bs[:0]
+	refs := atomic.AddInt32(&f.refs, -1)
+	if refs > 0 {
+		return
+	}
+	if refs < 0 {
+		panic("log: field released more times than retained")
+	}
+	f.Reset("", nil)
+	fieldsPool.Put(f)
 }
 
-// release returns the buffer to its Pool.
-func (b *buffer) release() {
-	b.pool.put(b)
+func (f *Field) Reset(name string, value interface{}) {
+	f.Name = name
+	f.Value = value
 }
@@ -17,4 +17,5 @@ require (
 	github.com/tj/assert v0.0.3
 	github.com/tj/go-elastic v0.0.0-20171221160941-36157cbbebc2
 	github.com/tj/go-spin v1.1.0
+	golang.org/x/sys v0.0.0-20210423082822-04245dca01da
 )
@@ -0,0 +1,286 @@
+// Package async implements a handler passing entries to another handler from
+// worker goroutines, so that slow handlers don't stall the logging
+// goroutines.
+//
+// Entries are queued in a bounded queue. When the queue is full, the Policy
+// decides whether logging blocks or entries are dropped: dropped entries are
+// counted and reported by Dropped. With more than one worker, entries may be
+// handled out of order.
+package async
+
+import (
+	"context"
+	"errors"
+	stdlog "log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eluv-io/apexlog-go"
+)
+
+// ErrClosed is returned when logging to a closed handler.
+var ErrClosed = errors.New("async: handler closed")
+
+// Policy is the behavior of the handler when its queue is full.
+type Policy int
+
+// Policies.
+const (
+	Block          Policy = iota // Block waits for room in the queue
+	DropNewest                   // DropNewest drops the entry being logged
+	DropOldest                   // DropOldest drops the oldest queued entries to make room
+	DropBelowError               // DropBelowError drops the entry being logged if below the error level, and waits for room otherwise
+)
+
+// Config for handler.
+type Config struct {
+	QueueSize      int           // QueueSize is the max number of queued entries (default: 1024)
+	Workers        int           // Workers is the number of goroutines handling entries (default: 1)
+	Policy         Policy        // Policy applies when the queue is full (default: Block)
+	ReportInterval time.Duration // ReportInterval is the interval of the reports of dropped entries to the standard logger, 0 for no reports
+}
+
+// defaults applies defaults to the config.
+func (c *Config) defaults() {
+	if c.QueueSize == 0 {
+		c.QueueSize = 1024
+	}
+
+	if c.Workers == 0 {
+		c.Workers = 1
+	}
+}
+
+// Handler implementation.
+type Handler struct {
+	dropped  uint64 // dropped is the number of dropped entries, first for 64-bit alignment
+	reported uint64 // reported is the number of dropped entries already reported
+
+	*Config
+	handler log.Handler
+
+	mu     sync.RWMutex // mu guards the queue against its closing
+	queue  chan *log.Entry
+	closed bool
+
+	pmu     sync.Mutex
+	pending int             // pending is the number of entries queued or being handled
+	idle    []chan struct{} // idle are closed once no entries are pending
+
+	done      chan struct{}
+	stopped   chan struct{} // stopped is closed once all workers returned
+	closeOnce sync.Once     // closeOnce closes the wrapped handler
+}
+
+// New handler passing entries to h. The config may be nil.
+func New(h log.Handler, config *Config) *Handler {
+	if config == nil {
+		config = &Config{}
+	}
+	config.defaults()
+
+	ret := &Handler{
+		Config:  config,
+		handler: h,
+		queue:   make(chan *log.Entry, config.QueueSize),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(config.Workers)
+	for i := 0; i < config.Workers; i++ {
+		go func() {
+			defer wg.Done()
+			ret.work()
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(ret.stopped)
+	}()
+
+	if config.ReportInterval > 0 {
+		go ret.report()
+	}
+	return ret
+}
+
+// HandleLog implements log.Handler. The entry is retained until handled or
+// dropped.
+func (h *Handler) HandleLog(e *log.Entry) error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if h.closed {
+		return ErrClosed
+	}
+
+	h.add(1)
+	e.Retain()
+
+	switch h.Policy {
+	case DropNewest:
+		h.offer(e)
+	case DropOldest:
+		for {
+			select {
+			case h.queue <- e:
+				return nil
+			default:
+			}
+			select {
+			case old := <-h.queue:
+				h.drop(old)
+			default:
+			}
+		}
+	case DropBelowError:
+		if e.Level < log.ErrorLevel {
+			h.offer(e)
+		} else {
+			h.queue <- e
+		}
+	default:
+		h.queue <- e
+	}
+
+	return nil
+}
+
+// Dropped returns the number of entries dropped so far.
+func (h *Handler) Dropped() uint64 {
+	return atomic.LoadUint64(&h.dropped)
+}
+
+// offer queues the entry, or drops it if the queue is full.
+func (h *Handler) offer(e *log.Entry) {
+	select {
+	case h.queue <- e:
+	default:
+		h.drop(e)
+	}
+}
+
+// drop drops the entry.
+func (h *Handler) drop(e *log.Entry) {
+	atomic.AddUint64(&h.dropped, 1)
+	e.Release()
+	h.add(-1)
+}
+
+// add adds n to the number of pending entries and notifies the waiters of
+// Flush once none is pending.
+func (h *Handler) add(n int) {
+	h.pmu.Lock()
+	defer h.pmu.Unlock()
+
+	h.pending += n
+	if h.pending == 0 {
+		for _, idle := range h.idle {
+			close(idle)
+		}
+		h.idle = nil
+	}
+}
+
+// work handles queued entries until the queue is closed.
+func (h *Handler) work() {
+	for e := range h.queue {
+		if err := h.handler.HandleLog(e); err != nil {
+			stdlog.Printf("log/async: failed to handle log: %s", err)
+		}
+		e.Release()
+		h.add(-1)
+	}
+}
+
+// report reports the dropped entries every ReportInterval until the handler
+// is closed.
+func (h *Handler) report() {
+	ticker := time.NewTicker(h.ReportInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			h.reportDropped()
+		case <-h.done:
+			h.reportDropped()
+			return
+		}
+	}
+}
+
+// reportDropped reports the entries dropped since the last report, if any.
+func (h *Handler) reportDropped() {
+	dropped := atomic.LoadUint64(&h.dropped)
+	reported := atomic.SwapUint64(&h.reported, dropped)
+	if dropped > reported {
+		stdlog.Printf("log/async: dropped %d logs", dropped-reported)
+	}
+}
+
+// Flush waits until the queue is empty and no entry is being handled, then
+// flushes the wrapped handler if it implements Flush() error or
+// Flush(context.Context) error. Entries logged while flushing delay the
+// return of Flush, which returns the error of the context if it is done
+// first.
+func (h *Handler) Flush(ctx context.Context) error {
+	h.pmu.Lock()
+	var idle chan struct{}
+	if h.pending > 0 {
+		idle = make(chan struct{})
+		h.idle = append(h.idle, idle)
+	}
+	h.pmu.Unlock()
+
+	if idle != nil {
+		select {
+		case <-idle:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	switch f := h.handler.(type) {
+	case interface{ Flush(context.Context) error }:
+		return f.Flush(ctx)
+	case interface{ Flush() error }:
+		return f.Flush()
+	}
+	return nil
+}
+
+// Close stops accepting entries, waits until the queued entries were handled
+// and closes the wrapped handler if it implements Close() error or
+// Close(context.Context) error. It returns the error of the context if it is
+// done first: queued entries are then still handled in the background, and
+// Close may be called again to wait for them.
+func (h *Handler) Close(ctx context.Context) error {
+	h.mu.Lock()
+	if !h.closed {
+		h.closed = true
+		close(h.queue)
+		close(h.done)
+	}
+	h.mu.Unlock()
+
+	select {
+	case <-h.stopped:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	var err error
+	h.closeOnce.Do(func() {
+		switch c := h.handler.(type) {
+		case interface{ Close(context.Context) error }:
+			err = c.Close(ctx)
+		case interface{ Close() error }:
+			err = c.Close()
+		}
+	})
+	return err
+}
@@ -0,0 +1,221 @@
+package async_test
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/eluv-io/apexlog-go"
+	"github.com/eluv-io/apexlog-go/handlers/async"
+	"github.com/eluv-io/apexlog-go/handlers/memory"
+)
+
+// gate is a handler blocking until released. Entries are then passed to the
+// memory handler.
+type gate struct {
+	*memory.Handler
+	started chan string
+	release chan struct{}
+
+	mu      sync.Mutex
+	flushed int
+	closed  int
+}
+
+func newGate() *gate {
+	return &gate{
+		Handler: memory.New(),
+		started: make(chan string, 100),
+		release: make(chan struct{}),
+	}
+}
+
+func (g *gate) HandleLog(e *log.Entry) error {
+	g.started <- e.Message
+	<-g.release
+	return g.Handler.HandleLog(e)
+}
+
+func (g *gate) Flush() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.flushed++
+	return nil
+}
+
+func (g *gate) Close() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.closed++
+	return nil
+}
+
+func TestHandler(t *testing.T) {
+	mem := memory.New()
+	h := async.New(mem, &async.Config{Workers: 1})
+
+	// entries are pooled: they must stay valid until handled
+	l := &log.Logger{Handler: h, Level: log.InfoLevel}
+	var expected []string
+	for i := 0; i < 1000; i++ {
+		msg := strconv.Itoa(i)
+		l.Info(msg, "i", i)
+		expected = append(expected, msg)
+	}
+	require.NoError(t, h.Flush(context.Background()))
+
+	assert.Equal(t, expected, mem.Messages())
+	for i, e := range mem.Snapshot() {
+		assert.Equal(t, i, e.Fields.Get("i"))
+	}
+	assert.Equal(t, uint64(0), h.Dropped())
+
+	require.NoError(t, h.Close(context.Background()))
+	assert.Equal(t, async.ErrClosed, h.HandleLog(&log.Entry{}))
+	assert.NoError(t, h.Close(context.Background()))
+}
+
+func TestHandler_workers(t *testing.T) {
+	mem := memory.New()
+	h := async.New(mem, &async.Config{Workers: 4, QueueSize: 8})
+	l := &log.Logger{Handler: h, Level: log.InfoLevel}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				l.Info("hello")
+			}
+		}()
+	}
+	wg.Wait()
+	require.NoError(t, h.Close(context.Background()))
+	assert.Equal(t, 800, mem.Len())
+}
+
+// fill logs "0", waits for the worker to block on it, then logs the given
+// messages.
+func fill(t *testing.T, g *gate, h *async.Handler, msgs ...string) {
+	require.NoError(t, h.HandleLog(&log.Entry{Message: "0", Level: log.InfoLevel}))
+	assert.Equal(t, "0", <-g.started)
+	for _, msg := range msgs {
+		require.NoError(t, h.HandleLog(&log.Entry{Message: msg, Level: log.InfoLevel}))
+	}
+}
+
+func TestHandler_dropNewest(t *testing.T) {
+	g := newGate()
+	h := async.New(g, &async.Config{QueueSize: 2, Policy: async.DropNewest})
+
+	fill(t, g, h, "1", "2", "3", "4")
+	assert.Equal(t, uint64(2), h.Dropped())
+
+	close(g.release)
+	require.NoError(t, h.Close(context.Background()))
+	assert.Equal(t, []string{"0", "1", "2"}, g.Handler.Messages())
+}
+
+func TestHandler_dropOldest(t *testing.T) {
+	g := newGate()
+	h := async.New(g, &async.Config{QueueSize: 2, Policy: async.DropOldest})
+
+	fill(t, g, h, "1", "2", "3", "4")
+	assert.Equal(t, uint64(2), h.Dropped())
+
+	close(g.release)
+	require.NoError(t, h.Close(context.Background()))
+	assert.Equal(t, []string{"0", "3", "4"}, g.Handler.Messages())
+}
+
+func TestHandler_dropBelowError(t *testing.T) {
+	g := newGate()
+	h := async.New(g, &async.Config{QueueSize: 2, Policy: async.DropBelowError})
+
+	fill(t, g, h, "1", "2", "3")
+	assert.Equal(t, uint64(1), h.Dropped())
+
+	// errors wait for room
+	logged := make(chan struct{})
+	go func() {
+		defer close(logged)
+		assert.NoError(t, h.HandleLog(&log.Entry{Message: "error", Level: log.ErrorLevel}))
+	}()
+	select {
+	case <-logged:
+		t.Fatal("error dropped or queued in a full queue")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(g.release)
+	<-logged
+	require.NoError(t, h.Close(context.Background()))
+	assert.Equal(t, []string{"0", "1", "2", "error"}, g.Handler.Messages())
+	assert.Equal(t, uint64(1), h.Dropped())
+}
+
+func TestHandler_block(t *testing.T) {
+	g := newGate()
+	h := async.New(g, &async.Config{QueueSize: 1})
+
+	fill(t, g, h, "1")
+	logged := make(chan struct{})
+	go func() {
+		defer close(logged)
+		assert.NoError(t, h.HandleLog(&log.Entry{Message: "2"}))
+	}()
+	select {
+	case <-logged:
+		t.Fatal("not blocked")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(g.release)
+	<-logged
+	require.NoError(t, h.Close(context.Background()))
+	assert.Equal(t, []string{"0", "1", "2"}, g.Handler.Messages())
+	assert.Equal(t, uint64(0), h.Dropped())
+}
+
+func TestHandler_flush(t *testing.T) {
+	g := newGate()
+	h := async.New(g, nil)
+
+	fill(t, g, h, "1")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, h.Flush(ctx))
+
+	close(g.release)
+	require.NoError(t, h.Flush(context.Background()))
+	assert.Equal(t, []string{"0", "1"}, g.Handler.Messages())
+	assert.Equal(t, 1, g.flushed)
+}
+
+func TestHandler_close(t *testing.T) {
+	g := newGate()
+	h := async.New(g, nil)
+
+	fill(t, g, h, "1")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, h.Close(ctx))
+	assert.Equal(t, 0, g.closed)
+
+	// queued entries are still handled
+	close(g.release)
+	require.NoError(t, h.Close(context.Background()))
+	assert.Equal(t, []string{"0", "1"}, g.Handler.Messages())
+	assert.Equal(t, 1, g.closed)
+
+	require.NoError(t, h.Close(context.Background()))
+	assert.Equal(t, 1, g.closed)
+}
@@ -0,0 +1,327 @@
+// Package batch implements a handler buffering encoded entries and sending
+// them in batches to a BatchSink. It is the building block of network
+// handlers such as es: the sink encodes entries and sends batches, the
+// handler takes care of buffering, flushing and concurrency.
+//
+// A batch is taken once BatchSize entries or BatchBytes bytes are pending, or
+// every FlushInterval, and sent by one of MaxConcurrent goroutines. With a
+// single goroutine - the default - batches are sent in the order they were
+// taken. Errors of batches sent in the background are passed to OnError,
+// while Flush and Close block until the batches are sent and return the
+// error of the batch they took.
+//
+// Handlers encoding records themselves, e.g. grouping entries, pass them to
+// Add and Send instead of HandleLog, and only need a Sender.
+package batch
+
+import (
+	"errors"
+	stdlog "log"
+	"sync"
+	"time"
+
+	"github.com/eluv-io/apexlog-go"
+)
+
+// ErrClosed is returned when logging to a closed handler.
+var ErrClosed = errors.New("batch: handler closed")
+
+// Record is an encoded entry.
+type Record struct {
+	Key  string // Key is an optional sink specific key, e.g. the index or the stream of the entry
+	Data []byte // Data is the encoded entry
+}
+
+// Sender sends batches of records.
+type Sender interface {
+	// Send sends the batch, retrying as appropriate for the sink. It is
+	// called by up to MaxConcurrent goroutines at a time.
+	Send(batch []Record) error
+}
+
+// BatchSink encodes entries and sends batches of them.
+type BatchSink interface {
+	Sender
+
+	// Encode encodes the entry. It is called by HandleLog, possibly
+	// concurrently: the entry must not be retained.
+	Encode(e *log.Entry) (Record, error)
+}
+
+// Config for handler.
+type Config struct {
+	BatchSize     int                             // BatchSize is the number of entries to buffer before sending (default: 100)
+	BatchBytes    int                             // BatchBytes is the max size of the data of a batch, 0 for no limit
+	FlushInterval time.Duration                   // FlushInterval is the max time entries are buffered, 0 to only send full batches
+	MaxConcurrent int                             // MaxConcurrent is the max number of batches sent concurrently (default: 1)
+	QueueSize     int                             // QueueSize is the max number of batches waiting to be sent, HandleLog blocks beyond (default: 4)
+	OnError       func(err error, batch []Record) // OnError is called with the errors of batches sent in the background (default: print to the standard logger)
+}
+
+// defaults applies defaults to the config.
+func (c *Config) defaults() {
+	if c.BatchSize == 0 {
+		c.BatchSize = 100
+	}
+
+	if c.MaxConcurrent == 0 {
+		c.MaxConcurrent = 1
+	}
+
+	if c.QueueSize == 0 {
+		c.QueueSize = 4
+	}
+
+	if c.OnError == nil {
+		c.OnError = func(err error, batch []Record) {
+			stdlog.Printf("log/batch: failed to send %d logs: %s", len(batch), err)
+		}
+	}
+}
+
+// Handler implementation.
+type Handler struct {
+	*Config
+	sink Sender
+
+	mu       sync.Mutex
+	records  []Record
+	size     int // size is the size of the data of the pending records
+	closed   bool
+	inflight map[*flush]struct{} // inflight are the batches queued or being sent
+
+	sendMu  sync.Mutex // sendMu orders the sends to flushes
+	flushes chan *flush
+	done    chan struct{}
+	stopped chan struct{} // stopped is closed once all senders returned
+}
+
+// flush is a batch to send. done is closed once it was sent, err is then the
+// result of the send.
+type flush struct {
+	records []Record
+	report  bool // report passes errors to OnError
+	done    chan struct{}
+	err     error
+}
+
+// New handler sending batches to the sink. The sink must implement BatchSink
+// for HandleLog to encode entries, a Sender is enough for records passed to
+// Add and Send. The config may be nil.
+func New(sink Sender, config *Config) *Handler {
+	if config == nil {
+		config = &Config{}
+	}
+	config.defaults()
+
+	h := &Handler{
+		Config:   config,
+		sink:     sink,
+		inflight: make(map[*flush]struct{}),
+		flushes:  make(chan *flush, config.QueueSize),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(config.MaxConcurrent)
+	for i := 0; i < config.MaxConcurrent; i++ {
+		go func() {
+			defer wg.Done()
+			h.work()
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(h.stopped)
+	}()
+
+	if config.FlushInterval > 0 {
+		go h.tick()
+	}
+	return h
+}
+
+// HandleLog implements log.Handler. The entry is encoded before HandleLog
+// returns.
+func (h *Handler) HandleLog(e *log.Entry) error {
+	sink, ok := h.sink.(BatchSink)
+	if !ok {
+		return errNoEncoder
+	}
+
+	r, err := sink.Encode(e)
+	if err != nil {
+		return err
+	}
+	return h.Add(r)
+}
+
+// errNoEncoder is returned by HandleLog if the sink doesn't encode entries.
+var errNoEncoder = errors.New("batch: the sink doesn't implement BatchSink")
+
+// Add adds encoded records to the pending entries, taking batches as
+// HandleLog does.
+func (h *Handler) Add(records ...Record) error {
+	h.mu.Lock()
+
+	if h.closed {
+		h.mu.Unlock()
+		return ErrClosed
+	}
+
+	var fs []*flush
+	for _, r := range records {
+		if h.BatchBytes > 0 && len(h.records) > 0 && h.size+len(r.Data) > h.BatchBytes {
+			fs = append(fs, h.take(true))
+		}
+
+		h.records = append(h.records, r)
+		h.size += len(r.Data)
+		if len(h.records) >= h.BatchSize || (h.BatchBytes > 0 && h.size >= h.BatchBytes) {
+			fs = append(fs, h.take(true))
+		}
+	}
+
+	h.enqueue(fs...)
+	return nil
+}
+
+// Send sends the pending entries and the records in a single batch, and waits
+// until all batches were sent. It returns the error of the batch.
+func (h *Handler) Send(records ...Record) error {
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		return ErrClosed
+	}
+	for _, r := range records {
+		h.records = append(h.records, r)
+		h.size += len(r.Data)
+	}
+	return h.flush()
+}
+
+// take takes the pending records as a new batch. h.mu must be held.
+func (h *Handler) take(report bool) *flush {
+	f := &flush{records: h.records, report: report, done: make(chan struct{})}
+	h.records = nil
+	h.size = 0
+	h.inflight[f] = struct{}{}
+	return f
+}
+
+// pending returns the batches queued or being sent. h.mu must be held.
+func (h *Handler) pending() []*flush {
+	ret := make([]*flush, 0, len(h.inflight))
+	for f := range h.inflight {
+		ret = append(ret, f)
+	}
+	return ret
+}
+
+// enqueue queues the batches for the senders and releases h.mu, which must be
+// held by the caller. Batches are queued in the order they are taken, even if
+// the queue is full.
+func (h *Handler) enqueue(fs ...*flush) {
+	if len(fs) == 0 {
+		h.mu.Unlock()
+		return
+	}
+
+	h.sendMu.Lock()
+	h.mu.Unlock()
+	for _, f := range fs {
+		h.flushes <- f
+	}
+	h.sendMu.Unlock()
+}
+
+// Flush sends the pending entries and waits until all batches were sent. It
+// returns the error of the batch of pending entries.
+func (h *Handler) Flush() error {
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		return nil
+	}
+	return h.flush()
+}
+
+// Close flushes the handler and stops its goroutines. Entries logged
+// afterwards are rejected with ErrClosed.
+func (h *Handler) Close() error {
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		return nil
+	}
+	h.closed = true
+	err := h.flush()
+
+	close(h.done)
+	h.sendMu.Lock()
+	close(h.flushes)
+	h.sendMu.Unlock()
+	<-h.stopped
+	return err
+}
+
+// flush queues the pending entries, releases h.mu, which must be held by the
+// caller, and waits until the batch and the ones taken before were sent.
+func (h *Handler) flush() error {
+	var f *flush
+	if len(h.records) > 0 {
+		f = h.take(false)
+	}
+	wait := h.pending()
+	if f != nil {
+		h.enqueue(f)
+	} else {
+		h.mu.Unlock()
+	}
+
+	for _, w := range wait {
+		<-w.done
+	}
+	if f != nil {
+		return f.err
+	}
+	return nil
+}
+
+// work sends the queued batches until the handler is closed.
+func (h *Handler) work() {
+	for f := range h.flushes {
+		f.err = h.sink.Send(f.records)
+		if f.err != nil && f.report {
+			h.OnError(f.err, f.records)
+		}
+
+		h.mu.Lock()
+		delete(h.inflight, f)
+		h.mu.Unlock()
+		close(f.done)
+	}
+}
+
+// tick queues the pending entries every FlushInterval until the handler is
+// closed.
+func (h *Handler) tick() {
+	ticker := time.NewTicker(h.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			h.mu.Lock()
+			if h.closed || len(h.records) == 0 {
+				h.mu.Unlock()
+				continue
+			}
+			h.enqueue(h.take(true))
+		case <-h.done:
+			return
+		}
+	}
+}
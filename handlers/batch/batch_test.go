@@ -0,0 +1,194 @@
+package batch_test
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/eluv-io/apexlog-go"
+	"github.com/eluv-io/apexlog-go/handlers/batch"
+)
+
+// sink records the batches of messages it is sent. Sends block while gate is
+// not nil and fail with err.
+type sink struct {
+	mu      sync.Mutex
+	batches [][]string
+	err     error
+	gate    chan struct{}
+	sending chan struct{}
+	active  int
+	peak    int // peak is the max number of concurrent sends
+}
+
+func (s *sink) Encode(e *log.Entry) (batch.Record, error) {
+	if e.Message == "invalid" {
+		return batch.Record{}, errors.New("invalid")
+	}
+	return batch.Record{Key: e.Level.String(), Data: []byte(e.Message)}, nil
+}
+
+func (s *sink) Send(records []batch.Record) error {
+	s.mu.Lock()
+	s.active++
+	if s.active > s.peak {
+		s.peak = s.active
+	}
+	gate := s.gate
+	s.mu.Unlock()
+
+	if gate != nil {
+		s.sending <- struct{}{}
+		<-gate
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active--
+	var msgs []string
+	for _, r := range records {
+		msgs = append(msgs, string(r.Data))
+	}
+	s.batches = append(s.batches, msgs)
+	return s.err
+}
+
+func (s *sink) received() [][]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([][]string(nil), s.batches...)
+}
+
+func TestHandler(t *testing.T) {
+	s := &sink{}
+	h := batch.New(s, &batch.Config{BatchSize: 2})
+	l := &log.Logger{Handler: h, Level: log.InfoLevel}
+
+	for i := 0; i < 5; i++ {
+		l.Info(strconv.Itoa(i))
+	}
+	assert.Error(t, h.HandleLog(&log.Entry{Message: "invalid"}))
+	require.NoError(t, h.Flush())
+	assert.Equal(t, [][]string{{"0", "1"}, {"2", "3"}, {"4"}}, s.received())
+
+	// nothing pending
+	require.NoError(t, h.Flush())
+	assert.Len(t, s.received(), 3)
+
+	l.Info("5")
+	require.NoError(t, h.Close())
+	assert.Equal(t, []string{"5"}, s.received()[3])
+
+	assert.Equal(t, batch.ErrClosed, h.HandleLog(&log.Entry{}))
+	assert.NoError(t, h.Flush())
+	assert.NoError(t, h.Close())
+}
+
+func TestHandler_bytes(t *testing.T) {
+	s := &sink{}
+	h := batch.New(s, &batch.Config{BatchBytes: 4})
+	l := &log.Logger{Handler: h, Level: log.InfoLevel}
+
+	for _, msg := range []string{"aa", "b", "cc", "dddddd", "e"} {
+		l.Info(msg)
+	}
+	require.NoError(t, h.Close())
+	assert.Equal(t, [][]string{{"aa", "b"}, {"cc"}, {"dddddd"}, {"e"}}, s.received())
+}
+
+// sender only sends records, it doesn't encode entries.
+type sender struct {
+	sink *sink
+}
+
+func (s sender) Send(records []batch.Record) error {
+	return s.sink.Send(records)
+}
+
+func TestHandler_Add(t *testing.T) {
+	s := &sink{}
+	h := batch.New(sender{s}, &batch.Config{BatchSize: 2})
+
+	assert.Error(t, h.HandleLog(&log.Entry{Message: "a"}))
+	require.NoError(t, h.Add(batch.Record{Data: []byte("a")}, batch.Record{Data: []byte("b")}, batch.Record{Data: []byte("c")}))
+
+	// sent with the pending records as a single batch
+	require.NoError(t, h.Send(batch.Record{Data: []byte("d")}, batch.Record{Data: []byte("e")}))
+	assert.Equal(t, [][]string{{"a", "b"}, {"c", "d", "e"}}, s.received())
+
+	s.mu.Lock()
+	s.err = errors.New("boom")
+	s.mu.Unlock()
+	assert.EqualError(t, h.Send(batch.Record{Data: []byte("f")}), "boom")
+
+	require.NoError(t, h.Close())
+	assert.Equal(t, batch.ErrClosed, h.Add(batch.Record{}))
+	assert.Equal(t, batch.ErrClosed, h.Send())
+}
+
+func TestHandler_interval(t *testing.T) {
+	s := &sink{}
+	h := batch.New(s, &batch.Config{FlushInterval: 10 * time.Millisecond})
+	defer h.Close()
+
+	require.NoError(t, h.HandleLog(&log.Entry{Message: "hello"}))
+	require.Eventually(t, func() bool {
+		return len(s.received()) == 1
+	}, time.Second, 5*time.Millisecond)
+	assert.Equal(t, [][]string{{"hello"}}, s.received())
+}
+
+func TestHandler_errors(t *testing.T) {
+	s := &sink{err: errors.New("boom")}
+	reported := make(chan []batch.Record, 1)
+	h := batch.New(s, &batch.Config{
+		BatchSize: 1,
+		OnError: func(err error, records []batch.Record) {
+			assert.EqualError(t, err, "boom")
+			reported <- records
+		},
+	})
+
+	// background sends are reported
+	require.NoError(t, h.HandleLog(&log.Entry{Message: "a"}))
+	assert.Equal(t, []byte("a"), (<-reported)[0].Data)
+
+	// flushed batches return their error
+	h.BatchSize = 10
+	require.NoError(t, h.HandleLog(&log.Entry{Message: "b"}))
+	assert.EqualError(t, h.Flush(), "boom")
+	require.NoError(t, h.HandleLog(&log.Entry{Message: "c"}))
+	assert.EqualError(t, h.Close(), "boom")
+	assert.Empty(t, reported)
+}
+
+func TestHandler_concurrency(t *testing.T) {
+	s := &sink{gate: make(chan struct{}), sending: make(chan struct{}, 10)}
+	h := batch.New(s, &batch.Config{BatchSize: 1, MaxConcurrent: 2})
+
+	for i := 0; i < 4; i++ {
+		require.NoError(t, h.HandleLog(&log.Entry{Message: strconv.Itoa(i)}))
+	}
+	<-s.sending
+	<-s.sending
+
+	// Flush waits for the batches being sent
+	flushed := make(chan error)
+	go func() { flushed <- h.Flush() }()
+	select {
+	case <-flushed:
+		t.Fatal("flush returned before delivery")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(s.gate)
+	require.NoError(t, <-flushed)
+	require.NoError(t, h.Close())
+	assert.Len(t, s.received(), 4)
+	assert.Equal(t, 2, s.peak)
+}
@@ -6,7 +6,6 @@ import (
 	"io"
 	"os"
 	"sync"
-	"time"
 
 	"github.com/eluv-io/apexlog-go"
 	"github.com/fatih/color"
@@ -16,9 +15,6 @@ import (
 // Default handler outputting to stderr.
 var Default = New(os.Stderr)
 
-// start time.
-var start = time.Now()
-
 var bold = color.New(color.Bold)
 
 // Colors mapping.
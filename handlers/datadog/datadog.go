@@ -0,0 +1,366 @@
+// Package datadog implements a handler posting batches of entries to the
+// Datadog HTTP logs intake, for agentless log shipping.
+//
+// Entries are encoded when logged, with the level as "status" and errors as
+// the reserved "error.*" attributes. Batches are posted in order by a
+// batch.Handler once BatchSize entries are pending, before they would exceed
+// BatchBytes, or every FlushInterval. Entries larger than MaxEntryBytes are
+// sent without their fields and with their message truncated.
+package datadog
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	stdlog "log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	pkgerrors "github.com/pkg/errors"
+
+	"github.com/eluv-io/apexlog-go"
+	"github.com/eluv-io/apexlog-go/handlers/batch"
+)
+
+// Limits of the logs intake.
+const (
+	MaxBatchSize  = 1000    // MaxBatchSize is the max number of entries per request
+	MaxBatchBytes = 5 << 20 // MaxBatchBytes is the max uncompressed size of requests
+	MaxEntryBytes = 1 << 20 // MaxEntryBytes is the max size of an entry
+)
+
+// ErrClosed is returned when logging to a closed handler.
+var ErrClosed = errors.New("datadog: handler closed")
+
+// Config for handler.
+type Config struct {
+	URL           string        // URL is the logs intake URL of the Datadog site (default: "https://http-intake.logs.datadoghq.com/api/v2/logs")
+	APIKey        string        // APIKey is the Datadog API key
+	Client        *http.Client  // Client is the HTTP client (default: client with a 10s timeout)
+	Source        string        // Source is the "ddsource" attribute (default: "go")
+	Service       string        // Service is the "service" attribute (default: the executable name)
+	Hostname      string        // Hostname is the "hostname" attribute (default: os.Hostname())
+	Tags          []string      // Tags are the "ddtags" of all entries, e.g. "env:prod"
+	Gzip          bool          // Gzip compresses request bodies
+	BatchSize     int           // BatchSize is the number of entries to buffer before posting (default and max: MaxBatchSize)
+	BatchBytes    int           // BatchBytes is the max size of a request (default and max: MaxBatchBytes)
+	MaxEntryBytes int           // MaxEntryBytes is the max size of an entry (default and max: MaxEntryBytes)
+	FlushInterval time.Duration // FlushInterval is the max time entries are buffered (default: 1s)
+	Retries       int           // Retries is the number of retries of failed requests (default: 5)
+	RetryBackoff  time.Duration // RetryBackoff is the delay before the first retry, doubled for each retry (default: 500ms)
+}
+
+// defaults applies defaults to the config.
+func (c *Config) defaults() {
+	if c.URL == "" {
+		c.URL = "https://http-intake.logs.datadoghq.com/api/v2/logs"
+	}
+
+	if c.Client == nil {
+		c.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	if c.Source == "" {
+		c.Source = "go"
+	}
+
+	if c.Service == "" && len(os.Args) > 0 {
+		c.Service = filepath.Base(os.Args[0])
+	}
+
+	if c.Hostname == "" {
+		c.Hostname, _ = os.Hostname()
+	}
+
+	if c.BatchSize <= 0 || c.BatchSize > MaxBatchSize {
+		c.BatchSize = MaxBatchSize
+	}
+
+	if c.BatchBytes <= 0 || c.BatchBytes > MaxBatchBytes {
+		c.BatchBytes = MaxBatchBytes
+	}
+
+	if c.MaxEntryBytes <= 0 || c.MaxEntryBytes > MaxEntryBytes {
+		c.MaxEntryBytes = MaxEntryBytes
+	}
+	if c.MaxEntryBytes > c.BatchBytes-2 {
+		c.MaxEntryBytes = c.BatchBytes - 2
+	}
+
+	if c.FlushInterval == 0 {
+		c.FlushInterval = time.Second
+	}
+
+	if c.Retries == 0 {
+		c.Retries = 5
+	}
+
+	if c.RetryBackoff == 0 {
+		c.RetryBackoff = 500 * time.Millisecond
+	}
+}
+
+// reserved are the attributes written by the handler. Fields with these names
+// are prefixed with "fields.".
+var reserved = map[string]bool{
+	"message":  true,
+	"status":   true,
+	"date":     true,
+	"ddsource": true,
+	"service":  true,
+	"hostname": true,
+	"ddtags":   true,
+}
+
+// Handler implementation.
+type Handler struct {
+	*Config
+	batch *batch.Handler
+}
+
+// New handler.
+func New(config *Config) *Handler {
+	config.defaults()
+	s := &sink{Config: config}
+	s.meta = s.appendMeta(nil)
+	return &Handler{
+		Config: config,
+		batch: batch.New(s, &batch.Config{
+			BatchSize: config.BatchSize,
+			// records end with a comma: one byte is left for the brackets
+			BatchBytes:    config.BatchBytes - 1,
+			FlushInterval: config.FlushInterval,
+			OnError: func(err error, entries []batch.Record) {
+				stdlog.Printf("log/datadog: failed to send %d logs: %s", len(entries), err)
+			},
+		}),
+	}
+}
+
+// Status returns the Datadog status of the given level.
+func Status(level log.Level) string {
+	switch level {
+	case log.TraceLevel, log.DebugLevel:
+		return "debug"
+	case log.InfoLevel:
+		return "info"
+	case log.WarnLevel:
+		return "warning"
+	case log.ErrorLevel:
+		return "error"
+	case log.FatalLevel:
+		return "critical"
+	}
+	return "info"
+}
+
+// HandleLog implements log.Handler.
+func (h *Handler) HandleLog(e *log.Entry) error {
+	err := h.batch.HandleLog(e)
+	if err == batch.ErrClosed {
+		return ErrClosed
+	}
+	return err
+}
+
+// Flush posts the pending entries and waits until all batches were posted.
+func (h *Handler) Flush() error {
+	return h.batch.Flush()
+}
+
+// Close flushes the handler. Entries logged afterwards are rejected with
+// ErrClosed.
+func (h *Handler) Close() error {
+	return h.batch.Close()
+}
+
+// sink implements batch.BatchSink.
+type sink struct {
+	*Config
+
+	meta []byte // meta are the encoded attributes common to all entries
+}
+
+// Encode implements batch.BatchSink. The record is the encoded entry followed
+// by a comma, entries larger than MaxEntryBytes are truncated.
+func (s *sink) Encode(e *log.Entry) (batch.Record, error) {
+	entry, err := s.appendEntry(nil, e, e.Message, true)
+	if err != nil {
+		return batch.Record{}, err
+	}
+	if len(entry) > s.MaxEntryBytes {
+		entry = s.truncate(e)
+	}
+	return batch.Record{Data: append(entry, ',')}, nil
+}
+
+// Send implements batch.BatchSink, posting the entries as a JSON array.
+func (s *sink) Send(entries []batch.Record) error {
+	b := []byte{'['}
+	for _, e := range entries {
+		b = append(b, e.Data...)
+	}
+	b[len(b)-1] = ']'
+	return s.send(b)
+}
+
+// truncate returns the encoding of the entry without its fields and with its
+// message truncated to fit in MaxEntryBytes.
+func (s *sink) truncate(e *log.Entry) []byte {
+	entry, _ := s.appendEntry(nil, e, "", false)
+	room := s.MaxEntryBytes - len(entry)
+	msg := e.Message
+	for room > 0 && len(msg) > 0 {
+		// escaping may grow the message: shrink until the encoding fits
+		if len(msg) > room {
+			msg = msg[:room]
+		}
+		msg = strings.ToValidUTF8(msg, "")
+		encoded, _ := s.appendEntry(nil, e, msg, false)
+		if len(encoded) <= s.MaxEntryBytes {
+			return encoded
+		}
+		room -= len(encoded) - s.MaxEntryBytes
+	}
+	return entry
+}
+
+// send posts the body in a single request, retrying on failures.
+func (s *sink) send(body []byte) error {
+	if s.Gzip {
+		var gz bytes.Buffer
+		w := gzip.NewWriter(&gz)
+		_, _ = w.Write(body)
+		_ = w.Close()
+		body = gz.Bytes()
+	}
+
+	backoff := s.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		retry, err := s.post(body)
+		if err == nil || !retry || attempt >= s.Retries {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// post posts the body to the intake. It returns whether the request should be
+// retried if it failed.
+func (s *sink) post(body []byte) (retry bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("DD-API-KEY", s.APIKey)
+	if s.Gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+
+	res, err := s.Client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer res.Body.Close()
+	msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return false, nil
+	}
+
+	err = fmt.Errorf("datadog: %s responded with %s: %s", s.URL, res.Status, strings.TrimSpace(string(msg)))
+	switch {
+	case res.StatusCode == http.StatusRequestTimeout, res.StatusCode == http.StatusTooManyRequests, res.StatusCode >= 500:
+		return true, err
+	}
+	return false, err
+}
+
+// appendMeta appends the attributes of the config.
+func (s *sink) appendMeta(dst []byte) []byte {
+	var js log.JSONEncoder
+	for _, kv := range [][2]string{
+		{"ddsource", s.Source},
+		{"service", s.Service},
+		{"hostname", s.Hostname},
+		{"ddtags", strings.Join(s.Tags, ",")},
+	} {
+		if kv[1] == "" {
+			continue
+		}
+		dst = append(dst, ',')
+		dst = js.AppendKey(dst, kv[0])
+		dst = js.AppendString(dst, kv[1])
+	}
+	return dst
+}
+
+// stackTracer is implemented by errors of github.com/pkg/errors.
+type stackTracer interface {
+	StackTrace() pkgerrors.StackTrace
+}
+
+// appendEntry appends the entry with the given message. The error of the
+// entry is written as the error.message, error.kind and error.stack
+// attributes - errors logged without WithError only as error.message, from
+// the "error" field - the other fields as attributes if fields is true.
+func (s *sink) appendEntry(dst []byte, e *log.Entry, msg string, fields bool) ([]byte, error) {
+	var js log.JSONEncoder
+
+	dst = append(dst, '{')
+	dst = js.AppendKey(dst, "message")
+	dst = js.AppendString(dst, msg)
+	dst = append(dst, `,"status":"`...)
+	dst = append(dst, Status(e.Level)...)
+	dst = append(dst, `","date":`...)
+	dst = js.AppendTime(dst, e.Timestamp)
+	dst = append(dst, s.meta...)
+
+	cause := e.Err()
+	errMsg, isErr := e.Fields.Get("error").(string)
+	if cause != nil {
+		errMsg, isErr = cause.Error(), true
+	}
+	if isErr {
+		dst = append(dst, `,"error":{"message":`...)
+		dst = js.AppendString(dst, errMsg)
+		if cause != nil {
+			dst = append(dst, `,"kind":`...)
+			dst = js.AppendString(dst, fmt.Sprintf("%T", pkgerrors.Cause(cause)))
+		}
+		if st, ok := cause.(stackTracer); ok {
+			dst = append(dst, `,"stack":`...)
+			dst = js.AppendString(dst, strings.TrimPrefix(fmt.Sprintf("%+v", st.StackTrace()), "\n"))
+		}
+		dst = append(dst, '}')
+	}
+
+	if fields {
+		var err error
+		for _, f := range e.Fields {
+			if f.Name == "error" && isErr {
+				continue
+			}
+			dst = append(dst, ',')
+			if reserved[f.Name] {
+				dst = js.AppendKey(dst, "fields."+f.Name)
+			} else {
+				dst = js.AppendKey(dst, f.Name)
+			}
+			if dst, err = js.AppendValue(dst, f.Value); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return append(dst, '}'), nil
+}
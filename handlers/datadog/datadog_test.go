@@ -0,0 +1,271 @@
+package datadog_test
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/eluv-io/apexlog-go"
+	"github.com/eluv-io/apexlog-go/handlers/datadog"
+	"github.com/eluv-io/apexlog-go/logtest"
+)
+
+// intake is a stand-in for the logs intake. status returns the status of the
+// n-th request, all requests succeed if nil.
+type intake struct {
+	*httptest.Server
+	status func(n int) int
+
+	mu       sync.Mutex
+	requests []*http.Request
+	sizes    []int // sizes are the uncompressed body sizes
+	batches  [][]map[string]interface{}
+}
+
+func newIntake(t *testing.T, status func(n int) int) *intake {
+	in := &intake{status: status}
+	in.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		in.mu.Lock()
+		defer in.mu.Unlock()
+
+		var body io.Reader = r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(r.Body)
+			require.NoError(t, err)
+			body = gz
+		}
+		b, err := ioutil.ReadAll(body)
+		require.NoError(t, err)
+
+		n := len(in.requests)
+		in.requests = append(in.requests, r)
+		if in.status != nil {
+			if status := in.status(n); status != http.StatusAccepted {
+				w.WriteHeader(status)
+				return
+			}
+		}
+
+		var batch []map[string]interface{}
+		require.NoError(t, json.Unmarshal(b, &batch))
+		in.sizes = append(in.sizes, len(b))
+		in.batches = append(in.batches, batch)
+		w.WriteHeader(http.StatusAccepted)
+		_, _ = w.Write([]byte("{}"))
+	}))
+	return in
+}
+
+func (in *intake) received() ([]*http.Request, [][]map[string]interface{}) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return append([]*http.Request(nil), in.requests...), append([][]map[string]interface{}(nil), in.batches...)
+}
+
+func newLogger(h log.Handler) *log.Logger {
+	return &log.Logger{
+		Handler: h,
+		Level:   log.InfoLevel,
+		Clock:   logtest.NewClock(logtest.Timestamp),
+	}
+}
+
+func TestHandler(t *testing.T) {
+	in := newIntake(t, nil)
+	defer in.Close()
+
+	h := datadog.New(&datadog.Config{
+		URL:           in.URL,
+		APIKey:        "key",
+		Service:       "api",
+		Hostname:      "web-1",
+		Tags:          []string{"env:prod", "team:core"},
+		FlushInterval: time.Hour,
+	})
+	l := newLogger(h)
+
+	l.Info("hello", "user", "tj", "count", 3, "service", "collides")
+	l.WithError(errors.New("boom")).Error("failed")
+	l.Error("failed again", errors.New("boom"))
+	require.NoError(t, h.Close())
+
+	requests, batches := in.received()
+	require.Len(t, requests, 1)
+	assert.Equal(t, "key", requests[0].Header.Get("DD-API-KEY"))
+	assert.Equal(t, "application/json", requests[0].Header.Get("Content-Type"))
+
+	require.Len(t, batches, 1)
+	require.Len(t, batches[0], 3)
+	assert.Equal(t, map[string]interface{}{
+		"message":        "hello",
+		"status":         "info",
+		"date":           "2020-01-02T03:04:05Z",
+		"ddsource":       "go",
+		"service":        "api",
+		"hostname":       "web-1",
+		"ddtags":         "env:prod,team:core",
+		"user":           "tj",
+		"count":          float64(3),
+		"fields.service": "collides",
+	}, batches[0][0])
+
+	failed := batches[0][1]
+	assert.Equal(t, "error", failed["status"])
+	assert.NotContains(t, failed, "fields.error")
+	errAttr := failed["error"].(map[string]interface{})
+	assert.Equal(t, "boom", errAttr["message"])
+	assert.Equal(t, "*errors.fundamental", errAttr["kind"])
+	assert.Contains(t, errAttr["stack"], "TestHandler")
+
+	// without WithError, only the message of the error is available
+	failed = batches[0][2]
+	assert.NotContains(t, failed, "fields.error")
+	assert.Equal(t, map[string]interface{}{"message": "boom"}, failed["error"])
+
+	assert.Equal(t, datadog.ErrClosed, h.HandleLog(&log.Entry{}))
+}
+
+func TestStatus(t *testing.T) {
+	assert.Equal(t, "debug", datadog.Status(log.TraceLevel))
+	assert.Equal(t, "debug", datadog.Status(log.DebugLevel))
+	assert.Equal(t, "info", datadog.Status(log.InfoLevel))
+	assert.Equal(t, "warning", datadog.Status(log.WarnLevel))
+	assert.Equal(t, "error", datadog.Status(log.ErrorLevel))
+	assert.Equal(t, "critical", datadog.Status(log.FatalLevel))
+}
+
+func TestHandler_batchSize(t *testing.T) {
+	in := newIntake(t, nil)
+	defer in.Close()
+
+	h := datadog.New(&datadog.Config{
+		URL:           in.URL,
+		Gzip:          true,
+		BatchSize:     2,
+		FlushInterval: time.Hour,
+	})
+	l := newLogger(h)
+
+	for i := 0; i < 5; i++ {
+		l.Info("hello", "i", i)
+	}
+	require.NoError(t, h.Close())
+
+	requests, batches := in.received()
+	assert.Equal(t, "gzip", requests[0].Header.Get("Content-Encoding"))
+	require.Len(t, batches, 3)
+	assert.Len(t, batches[0], 2)
+	assert.Len(t, batches[2], 1)
+	assert.Equal(t, float64(4), batches[2][0]["i"])
+}
+
+func TestHandler_batchBytes(t *testing.T) {
+	in := newIntake(t, nil)
+	defer in.Close()
+
+	h := datadog.New(&datadog.Config{
+		URL:           in.URL,
+		BatchBytes:    1000,
+		FlushInterval: time.Hour,
+	})
+	l := newLogger(h)
+
+	msg := strings.Repeat("x", 200)
+	for i := 0; i < 10; i++ {
+		l.Info(msg, "i", i)
+	}
+	require.NoError(t, h.Close())
+
+	_, batches := in.received()
+	assert.True(t, len(batches) > 1)
+	count := 0
+	for _, b := range batches {
+		count += len(b)
+	}
+	assert.Equal(t, 10, count)
+
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	for _, size := range in.sizes {
+		assert.True(t, size <= 1000, size)
+	}
+}
+
+func TestHandler_truncate(t *testing.T) {
+	in := newIntake(t, nil)
+	defer in.Close()
+
+	h := datadog.New(&datadog.Config{
+		URL:           in.URL,
+		MaxEntryBytes: 500,
+		FlushInterval: time.Hour,
+	})
+
+	newLogger(h).Info(strings.Repeat("é", 1000), "data", strings.Repeat("y", 1000))
+	require.NoError(t, h.Close())
+
+	_, batches := in.received()
+	require.Len(t, batches, 1)
+	entry := batches[0][0]
+	assert.NotContains(t, entry, "data")
+	msg := entry["message"].(string)
+	assert.NotEmpty(t, msg)
+	assert.True(t, strings.HasPrefix(strings.Repeat("é", 1000), msg))
+
+	b, err := json.Marshal(entry)
+	require.NoError(t, err)
+	assert.True(t, len(b) <= 500, len(b))
+}
+
+func TestHandler_retry(t *testing.T) {
+	in := newIntake(t, func(n int) int {
+		if n < 2 {
+			return http.StatusTooManyRequests
+		}
+		return http.StatusAccepted
+	})
+	defer in.Close()
+
+	h := datadog.New(&datadog.Config{
+		URL:           in.URL,
+		RetryBackoff:  time.Millisecond,
+		FlushInterval: time.Hour,
+	})
+
+	newLogger(h).Info("hello")
+	require.NoError(t, h.Close())
+
+	requests, batches := in.received()
+	assert.Len(t, requests, 3)
+	assert.Len(t, batches, 1)
+}
+
+func TestHandler_error(t *testing.T) {
+	in := newIntake(t, func(int) int {
+		return http.StatusForbidden
+	})
+	defer in.Close()
+
+	h := datadog.New(&datadog.Config{
+		URL:           in.URL,
+		FlushInterval: time.Hour,
+	})
+
+	newLogger(h).Info("hello")
+	assert.Error(t, h.Close())
+
+	// not retried
+	requests, _ := in.received()
+	assert.Len(t, requests, 1)
+}
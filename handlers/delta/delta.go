@@ -73,7 +73,7 @@ var Default = New(os.Stderr)
 // Handler implementation.
 type Handler struct {
 	entries chan *log.Entry
-	start   time.Time
+	start   time.Time // start of the current delta, from the entries' clock
 	spin    *spin.Spinner
 	prev    *log.Entry
 	done    chan struct{}
@@ -85,7 +85,6 @@ func New(w io.Writer) *Handler {
 	h := &Handler{
 		entries: make(chan *log.Entry),
 		done:    make(chan struct{}),
-		start:   time.Now(),
 		spin:    spin.New(),
 		w:       w,
 	}
@@ -112,6 +111,7 @@ func (h *Handler) loop() {
 		case e := <-h.entries:
 			if h.prev != nil {
 				h.render(h.prev, true)
+				h.prev.Release()
 			}
 			h.render(e, false)
 			h.prev = e
@@ -124,6 +124,8 @@ func (h *Handler) loop() {
 			ticker.Stop()
 			if h.prev != nil {
 				h.render(h.prev, true)
+				h.prev.Release()
+				h.prev = nil
 			}
 			return
 		}
@@ -134,11 +136,17 @@ func (h *Handler) render(e *log.Entry, done bool) {
 	color := Colors[e.Level]
 	level := Strings[e.Level]
 
+	clock := e.Clock()
+	if h.start.IsZero() {
+		h.start = clock.Start()
+	}
+	delta := clock.Now().Sub(h.start).Round(time.Millisecond)
+
 	// delta and spinner
 	if done {
-		_, _ = fmt.Fprintf(h.w, "\r     %-7s", time.Since(h.start).Round(time.Millisecond))
+		_, _ = fmt.Fprintf(h.w, "\r     %-7s", delta)
 	} else {
-		_, _ = fmt.Fprintf(h.w, "\r   %s %-7s", h.spin.Current(), time.Since(h.start).Round(time.Millisecond))
+		_, _ = fmt.Fprintf(h.w, "\r   %s %-7s", h.spin.Current(), delta)
 	}
 
 	// message
@@ -158,12 +166,12 @@ func (h *Handler) render(e *log.Entry, done bool) {
 	// newline
 	if done {
 		_, _ = fmt.Fprintf(h.w, "\n")
-		h.start = time.Now()
+		h.start = clock.Now()
 	}
 }
 
 // HandleLog implements log.Handler.
 func (h *Handler) HandleLog(e *log.Entry) error {
-	h.entries <- e
+	h.entries <- e.Retain()
 	return nil
 }
@@ -0,0 +1,648 @@
+// Package errtrack implements a handler grouping error and fatal entries into
+// issues and reporting them to an error tracker accepting Sentry envelopes.
+//
+// Entries are grouped by a fingerprint computed from their message template -
+// the message with numbers and quoted strings replaced by placeholders - the
+// type of their error and the top frame of its stack. Each issue counts its
+// occurrences and keeps its first and last seen times and the fields of its
+// last occurrence. New issues are reported when first seen; issues with new
+// occurrences are reported again every DigestInterval with their counts.
+// Fatal entries are reported before HandleLog returns, since the process
+// exits right after.
+//
+// Entries below the error level are ignored: the handler is meant to be used
+// along other handlers, see the multi handler.
+package errtrack
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	stdlog "log"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	pkgerrors "github.com/pkg/errors"
+
+	"github.com/eluv-io/apexlog-go"
+	"github.com/eluv-io/apexlog-go/handlers/batch"
+)
+
+// ErrClosed is returned when logging to a closed handler.
+var ErrClosed = errors.New("errtrack: handler closed")
+
+// Client is the client name reported to the error tracker.
+const Client = "apexlog-go/1.0"
+
+// Config for handler.
+type Config struct {
+	DSN            string            // DSN is the Sentry DSN of the project: "https://<key>@<host>/<project>"
+	Client         *http.Client      // Client is the HTTP client (default: client with a 10s timeout)
+	Environment    string            // Environment of the events
+	Release        string            // Release of the events
+	ServerName     string            // ServerName of the events (default: os.Hostname())
+	Tags           map[string]string // Tags are added to all events
+	DigestInterval time.Duration     // DigestInterval is the interval of the reports of issues with new occurrences (default: 10m)
+	MaxIssues      int               // MaxIssues is the max number of issues tracked, the least recently seen are dropped beyond (default: 1000)
+	Retries        int               // Retries is the number of retries of failed requests (default: 3)
+	RetryBackoff   time.Duration     // RetryBackoff is the delay before the first retry, doubled for each retry (default: 500ms)
+	Clock          log.Clock         // Clock is used for the send time of events (default: log.SystemClock)
+}
+
+// defaults applies defaults to the config.
+func (c *Config) defaults() {
+	if c.Client == nil {
+		c.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	if c.ServerName == "" {
+		c.ServerName, _ = os.Hostname()
+	}
+
+	if c.DigestInterval == 0 {
+		c.DigestInterval = 10 * time.Minute
+	}
+
+	if c.MaxIssues == 0 {
+		c.MaxIssues = 1000
+	}
+
+	if c.Retries == 0 {
+		c.Retries = 3
+	}
+
+	if c.RetryBackoff == 0 {
+		c.RetryBackoff = 500 * time.Millisecond
+	}
+
+	if c.Clock == nil {
+		c.Clock = log.SystemClock
+	}
+}
+
+// Issue is a group of entries with the same fingerprint.
+type Issue struct {
+	Fingerprint string          // Fingerprint identifies the issue
+	Template    string          // Template is the message template
+	Message     string          // Message is the message of the last occurrence
+	Type        string          // Type is the type of the error, if any
+	Frame       string          // Frame is the function of the top frame of the error stack, if any
+	Level       log.Level       // Level is the level of the last occurrence
+	Count       int             // Count is the number of occurrences
+	FirstSeen   time.Time       // FirstSeen is the time of the first occurrence
+	LastSeen    time.Time       // LastSeen is the time of the last occurrence
+	Fields      json.RawMessage // Fields are the fields of the last occurrence
+
+	err     string  // err is the error message of the last occurrence
+	frames  []frame // frames are the stack frames, oldest first
+	pending int     // pending is the number of occurrences since the last report
+}
+
+// Handler implementation.
+type Handler struct {
+	*Config
+	batch *batch.Handler
+
+	mu     sync.Mutex
+	issues map[string]*list.Element // issues are the elements of lru
+	lru    *list.List               // lru are the issues, most recently seen first
+	closed bool
+
+	done chan struct{}
+}
+
+// New handler. It returns an error if the DSN is invalid.
+func New(config *Config) (*Handler, error) {
+	endpoint, key, err := parseDSN(config.DSN)
+	if err != nil {
+		return nil, err
+	}
+
+	config.defaults()
+	s := &sink{
+		Config:   config,
+		endpoint: endpoint,
+		auth:     fmt.Sprintf("Sentry sentry_version=7, sentry_client=%s, sentry_key=%s", Client, key),
+	}
+	h := &Handler{
+		Config: config,
+		batch: batch.New(s, &batch.Config{
+			BatchSize: 1,
+			QueueSize: 16,
+			OnError: func(err error, envelopes []batch.Record) {
+				stdlog.Printf("log/errtrack: failed to send %d issues: %s", len(envelopes), err)
+			},
+		}),
+		issues: make(map[string]*list.Element),
+		lru:    list.New(),
+		done:   make(chan struct{}),
+	}
+	go h.tick()
+	return h, nil
+}
+
+// parseDSN returns the envelope endpoint and the public key of the DSN.
+func parseDSN(dsn string) (endpoint, key string, err error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "", "", fmt.Errorf("errtrack: invalid DSN: %s", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User == nil || u.User.Username() == "" {
+		return "", "", fmt.Errorf("errtrack: invalid DSN %q", dsn)
+	}
+
+	path := strings.TrimSuffix(u.Path, "/")
+	slash := strings.LastIndex(path, "/")
+	project := path[slash+1:]
+	if project == "" {
+		return "", "", fmt.Errorf("errtrack: invalid DSN %q: missing project", dsn)
+	}
+
+	endpoint = fmt.Sprintf("%s://%s%s/api/%s/envelope/", u.Scheme, u.Host, path[:slash], project)
+	return endpoint, u.User.Username(), nil
+}
+
+// HandleLog implements log.Handler.
+func (h *Handler) HandleLog(e *log.Entry) error {
+	if e.Level < log.ErrorLevel {
+		return nil
+	}
+
+	// errors logged without WithError are only available as strings
+	cause := e.Err()
+	template := Template(e.Message)
+	typ, errMsg := "", ""
+	if cause != nil {
+		typ = fmt.Sprintf("%T", pkgerrors.Cause(cause))
+		errMsg = cause.Error()
+	} else if s, ok := e.Fields.Get("error").(string); ok {
+		errMsg = s
+	}
+	frames := stack(cause, e)
+	top := ""
+	if len(frames) > 0 {
+		top = frames[len(frames)-1].Function
+	}
+	fp := fingerprint(template, typ, top)
+
+	fields, err := e.Fields.MarshalJSON()
+	if err != nil {
+		fields = nil
+	}
+
+	h.mu.Lock()
+
+	if h.closed {
+		h.mu.Unlock()
+		return ErrClosed
+	}
+
+	var issue *Issue
+	el, ok := h.issues[fp]
+	if ok {
+		h.lru.MoveToFront(el)
+		issue = el.Value.(*Issue)
+	} else {
+		if h.lru.Len() >= h.MaxIssues {
+			oldest := h.lru.Back()
+			h.lru.Remove(oldest)
+			delete(h.issues, oldest.Value.(*Issue).Fingerprint)
+		}
+		issue = &Issue{
+			Fingerprint: fp,
+			Template:    template,
+			Type:        typ,
+			Frame:       top,
+			FirstSeen:   e.Timestamp,
+			frames:      frames,
+		}
+		h.issues[fp] = h.lru.PushFront(issue)
+	}
+	issue.Message = e.Message
+	issue.Level = e.Level
+	issue.Count++
+	issue.LastSeen = e.Timestamp
+	issue.Fields = fields
+	issue.err = errMsg
+
+	if ok {
+		issue.pending++
+	}
+
+	// fatal entries are reported before returning since the process exits
+	// right after
+	if ok && e.Level != log.FatalLevel {
+		h.mu.Unlock()
+		return nil
+	}
+
+	envelope, err := h.envelope(issue, !ok)
+	h.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if e.Level != log.FatalLevel {
+		err = h.batch.Add(batch.Record{Data: envelope})
+	} else {
+		err = h.batch.Send(batch.Record{Data: envelope})
+	}
+	if err == batch.ErrClosed {
+		return ErrClosed
+	}
+	return err
+}
+
+// Issues returns a snapshot of the tracked issues, most recently seen first.
+func (h *Handler) Issues() []Issue {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ret := make([]Issue, 0, h.lru.Len())
+	for el := h.lru.Front(); el != nil; el = el.Next() {
+		ret = append(ret, *el.Value.(*Issue))
+	}
+	return ret
+}
+
+// digest returns the envelopes of the issues with occurrences since their
+// last report. h.mu must be held by the caller.
+func (h *Handler) digest() [][]byte {
+	var envelopes [][]byte
+	for el := h.lru.Front(); el != nil; el = el.Next() {
+		issue := el.Value.(*Issue)
+		if issue.pending == 0 {
+			continue
+		}
+		envelope, err := h.envelope(issue, false)
+		if err != nil {
+			stdlog.Printf("log/errtrack: failed to encode issue %s: %s", issue.Fingerprint, err)
+			continue
+		}
+		envelopes = append(envelopes, envelope)
+	}
+	return envelopes
+}
+
+// records returns the envelopes as records.
+func records(envelopes [][]byte) []batch.Record {
+	ret := make([]batch.Record, len(envelopes))
+	for i, envelope := range envelopes {
+		ret[i] = batch.Record{Data: envelope}
+	}
+	return ret
+}
+
+// Flush reports the issues with new occurrences and waits until all reports
+// were sent.
+func (h *Handler) Flush() error {
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		return nil
+	}
+	envelopes := h.digest()
+	h.mu.Unlock()
+
+	err := h.batch.Send(records(envelopes)...)
+	if err == batch.ErrClosed {
+		return nil
+	}
+	return err
+}
+
+// Close flushes the handler. Entries logged afterwards are rejected with
+// ErrClosed.
+func (h *Handler) Close() error {
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		return nil
+	}
+	h.closed = true
+	envelopes := h.digest()
+	h.mu.Unlock()
+
+	close(h.done)
+	err := h.batch.Send(records(envelopes)...)
+	if cerr := h.batch.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// tick reports the digest every DigestInterval until the handler is closed.
+func (h *Handler) tick() {
+	ticker := time.NewTicker(h.DigestInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			h.mu.Lock()
+			if h.closed {
+				h.mu.Unlock()
+				continue
+			}
+			envelopes := h.digest()
+			h.mu.Unlock()
+			_ = h.batch.Add(records(envelopes)...)
+		case <-h.done:
+			return
+		}
+	}
+}
+
+// sink implements batch.Sender, posting envelopes.
+type sink struct {
+	*Config
+
+	endpoint string // endpoint is the envelope endpoint of the DSN
+	auth     string // auth is the X-Sentry-Auth header
+}
+
+// Send implements batch.Sender, posting the envelopes one by one. It returns
+// the first error.
+func (s *sink) Send(envelopes []batch.Record) error {
+	var err error
+	for _, envelope := range envelopes {
+		if serr := s.send(envelope.Data); serr != nil && err == nil {
+			err = serr
+		}
+	}
+	return err
+}
+
+// send posts the envelope, retrying on failures.
+func (s *sink) send(envelope []byte) error {
+	backoff := s.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		retry, err := s.post(envelope)
+		if err == nil || !retry || attempt >= s.Retries {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// post posts the envelope. It returns whether the request should be retried
+// if it failed.
+func (s *sink) post(envelope []byte) (retry bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, s.endpoint, bytes.NewReader(envelope))
+	if err != nil {
+		return false, err
+	}
+
+	req.Header.Set("Content-Type", "application/x-sentry-envelope")
+	req.Header.Set("X-Sentry-Auth", s.auth)
+
+	res, err := s.Client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer res.Body.Close()
+	msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return false, nil
+	}
+
+	err = fmt.Errorf("errtrack: %s responded with %s: %s", s.endpoint, res.Status, strings.TrimSpace(string(msg)))
+	return res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500, err
+}
+
+// event is a Sentry event.
+type event struct {
+	EventID     string            `json:"event_id"`
+	Timestamp   time.Time         `json:"timestamp"`
+	Platform    string            `json:"platform"`
+	Level       string            `json:"level"`
+	ServerName  string            `json:"server_name,omitempty"`
+	Environment string            `json:"environment,omitempty"`
+	Release     string            `json:"release,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Fingerprint []string          `json:"fingerprint"`
+	Logentry    logentry          `json:"logentry"`
+	Exception   *exceptions       `json:"exception,omitempty"`
+	Extra       json.RawMessage   `json:"extra,omitempty"`
+	Contexts    contexts          `json:"contexts"`
+}
+
+type logentry struct {
+	Message   string `json:"message"`
+	Formatted string `json:"formatted"`
+}
+
+type exceptions struct {
+	Values []exception `json:"values"`
+}
+
+type exception struct {
+	Type       string      `json:"type"`
+	Value      string      `json:"value"`
+	Stacktrace *stacktrace `json:"stacktrace,omitempty"`
+}
+
+type stacktrace struct {
+	Frames []frame `json:"frames"`
+}
+
+// frame is a stack frame.
+type frame struct {
+	Function string `json:"function"`
+	AbsPath  string `json:"abs_path,omitempty"`
+	Lineno   int    `json:"lineno,omitempty"`
+}
+
+type contexts struct {
+	Issue issueContext `json:"issue"`
+}
+
+// issueContext holds the aggregated data of the issue.
+type issueContext struct {
+	Type        string    `json:"type"`
+	New         bool      `json:"new"`
+	Count       int       `json:"count"`
+	Occurrences int       `json:"occurrences"` // Occurrences is the number of occurrences since the last report
+	FirstSeen   time.Time `json:"first_seen"`
+	LastSeen    time.Time `json:"last_seen"`
+}
+
+// envelope returns the envelope reporting the issue and resets its pending
+// occurrences.
+func (h *Handler) envelope(issue *Issue, isNew bool) ([]byte, error) {
+	occurrences := issue.pending
+	if isNew {
+		occurrences = 1
+	}
+	issue.pending = 0
+
+	ev := event{
+		EventID:     newEventID(),
+		Timestamp:   issue.LastSeen.UTC(),
+		Platform:    "go",
+		Level:       level(issue.Level),
+		ServerName:  h.ServerName,
+		Environment: h.Environment,
+		Release:     h.Release,
+		Tags:        h.Tags,
+		Fingerprint: []string{issue.Fingerprint},
+		Logentry:    logentry{Message: issue.Template, Formatted: issue.Message},
+		Extra:       issue.Fields,
+		Contexts: contexts{Issue: issueContext{
+			Type:        "issue",
+			New:         isNew,
+			Count:       issue.Count,
+			Occurrences: occurrences,
+			FirstSeen:   issue.FirstSeen.UTC(),
+			LastSeen:    issue.LastSeen.UTC(),
+		}},
+	}
+	if issue.Type != "" || issue.err != "" {
+		ex := exception{Type: issue.Type, Value: issue.err}
+		if ex.Type == "" {
+			ex.Type = "error"
+		}
+		if len(issue.frames) > 0 {
+			ex.Stacktrace = &stacktrace{Frames: issue.frames}
+		}
+		ev.Exception = &exceptions{Values: []exception{ex}}
+	}
+
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `{"event_id":%q,"sent_at":%q}`+"\n", ev.EventID, h.Clock.Now().UTC().Format(time.RFC3339Nano))
+	fmt.Fprintf(&buf, `{"type":"event","length":%d,"content_type":"application/json"}`+"\n", len(payload))
+	buf.Write(payload)
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+// level returns the Sentry level of the given level.
+func level(l log.Level) string {
+	if l == log.FatalLevel {
+		return "fatal"
+	}
+	return "error"
+}
+
+// stackTracer is implemented by errors of github.com/pkg/errors.
+type stackTracer interface {
+	StackTrace() pkgerrors.StackTrace
+}
+
+// stack returns the frames of the error stack, oldest first, or the frame of
+// the "source" field of the entry.
+func stack(err error, e *log.Entry) []frame {
+	if st, ok := err.(stackTracer); ok {
+		trace := st.StackTrace()
+		frames := make([]frame, 0, len(trace))
+		for i := len(trace) - 1; i >= 0; i-- {
+			pc := uintptr(trace[i]) - 1
+			fn := runtime.FuncForPC(pc)
+			if fn == nil {
+				continue
+			}
+			file, line := fn.FileLine(pc)
+			frames = append(frames, frame{Function: fn.Name(), AbsPath: file, Lineno: line})
+		}
+		return frames
+	}
+
+	if source, ok := e.Fields.Get("source").(string); ok {
+		if fn, file, line, ok := log.ParseSource(source); ok {
+			return []frame{{Function: fn, AbsPath: file, Lineno: line}}
+		}
+	}
+	return nil
+}
+
+// fingerprint returns the fingerprint of the given message template, error
+// type and top frame function.
+func fingerprint(template, typ, frame string) string {
+	sum := sha1.Sum([]byte(template + "\x00" + typ + "\x00" + frame))
+	return hex.EncodeToString(sum[:16])
+}
+
+// Template returns the template of the message: quoted strings are replaced
+// with "<s>" and words of hexadecimal digits holding at least one decimal
+// digit - numbers, ids, addresses - with "<n>".
+func Template(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); {
+		c := msg[i]
+		switch {
+		case c == '"':
+			end := closingQuote(msg, i+1)
+			if end < 0 {
+				b.WriteString(msg[i:])
+				return b.String()
+			}
+			b.WriteString(`"<s>"`)
+			i = end + 1
+		case isAlnum(c):
+			j := i
+			hexa, digit := true, false
+			for j < len(msg) && isAlnum(msg[j]) {
+				hexa = hexa && isHex(msg[j])
+				digit = digit || msg[j] >= '0' && msg[j] <= '9'
+				j++
+			}
+			if hexa && digit {
+				b.WriteString("<n>")
+			} else {
+				b.WriteString(msg[i:j])
+			}
+			i = j
+		default:
+			b.WriteByte(c)
+			i++
+		}
+	}
+	return b.String()
+}
+
+// closingQuote returns the index of the quote closing the string starting at
+// i, skipping escaped quotes, or -1.
+func closingQuote(s string, i int) int {
+	for ; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+	return -1
+}
+
+func isAlnum(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isHex(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+// newEventID returns a random event id: 32 hexadecimal digits.
+func newEventID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
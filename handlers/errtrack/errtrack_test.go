@@ -0,0 +1,317 @@
+package errtrack_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/eluv-io/apexlog-go"
+	"github.com/eluv-io/apexlog-go/handlers/errtrack"
+	"github.com/eluv-io/apexlog-go/logtest"
+)
+
+// event holds the parts of Sentry events checked by tests.
+type event struct {
+	EventID     string                 `json:"event_id"`
+	Level       string                 `json:"level"`
+	Environment string                 `json:"environment"`
+	Fingerprint []string               `json:"fingerprint"`
+	Extra       map[string]interface{} `json:"extra"`
+	Logentry    struct {
+		Message   string `json:"message"`
+		Formatted string `json:"formatted"`
+	} `json:"logentry"`
+	Exception *struct {
+		Values []struct {
+			Type       string `json:"type"`
+			Value      string `json:"value"`
+			Stacktrace struct {
+				Frames []struct {
+					Function string `json:"function"`
+					Lineno   int    `json:"lineno"`
+				} `json:"frames"`
+			} `json:"stacktrace"`
+		} `json:"values"`
+	} `json:"exception"`
+	Contexts struct {
+		Issue struct {
+			New         bool      `json:"new"`
+			Count       int       `json:"count"`
+			Occurrences int       `json:"occurrences"`
+			FirstSeen   time.Time `json:"first_seen"`
+			LastSeen    time.Time `json:"last_seen"`
+		} `json:"issue"`
+	} `json:"contexts"`
+}
+
+// tracker is a stand-in for the error tracker, decoding the envelopes.
+type tracker struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []*http.Request
+	events   []event
+	sentAt   []time.Time
+}
+
+func newTracker(t *testing.T) *tracker {
+	tr := &tracker{}
+	tr.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tr.mu.Lock()
+		defer tr.mu.Unlock()
+
+		s := bufio.NewScanner(r.Body)
+		var lines []string
+		for s.Scan() {
+			lines = append(lines, s.Text())
+		}
+		require.Len(t, lines, 3)
+
+		var header struct {
+			EventID string    `json:"event_id"`
+			SentAt  time.Time `json:"sent_at"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(lines[0]), &header))
+		var item struct {
+			Type   string `json:"type"`
+			Length int    `json:"length"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(lines[1]), &item))
+		assert.Equal(t, "event", item.Type)
+		assert.Equal(t, len(lines[2]), item.Length)
+
+		var ev event
+		require.NoError(t, json.Unmarshal([]byte(lines[2]), &ev))
+		assert.Equal(t, header.EventID, ev.EventID)
+
+		tr.requests = append(tr.requests, r)
+		tr.events = append(tr.events, ev)
+		tr.sentAt = append(tr.sentAt, header.SentAt)
+		_, _ = w.Write([]byte(`{"id":"` + ev.EventID + `"}`))
+	}))
+	return tr
+}
+
+func (tr *tracker) received() ([]*http.Request, []event) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return append([]*http.Request(nil), tr.requests...), append([]event(nil), tr.events...)
+}
+
+func (tr *tracker) dsn() string {
+	return strings.Replace(tr.URL, "://", "://public@", 1) + "/42"
+}
+
+func TestTemplate(t *testing.T) {
+	for _, c := range []struct{ msg, template string }{
+		{"user 42 not found", "user <n> not found"},
+		{"dial tcp 10.0.0.1:8080: connection refused", "dial tcp <n>.<n>.<n>.<n>:<n>: connection refused"},
+		{`object "abc \" def" is locked`, `object "<s>" is locked`},
+		{"hash deadbeef01 mismatch", "hash <n> mismatch"},
+		{"sha256 of iq__3x failed", "sha256 of iq__3x failed"},
+		{"unterminated \"quote", "unterminated \"quote"},
+	} {
+		assert.Equal(t, c.template, errtrack.Template(c.msg), c.msg)
+	}
+}
+
+func TestNew_dsn(t *testing.T) {
+	for _, dsn := range []string{"", "localhost/42", "https://example.com/42", "https://key@example.com/", "ftp://key@example.com/42"} {
+		_, err := errtrack.New(&errtrack.Config{DSN: dsn})
+		assert.Error(t, err, dsn)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	tr := newTracker(t)
+	defer tr.Close()
+
+	clock := logtest.NewClock(logtest.Timestamp)
+	h, err := errtrack.New(&errtrack.Config{
+		DSN:            tr.dsn(),
+		Environment:    "prod",
+		DigestInterval: time.Hour,
+		Clock:          clock,
+	})
+	require.NoError(t, err)
+
+	l := &log.Logger{Handler: h, Level: log.InfoLevel, Clock: clock}
+
+	l.Info("ignored")
+	l.Warn("ignored")
+	for i := 0; i < 3; i++ {
+		clock.Add(time.Minute)
+		l.WithError(errors.Errorf("boom")).Errorf("request %d failed", i)
+	}
+	l.Error("quota exceeded", "user", "tj")
+	require.NoError(t, h.Flush())
+
+	issues := h.Issues()
+	require.Len(t, issues, 2)
+	sort.Slice(issues, func(i, j int) bool { return issues[i].Count > issues[j].Count })
+
+	issue := issues[0]
+	assert.Equal(t, "request <n> failed", issue.Template)
+	assert.Equal(t, "request 2 failed", issue.Message)
+	assert.Equal(t, "*errors.fundamental", issue.Type)
+	assert.Equal(t, "github.com/eluv-io/apexlog-go/handlers/errtrack_test.TestHandler", issue.Frame)
+	assert.Equal(t, 3, issue.Count)
+	assert.Equal(t, logtest.Timestamp.Add(time.Minute), issue.FirstSeen)
+	assert.Equal(t, logtest.Timestamp.Add(3*time.Minute), issue.LastSeen)
+	assert.Equal(t, 1, issues[1].Count)
+
+	// the new issues, then the digest of the first one
+	requests, events := tr.received()
+	require.Len(t, events, 3)
+	assert.Equal(t, "/api/42/envelope/", requests[0].URL.Path)
+	assert.Contains(t, requests[0].Header.Get("X-Sentry-Auth"), "sentry_key=public")
+	assert.Equal(t, "application/x-sentry-envelope", requests[0].Header.Get("Content-Type"))
+
+	first := events[0]
+	assert.Equal(t, "error", first.Level)
+	assert.Equal(t, "prod", first.Environment)
+	assert.Equal(t, []string{issue.Fingerprint}, first.Fingerprint)
+	assert.Equal(t, "request <n> failed", first.Logentry.Message)
+	assert.Equal(t, "request 0 failed", first.Logentry.Formatted)
+	require.NotNil(t, first.Exception)
+	ex := first.Exception.Values[0]
+	assert.Equal(t, "*errors.fundamental", ex.Type)
+	assert.Equal(t, "boom", ex.Value)
+	frames := ex.Stacktrace.Frames
+	require.NotEmpty(t, frames)
+	assert.Equal(t, issue.Frame, frames[len(frames)-1].Function)
+	assert.True(t, first.Contexts.Issue.New)
+	assert.Equal(t, 1, first.Contexts.Issue.Count)
+
+	second := events[1]
+	assert.Equal(t, "quota exceeded", second.Logentry.Formatted)
+	assert.Nil(t, second.Exception)
+	assert.Equal(t, "tj", second.Extra["user"])
+
+	digest := events[2]
+	assert.Equal(t, first.Fingerprint, digest.Fingerprint)
+	assert.False(t, digest.Contexts.Issue.New)
+	assert.Equal(t, 3, digest.Contexts.Issue.Count)
+	assert.Equal(t, 2, digest.Contexts.Issue.Occurrences)
+	assert.Equal(t, logtest.Timestamp.Add(time.Minute), digest.Contexts.Issue.FirstSeen)
+	assert.Equal(t, logtest.Timestamp.Add(3*time.Minute), digest.Contexts.Issue.LastSeen)
+
+	// events are stamped by the clock of the handler
+	tr.mu.Lock()
+	assert.Equal(t, []time.Time{logtest.Timestamp.Add(time.Minute), logtest.Timestamp.Add(3 * time.Minute), logtest.Timestamp.Add(3 * time.Minute)}, tr.sentAt)
+	tr.mu.Unlock()
+
+	// no new occurrences: no digest
+	require.NoError(t, h.Close())
+	_, events = tr.received()
+	assert.Len(t, events, 3)
+
+	assert.Equal(t, errtrack.ErrClosed, h.HandleLog(&log.Entry{Level: log.ErrorLevel}))
+}
+
+func TestHandler_fingerprint(t *testing.T) {
+	tr := newTracker(t)
+	defer tr.Close()
+
+	h, err := errtrack.New(&errtrack.Config{DSN: tr.dsn(), DigestInterval: time.Hour})
+	require.NoError(t, err)
+	defer h.Close()
+	l := &log.Logger{Handler: h, Level: log.InfoLevel}
+
+	type myError struct{ error }
+	l.WithError(errors.New("a")).Error("failed")
+	l.WithError(newError("a")).Error("failed")            // other frame
+	l.WithError(myError{errors.New("a")}).Error("failed") // other type
+	l.WithError(errors.New("a")).Error("failed to write") // other template
+	l.WithError(errors.New("b")).Error("failed to write \"/tmp/x\"")
+	for i := 0; i < 2; i++ {
+		l.WithError(errors.New("c")).Error("failed to write \"/tmp/y\"") // same template and frame
+	}
+
+	issues := h.Issues()
+	require.Len(t, issues, 5)
+	counts := make(map[int]int)
+	for _, issue := range issues {
+		counts[issue.Count]++
+	}
+	assert.Equal(t, map[int]int{1: 4, 3: 1}, counts)
+}
+
+func newError(msg string) error {
+	return errors.New(msg)
+}
+
+func TestHandler_errorValue(t *testing.T) {
+	tr := newTracker(t)
+	defer tr.Close()
+
+	h, err := errtrack.New(&errtrack.Config{DSN: tr.dsn(), DigestInterval: time.Hour})
+	require.NoError(t, err)
+	defer h.Close()
+	l := &log.Logger{Handler: h, Level: log.InfoLevel}
+
+	// without WithError, only the message of the error is available
+	l.Error("upload failed", errors.New("disk full"))
+	require.NoError(t, h.Flush())
+
+	_, events := tr.received()
+	require.Len(t, events, 1)
+	require.NotNil(t, events[0].Exception)
+	ex := events[0].Exception.Values[0]
+	assert.Equal(t, "error", ex.Type)
+	assert.Equal(t, "disk full", ex.Value)
+}
+
+func TestHandler_maxIssues(t *testing.T) {
+	tr := newTracker(t)
+	defer tr.Close()
+
+	h, err := errtrack.New(&errtrack.Config{DSN: tr.dsn(), MaxIssues: 2, DigestInterval: time.Hour})
+	require.NoError(t, err)
+	defer h.Close()
+
+	clock := logtest.NewClock(logtest.Timestamp)
+	l := &log.Logger{Handler: h, Level: log.InfoLevel, Clock: clock}
+
+	for _, msg := range []string{"a", "b", "a", "c"} {
+		clock.Add(time.Second)
+		l.Error(msg)
+	}
+
+	// b is the least recently seen issue
+	var templates []string
+	for _, issue := range h.Issues() {
+		templates = append(templates, issue.Template)
+	}
+	assert.Equal(t, []string{"c", "a"}, templates)
+}
+
+func TestHandler_fatal(t *testing.T) {
+	tr := newTracker(t)
+	defer tr.Close()
+
+	h, err := errtrack.New(&errtrack.Config{DSN: tr.dsn(), DigestInterval: time.Hour})
+	require.NoError(t, err)
+	defer h.Close()
+
+	e := &log.Entry{Level: log.FatalLevel, Message: "oops", Timestamp: logtest.Timestamp}
+	require.NoError(t, h.HandleLog(e))
+	require.NoError(t, h.HandleLog(e))
+
+	// reported before HandleLog returned
+	_, events := tr.received()
+	require.Len(t, events, 2)
+	assert.Equal(t, "fatal", events[1].Level)
+	assert.False(t, events[1].Contexts.Issue.New)
+	assert.Equal(t, 1, events[1].Contexts.Issue.Occurrences)
+}
@@ -1,22 +1,35 @@
 // Package es implements an Elasticsearch batch handler. Currently this implementation
 // assumes the index format of "logs-YY-MM-DD".
+//
+// Documents are entries marshaled as tagged in log.Entry unless an encoder is
+// configured, for instance to index entries in the Elastic Common Schema:
+//
+//	es.New(&es.Config{Client: client, Encoder: ecs.New(&ecs.Config{})})
+//
+// Documents are buffered and indexed in bulk by a batch.Handler: call Flush
+// to index the buffered documents, e.g. at the end of a Lambda function, and
+// Close before exiting.
 package es
 
 import (
+	"encoding/json"
+	"errors"
 	"io"
 	stdlog "log"
-	"sync"
 	"time"
 
-	"github.com/tj/go-elastic/batch"
+	elastic "github.com/tj/go-elastic/batch"
 
 	"github.com/eluv-io/apexlog-go"
+	"github.com/eluv-io/apexlog-go/handlers/batch"
+	"github.com/eluv-io/apexlog-go/handlers/spool"
 )
 
 // TODO(tj): allow dumping logs to stderr on timeout
 // TODO(tj): allow custom format that does not include .fields etc
-// TODO(tj): allow interval flushes
-// TODO(tj): allow explicit Flush() (for Lambda where you have to flush at the end of function)
+
+// ErrClosed is returned when logging to a closed handler.
+var ErrClosed = errors.New("es: handler closed")
 
 // Elasticsearch interface.
 type Elasticsearch interface {
@@ -25,9 +38,14 @@ type Elasticsearch interface {
 
 // Config for handler.
 type Config struct {
-	BufferSize int           // BufferSize is the number of logs to buffer before flush (default: 100)
-	Format     string        // Format for index
-	Client     Elasticsearch // Client for ES
+	BufferSize    int           // BufferSize is the number of logs to buffer before flush (default: 100)
+	BufferBytes   int           // BufferBytes is the max size of the documents of a bulk request, 0 for no limit
+	FlushInterval time.Duration // FlushInterval is the max time logs are buffered, 0 to only flush full buffers
+	MaxConcurrent int           // MaxConcurrent is the max number of concurrent bulk requests (default: 4, always 1 with a Spool to keep the order of logs)
+	Format        string        // Format for index
+	Client        Elasticsearch // Client for ES
+	Encoder       log.Encoder   // Encoder encodes documents, it must produce JSON (default: entries as tagged in log.Entry)
+	Spool         *spool.Config // Spool persists the bulk requests that failed and replays them, nil to drop them
 }
 
 // defaults applies defaults to the config.
@@ -36,6 +54,14 @@ func (c *Config) defaults() {
 		c.BufferSize = 100
 	}
 
+	if c.MaxConcurrent == 0 {
+		c.MaxConcurrent = 4
+	}
+
+	if c.Spool != nil {
+		c.MaxConcurrent = 1
+	}
+
 	if c.Format == "" {
 		c.Format = "logs-06-01-02"
 	}
@@ -44,55 +70,131 @@ func (c *Config) defaults() {
 // Handler implementation.
 type Handler struct {
 	*Config
-
-	mu    sync.Mutex
-	batch *batch.Batch
+	batch *batch.Handler
+	spool *spool.Sink
 }
 
-// New handler with BufferSize
+// New handler with BufferSize. If the spool can't be opened, the error is
+// printed and the handler drops the bulk requests that failed, use NewE to
+// handle the error.
 func New(config *Config) *Handler {
+	h, err := NewE(config)
+	if err != nil {
+		stdlog.Printf("log/elastic: failed to open spool: %s", err)
+		h = &Handler{Config: config}
+		h.batch = h.newBatch(sink{config})
+	}
+	return h
+}
+
+// NewE returns a new handler, or an error if the spool can't be opened.
+func NewE(config *Config) (*Handler, error) {
 	config.defaults()
-	return &Handler{
-		Config: config,
+	h := &Handler{Config: config}
+
+	var s batch.BatchSink = sink{config}
+	if config.Spool != nil {
+		var err error
+		if h.spool, err = spool.NewSink(s, config.Spool); err != nil {
+			return nil, err
+		}
+		s = h.spool
 	}
+
+	h.batch = h.newBatch(s)
+	return h, nil
+}
+
+// newBatch returns the batch handler sending bulk requests to s.
+func (h *Handler) newBatch(s batch.BatchSink) *batch.Handler {
+	return batch.New(s, &batch.Config{
+		BatchSize:     h.BufferSize,
+		BatchBytes:    h.BufferBytes,
+		FlushInterval: h.FlushInterval,
+		MaxConcurrent: h.MaxConcurrent,
+		OnError: func(err error, docs []batch.Record) {
+			stdlog.Printf("log/elastic: failed to flush %d logs: %s", len(docs), err)
+		},
+	})
 }
 
 // HandleLog implements log.Handler.
 func (h *Handler) HandleLog(e *log.Entry) error {
-	h.mu.Lock()
-	defer h.mu.Unlock()
+	err := h.batch.HandleLog(e)
+	if err == batch.ErrClosed {
+		return ErrClosed
+	}
+	return err
+}
 
-	if h.batch == nil {
-		h.batch = &batch.Batch{
-			Index:   time.Now().Format(h.Config.Format),
-			Elastic: h.Client,
-			Type:    "log",
+// Asynchronous implements log.Asynchronous. Entries are encoded by HandleLog
+// and not retained.
+//
+// Deprecated: see log.Asynchronous.
+func (h *Handler) Asynchronous() bool {
+	return false
+}
+
+// Flush indexes the buffered logs and waits until all bulk requests
+// completed.
+func (h *Handler) Flush() error {
+	return h.batch.Flush()
+}
+
+// Close flushes the handler and closes the spool, if any. Entries logged
+// afterwards are rejected with ErrClosed.
+func (h *Handler) Close() error {
+	err := h.batch.Close()
+	if h.spool != nil {
+		if serr := h.spool.Close(); err == nil {
+			err = serr
 		}
 	}
+	return err
+}
 
-	h.batch.Add(e)
+// sink implements batch.BatchSink, keying documents by index.
+type sink struct {
+	*Config
+}
 
-	if h.batch.Size() >= h.BufferSize {
-		go h.flush(h.batch)
-		h.batch = nil
+// Encode implements batch.BatchSink.
+func (s sink) Encode(e *log.Entry) (batch.Record, error) {
+	var doc []byte
+	var err error
+	if s.Encoder != nil {
+		doc, err = s.Encoder.AppendEntry(nil, e)
+	} else {
+		doc, err = json.Marshal(e)
 	}
-
-	return nil
+	if err != nil {
+		return batch.Record{}, err
+	}
+	return batch.Record{Key: e.Timestamp.Format(s.Format), Data: doc}, nil
 }
 
-// flush the given `batch` asynchronously.
-func (h *Handler) flush(batch *batch.Batch) {
-	size := batch.Size()
+// Send implements batch.BatchSink, with a bulk request per run of documents
+// of the same index.
+func (s sink) Send(docs []batch.Record) error {
+	size := len(docs)
 	start := time.Now()
 	stdlog.Printf("log/elastic: flushing %d logs", size)
 
-	if err := batch.Flush(); err != nil {
-		stdlog.Printf("log/elastic: failed to flush %d logs: %s", size, err)
+	for len(docs) > 0 {
+		b := &elastic.Batch{
+			Index:   docs[0].Key,
+			Elastic: s.Client,
+			Type:    "log",
+		}
+		for len(docs) > 0 && docs[0].Key == b.Index {
+			b.Add(json.RawMessage(docs[0].Data))
+			docs = docs[1:]
+		}
+		if err := b.Flush(); err != nil {
+			return err
+		}
 	}
 
 	stdlog.Printf("log/elastic: flushed %d logs in %s", size, time.Since(start))
-}
-
-func (h *Handler) Asynchronous() bool {
-	return true
+	return nil
 }
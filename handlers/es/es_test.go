@@ -0,0 +1,99 @@
+package es_test
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/eluv-io/apexlog-go"
+	"github.com/eluv-io/apexlog-go/handlers/es"
+	"github.com/eluv-io/apexlog-go/handlers/spool"
+	"github.com/eluv-io/apexlog-go/logtest"
+)
+
+// client records the lines of bulk requests.
+type client struct {
+	mu       sync.Mutex
+	requests [][]string
+	err      error
+}
+
+func (c *client) Bulk(r io.Reader) error {
+	var lines []string
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		lines = append(lines, s.Text())
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.requests = append(c.requests, lines)
+	return c.err
+}
+
+func (c *client) received() [][]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([][]string(nil), c.requests...)
+}
+
+var ts = time.Date(2020, 1, 2, 23, 59, 59, 0, time.UTC)
+
+func TestHandler(t *testing.T) {
+	c := &client{}
+	h := es.New(&es.Config{Client: c, BufferSize: 3, MaxConcurrent: 1})
+
+	clock := logtest.NewClock(ts)
+	l := &log.Logger{Handler: h, Level: log.InfoLevel, Clock: clock}
+	l.Info("a", "user", "tj")
+	clock.Add(time.Second)
+	l.Info("b")
+	l.Info("c")
+	l.Info("d")
+	require.NoError(t, h.Flush())
+
+	// a bulk request per index
+	op := func(index string) string {
+		return `{"index":{"_index":"` + index + `","_type":"log"}}`
+	}
+	assert.Equal(t, [][]string{
+		{
+			op("logs-20-01-02"),
+			`{"fields":{"user":"tj"},"level":"info","timestamp":"2020-01-02T23:59:59Z","message":"a"}`,
+		},
+		{
+			op("logs-20-01-03"),
+			`{"fields":{},"level":"info","timestamp":"2020-01-03T00:00:00Z","message":"b"}`,
+			op("logs-20-01-03"),
+			`{"fields":{},"level":"info","timestamp":"2020-01-03T00:00:00Z","message":"c"}`,
+		},
+		{
+			op("logs-20-01-03"),
+			`{"fields":{},"level":"info","timestamp":"2020-01-03T00:00:00Z","message":"d"}`,
+		},
+	}, c.received())
+
+	c.err = errors.New("boom")
+	l.Info("e")
+	assert.EqualError(t, h.Close(), "boom")
+	assert.Equal(t, es.ErrClosed, h.HandleLog(&log.Entry{}))
+}
+
+func TestNewE(t *testing.T) {
+	_, err := es.NewE(&es.Config{Client: &client{}, Spool: &spool.Config{}})
+	assert.EqualError(t, err, "spool: missing directory")
+
+	// New logs without the spool
+	c := &client{}
+	h := es.New(&es.Config{Client: c, Spool: &spool.Config{}})
+	l := &log.Logger{Handler: h, Level: log.InfoLevel}
+	l.Info("hello")
+	require.NoError(t, h.Close())
+	assert.Len(t, c.received(), 1)
+}
@@ -0,0 +1,231 @@
+// Package failover implements a handler passing entries to the first healthy
+// handler of an ordered list, e.g. graylog as primary and a local file as
+// secondary:
+//
+//	failover.New(nil, graylogHandler, json.New(fileWriter))
+//
+// A handler is marked unhealthy after Threshold consecutive errors: entries
+// then go to the next healthy handler. Unhealthy handlers are probed with
+// live entries once their backoff elapsed - doubled after each failed probe -
+// and entries go back to them once a probe succeeds.
+//
+// Transitions are recorded as entries passed to the handler taking over:
+// warnings on failover, informational entries on fail-back. They are built by
+// the handler rather than logged: they have no Logger, hence no logger
+// fields, and their timestamp is read from Clock.
+package failover
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/eluv-io/apexlog-go"
+)
+
+// ErrUnavailable is returned when no handler is healthy.
+var ErrUnavailable = errors.New("failover: no healthy handler")
+
+// Config for handler.
+type Config struct {
+	Threshold    int           // Threshold is the number of consecutive errors after which a handler is unhealthy (default: 3)
+	ProbeBackoff time.Duration // ProbeBackoff is the delay before the first probe of an unhealthy handler, doubled after each failed probe (default: 1s)
+	MaxBackoff   time.Duration // MaxBackoff is the max delay between probes (default: 1m)
+	Clock        log.Clock     // Clock is used for probes and transition entries (default: log.SystemClock)
+}
+
+// defaults applies defaults to the config.
+func (c *Config) defaults() {
+	if c.Threshold == 0 {
+		c.Threshold = 3
+	}
+
+	if c.ProbeBackoff == 0 {
+		c.ProbeBackoff = time.Second
+	}
+
+	if c.MaxBackoff == 0 {
+		c.MaxBackoff = time.Minute
+	}
+
+	if c.Clock == nil {
+		c.Clock = log.SystemClock
+	}
+}
+
+// member is a handler and its health.
+type member struct {
+	handler   log.Handler
+	failures  int // failures is the number of consecutive errors
+	unhealthy bool
+	probing   bool          // probing is true while an entry probes the handler
+	next      time.Time     // next is the time of the next probe
+	backoff   time.Duration // backoff is the delay before the next probe
+}
+
+// Handler implementation.
+type Handler struct {
+	*Config
+
+	mu      sync.Mutex
+	members []*member
+}
+
+// New handler passing entries to the first healthy handler of h. The config
+// may be nil.
+func New(config *Config, h ...log.Handler) *Handler {
+	if config == nil {
+		config = &Config{}
+	}
+	config.defaults()
+
+	ret := &Handler{Config: config}
+	for _, l := range h {
+		ret.members = append(ret.members, &member{handler: l})
+	}
+	return ret
+}
+
+// HandleLog implements log.Handler. The entry is passed to the healthy
+// handlers in order - and to the unhealthy ones due for a probe - until one
+// succeeds. The error of the last handler is returned if none does.
+func (h *Handler) HandleLog(e *log.Entry) error {
+	err := ErrUnavailable
+	for i := range h.members {
+		if !h.acquire(i) {
+			continue
+		}
+		if err = h.members[i].handler.HandleLog(e); err == nil {
+			h.record(i, nil)
+			return nil
+		}
+		h.record(i, err)
+	}
+	return err
+}
+
+// Active returns the index of the first healthy handler, -1 if none is.
+func (h *Handler) Active() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.active()
+}
+
+// active returns the index of the first healthy handler. h.mu must be held.
+func (h *Handler) active() int {
+	for i, m := range h.members {
+		if !m.unhealthy {
+			return i
+		}
+	}
+	return -1
+}
+
+// acquire returns true if the handler is healthy, or due for a probe: the
+// handler is then probed by the caller only.
+func (h *Handler) acquire(i int) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	m := h.members[i]
+	if !m.unhealthy {
+		return true
+	}
+	if m.probing || h.Clock.Now().Before(m.next) {
+		return false
+	}
+	m.probing = true
+	return true
+}
+
+// record records the result of passing an entry to the handler, and the
+// transition it triggered, if any.
+func (h *Handler) record(i int, err error) {
+	h.mu.Lock()
+
+	from := h.active()
+	m := h.members[i]
+	m.probing = false
+	if err == nil {
+		m.failures = 0
+		m.unhealthy = false
+	} else {
+		m.failures++
+		switch {
+		case m.unhealthy:
+			m.backoff *= 2
+			if m.backoff > h.MaxBackoff {
+				m.backoff = h.MaxBackoff
+			}
+			m.next = h.Clock.Now().Add(m.backoff)
+		case m.failures >= h.Threshold:
+			m.unhealthy = true
+			m.backoff = h.ProbeBackoff
+			m.next = h.Clock.Now().Add(m.backoff)
+		}
+	}
+	to := h.active()
+	failures := m.failures
+	h.mu.Unlock()
+
+	if from == to || to < 0 {
+		return
+	}
+
+	t := &log.Entry{Timestamp: h.Clock.Now(), Level: log.InfoLevel}
+	switch {
+	case from < 0:
+		t.Message = fmt.Sprintf("failover: handler %d recovered", to)
+	case to > from:
+		t.Level = log.WarnLevel
+		t.Message = fmt.Sprintf("failover: failing over from handler %d to handler %d", from, to)
+		t.Fields = log.Fields{
+			{Name: "failures", Value: failures},
+			{Name: "error", Value: err.Error()},
+		}
+	default:
+		t.Message = fmt.Sprintf("failover: failing back from handler %d to handler %d", from, to)
+	}
+	t.Fields = append(t.Fields, &log.Field{Name: "from", Value: from}, &log.Field{Name: "to", Value: to})
+	_ = h.members[to].handler.HandleLog(t)
+}
+
+// Flush flushes the handlers implementing Flush() error or
+// Flush(context.Context) error, and returns the first error.
+func (h *Handler) Flush() error {
+	var ret error
+	for _, m := range h.members {
+		var err error
+		switch f := m.handler.(type) {
+		case interface{ Flush(context.Context) error }:
+			err = f.Flush(context.Background())
+		case interface{ Flush() error }:
+			err = f.Flush()
+		}
+		if err != nil && ret == nil {
+			ret = err
+		}
+	}
+	return ret
+}
+
+// Close closes the handlers implementing Close() error or
+// Close(context.Context) error, and returns the first error.
+func (h *Handler) Close() error {
+	var ret error
+	for _, m := range h.members {
+		var err error
+		switch c := m.handler.(type) {
+		case interface{ Close(context.Context) error }:
+			err = c.Close(context.Background())
+		case interface{ Close() error }:
+			err = c.Close()
+		}
+		if err != nil && ret == nil {
+			ret = err
+		}
+	}
+	return ret
+}
@@ -0,0 +1,122 @@
+package failover_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/eluv-io/apexlog-go"
+	"github.com/eluv-io/apexlog-go/handlers/async"
+	"github.com/eluv-io/apexlog-go/handlers/failover"
+	"github.com/eluv-io/apexlog-go/handlers/memory"
+	"github.com/eluv-io/apexlog-go/logtest"
+)
+
+// flaky is a memory handler failing while down.
+type flaky struct {
+	*memory.Handler
+	mu    sync.Mutex
+	down  bool
+	calls int
+}
+
+func newFlaky() *flaky {
+	return &flaky{Handler: memory.New()}
+}
+
+func (f *flaky) HandleLog(e *log.Entry) error {
+	f.mu.Lock()
+	f.calls++
+	down := f.down
+	f.mu.Unlock()
+
+	if down {
+		return errors.New("unavailable")
+	}
+	return f.Handler.HandleLog(e)
+}
+
+func (f *flaky) setDown(down bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.down = down
+}
+
+func TestHandler(t *testing.T) {
+	primary, secondary := newFlaky(), newFlaky()
+	clock := logtest.NewClock(logtest.Timestamp)
+	h := failover.New(&failover.Config{Threshold: 2, ProbeBackoff: time.Second, Clock: clock}, primary, secondary)
+	l := &log.Logger{Handler: h, Level: log.InfoLevel, Clock: clock}
+
+	l.Info("a")
+	assert.Equal(t, 0, h.Active())
+
+	// entries go to the secondary on errors, it takes over after Threshold
+	primary.setDown(true)
+	l.Info("b")
+	assert.Equal(t, 0, h.Active())
+	l.Info("c")
+	assert.Equal(t, 1, h.Active())
+	l.Info("d")
+	assert.Equal(t, 3, primary.calls)
+
+	snapshot := secondary.Snapshot()
+	assert.Equal(t, []string{"b", "failover: failing over from handler 0 to handler 1", "c", "d"}, secondary.Handler.Messages())
+	transition := snapshot[1]
+	assert.Equal(t, log.WarnLevel, transition.Level)
+	assert.Equal(t, 2, transition.Fields.Get("failures"))
+	assert.Equal(t, "unavailable", transition.Fields.Get("error"))
+	assert.Equal(t, 0, transition.Fields.Get("from"))
+	assert.Equal(t, 1, transition.Fields.Get("to"))
+
+	// failed probes double the backoff
+	clock.Add(time.Second)
+	l.Info("e")
+	assert.Equal(t, 4, primary.calls)
+	clock.Add(time.Second)
+	l.Info("f")
+	assert.Equal(t, 4, primary.calls)
+
+	// a successful probe fails back
+	primary.setDown(false)
+	clock.Add(time.Second)
+	l.Info("g")
+	assert.Equal(t, 0, h.Active())
+	l.Info("h")
+	assert.Equal(t, []string{"a", "g", "failover: failing back from handler 1 to handler 0", "h"}, primary.Handler.Messages())
+	assert.Equal(t, log.InfoLevel, primary.Snapshot()[2].Level)
+}
+
+func TestHandler_unavailable(t *testing.T) {
+	primary, secondary := newFlaky(), newFlaky()
+	primary.setDown(true)
+	secondary.setDown(true)
+	clock := logtest.NewClock(logtest.Timestamp)
+	h := failover.New(&failover.Config{Threshold: 1, Clock: clock}, primary, secondary)
+
+	assert.EqualError(t, h.HandleLog(&log.Entry{Message: "a"}), "unavailable")
+	assert.Equal(t, -1, h.Active())
+	assert.Equal(t, failover.ErrUnavailable, h.HandleLog(&log.Entry{Message: "b"}))
+
+	secondary.setDown(false)
+	clock.Add(time.Second)
+	assert.NoError(t, h.HandleLog(&log.Entry{Message: "c"}))
+	assert.Equal(t, 1, h.Active())
+	assert.Equal(t, []string{"c", "failover: handler 1 recovered"}, secondary.Handler.Messages())
+}
+
+func TestHandler_Close(t *testing.T) {
+	mem := memory.New()
+	a := async.New(mem, nil)
+	h := failover.New(nil, a)
+
+	assert.NoError(t, h.HandleLog(&log.Entry{Message: "a", Level: log.InfoLevel}))
+	assert.NoError(t, h.Flush())
+	assert.Equal(t, []string{"a"}, mem.Messages())
+
+	assert.NoError(t, h.Close())
+	assert.Equal(t, async.ErrClosed, a.HandleLog(&log.Entry{}))
+}
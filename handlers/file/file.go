@@ -0,0 +1,410 @@
+// Package file implements a writer to a log file rotated by size and time,
+// with a retention policy and optional compression of the rotated files.
+//
+// The writer is meant to be used with formatting handlers:
+//
+//	w, err := file.New(&file.Config{
+//		Filename: "/var/log/app/app.log",
+//		MaxSize:  100 << 20,
+//		MaxCount: 10,
+//		Compress: true,
+//	})
+//	if err != nil {
+//		...
+//	}
+//	defer w.Close()
+//	log.SetHandler(json.New(w))
+//
+// Rotated files are renamed with the time of their rotation, as in
+// "app-2020-01-02T03-04-05.000.log", and compressed to "….log.gz" if
+// Compress is set. Retention and compression run in the background.
+package file
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	stdlog "log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eluv-io/apexlog-go"
+)
+
+// ErrClosed is returned when writing to a closed writer.
+var ErrClosed = errors.New("file: writer closed")
+
+// timeFormat is the format of the rotation time in the names of rotated
+// files.
+const timeFormat = "2006-01-02T15-04-05.000"
+
+// compressSuffix is the suffix of compressed files.
+const compressSuffix = ".gz"
+
+// Config for writer.
+type Config struct {
+	Filename string        // Filename is the path of the log file, its directory is created if missing
+	MaxSize  int64         // MaxSize is the size in bytes beyond which the file is rotated, 0 for no size based rotation
+	Interval time.Duration // Interval is the period of time based rotations, aligned on UTC multiples of it: 24h rotates at midnight UTC, 0 for no time based rotation
+	MaxAge   time.Duration // MaxAge is the max age of rotated files, older files are removed, 0 to keep them
+	MaxCount int           // MaxCount is the max number of rotated files, the oldest are removed beyond, 0 to keep them
+	Compress bool          // Compress gzips rotated files
+	Perm     os.FileMode   // Perm are the permissions of created files (default: 0644)
+	DirPerm  os.FileMode   // DirPerm are the permissions of created directories (default: 0755)
+	Clock    log.Clock     // Clock is used for rotations and retention (default: log.SystemClock)
+}
+
+// defaults applies defaults to the config.
+func (c *Config) defaults() {
+	if c.Perm == 0 {
+		c.Perm = 0644
+	}
+
+	if c.DirPerm == 0 {
+		c.DirPerm = 0755
+	}
+
+	if c.Clock == nil {
+		c.Clock = log.SystemClock
+	}
+}
+
+// Writer implementation.
+type Writer struct {
+	*Config
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64     // size is the size of the file
+	next   time.Time // next is the time of the next time based rotation
+	closed bool
+
+	mill    chan struct{} // mill requests a retention and compression run
+	stopped chan struct{}
+}
+
+// New writer. The file is opened - and its directory created - immediately,
+// so that configuration errors are reported early.
+func New(config *Config) (*Writer, error) {
+	if config.Filename == "" {
+		return nil, errors.New("file: missing filename")
+	}
+	config.defaults()
+
+	w := &Writer{
+		Config:  config,
+		mill:    make(chan struct{}, 1),
+		stopped: make(chan struct{}),
+	}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	go w.loop()
+	w.requestMill()
+	return w, nil
+}
+
+// Write implements io.Writer. The file is rotated before the write if the
+// write would make it exceed MaxSize, or if the rotation interval elapsed.
+func (w *Writer) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return 0, ErrClosed
+	}
+
+	if w.file == nil {
+		if err := w.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	rotate := w.MaxSize > 0 && w.size > 0 && w.size+int64(len(p)) > w.MaxSize
+	rotate = rotate || (w.Interval > 0 && !w.Clock.Now().Before(w.next))
+	if rotate {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// Rotate rotates the file.
+func (w *Writer) Rotate() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return ErrClosed
+	}
+	if w.file == nil {
+		if err := w.open(); err != nil {
+			return err
+		}
+	}
+	return w.rotate()
+}
+
+// Reopen closes and reopens the file, e.g. after it was moved by an external
+// tool.
+func (w *Writer) Reopen() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return ErrClosed
+	}
+	if w.file != nil {
+		err := w.file.Close()
+		w.file = nil
+		if err != nil {
+			return err
+		}
+	}
+	return w.open()
+}
+
+// Close closes the file and waits for the background retention and
+// compression to complete.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	w.closed = true
+	var err error
+	if w.file != nil {
+		err = w.file.Close()
+		w.file = nil
+	}
+	close(w.mill)
+	w.mu.Unlock()
+
+	<-w.stopped
+	return err
+}
+
+// open opens the file in append mode, creating it and its directory if
+// needed. The time of the next time based rotation is computed from the
+// modification time of an existing file.
+func (w *Writer) open() error {
+	if err := os.MkdirAll(filepath.Dir(w.Filename), w.DirPerm); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(w.Filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, w.Perm)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	w.file = f
+	w.size = info.Size()
+	if w.Interval > 0 {
+		start := w.Clock.Now()
+		if w.size > 0 {
+			start = info.ModTime()
+		}
+		w.next = start.Truncate(w.Interval).Add(w.Interval)
+	}
+	return nil
+}
+
+// rotate renames the file with the rotation time and opens a new file.
+func (w *Writer) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	w.file = nil
+
+	now := w.Clock.Now()
+	name := w.backupName(now)
+	for exists(name) || exists(name+compressSuffix) {
+		now = now.Add(time.Millisecond)
+		name = w.backupName(now)
+	}
+	if err := os.Rename(w.Filename, name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := w.open(); err != nil {
+		return err
+	}
+	w.requestMill()
+	return nil
+}
+
+// requestMill requests a retention and compression run, if not already
+// requested.
+func (w *Writer) requestMill() {
+	if w.MaxAge == 0 && w.MaxCount == 0 && !w.Compress {
+		return
+	}
+	select {
+	case w.mill <- struct{}{}:
+	default:
+	}
+}
+
+// loop runs the requested retention and compression runs until the writer is
+// closed.
+func (w *Writer) loop() {
+	defer close(w.stopped)
+
+	for range w.mill {
+		if err := w.millRun(); err != nil {
+			stdlog.Printf("log/file: failed to process rotated files: %s", err)
+		}
+	}
+}
+
+// backup is a rotated file.
+type backup struct {
+	path string
+	time time.Time
+}
+
+// millRun removes the rotated files beyond MaxCount or older than MaxAge, and
+// compresses the remaining ones if Compress is set.
+func (w *Writer) millRun() error {
+	backups, err := w.backups()
+	if err != nil {
+		return err
+	}
+
+	var remove, keep []backup
+	cutoff := w.Clock.Now().Add(-w.MaxAge)
+	for i, b := range backups {
+		if (w.MaxCount > 0 && i >= w.MaxCount) || (w.MaxAge > 0 && b.time.Before(cutoff)) {
+			remove = append(remove, b)
+		} else {
+			keep = append(keep, b)
+		}
+	}
+
+	var errs []string
+	for _, b := range remove {
+		if err := os.Remove(b.path); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err.Error())
+		}
+	}
+	if w.Compress {
+		for _, b := range keep {
+			if strings.HasSuffix(b.path, compressSuffix) {
+				continue
+			}
+			if err := compress(b.path, w.Perm); err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// backupName returns the name of the file rotated at the given time.
+func (w *Writer) backupName(t time.Time) string {
+	prefix, ext := w.nameParts()
+	return fmt.Sprintf("%s%s%s", prefix, t.UTC().Format(timeFormat), ext)
+}
+
+// nameParts returns the prefix - the file name without its extension and a
+// dash - and the extension of rotated files.
+func (w *Writer) nameParts() (prefix, ext string) {
+	ext = filepath.Ext(w.Filename)
+	return strings.TrimSuffix(w.Filename, ext) + "-", ext
+}
+
+// backups returns the rotated files, newest first.
+func (w *Writer) backups() ([]backup, error) {
+	infos, err := ioutil.ReadDir(filepath.Dir(w.Filename))
+	if err != nil {
+		return nil, err
+	}
+
+	prefix, ext := w.nameParts()
+	prefix = filepath.Base(prefix)
+
+	var backups []backup
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+		name := strings.TrimSuffix(info.Name(), compressSuffix)
+		if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ext) {
+			continue
+		}
+		t, err := time.Parse(timeFormat, name[len(prefix):len(name)-len(ext)])
+		if err != nil {
+			continue
+		}
+		backups = append(backups, backup{
+			path: filepath.Join(filepath.Dir(w.Filename), info.Name()),
+			time: t,
+		})
+	}
+
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].time.After(backups[j].time)
+	})
+	return backups, nil
+}
+
+// compress gzips the file and removes it. The compressed file is written
+// under a temporary name and renamed once complete.
+func compress(path string, perm os.FileMode) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp := path + compressSuffix + ".tmp"
+	dst, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(dst)
+	_, err = io.Copy(gz, src)
+	if err == nil {
+		err = gz.Close()
+	}
+	if err == nil {
+		err = dst.Sync()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path+compressSuffix)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Remove(path)
+}
+
+// exists returns true if the file exists.
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
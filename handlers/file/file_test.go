@@ -0,0 +1,217 @@
+package file_test
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/eluv-io/apexlog-go"
+	"github.com/eluv-io/apexlog-go/handlers/file"
+	"github.com/eluv-io/apexlog-go/handlers/json"
+	"github.com/eluv-io/apexlog-go/logtest"
+)
+
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "file")
+	require.NoError(t, err)
+	return dir, func() { _ = os.RemoveAll(dir) }
+}
+
+// files returns the names of the files of the directory and their content.
+func files(t *testing.T, dir string) map[string]string {
+	infos, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+
+	ret := make(map[string]string)
+	for _, info := range infos {
+		path := filepath.Join(dir, info.Name())
+		b, err := ioutil.ReadFile(path)
+		require.NoError(t, err)
+		if strings.HasSuffix(path, ".gz") {
+			gz, err := gzip.NewReader(strings.NewReader(string(b)))
+			require.NoError(t, err)
+			b, err = ioutil.ReadAll(gz)
+			require.NoError(t, err)
+		}
+		ret[info.Name()] = string(b)
+	}
+	return ret
+}
+
+func names(m map[string]string) []string {
+	var ret []string
+	for name := range m {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func TestWriter_size(t *testing.T) {
+	dir, done := tempDir(t)
+	defer done()
+
+	clock := logtest.NewClock(logtest.Timestamp)
+	w, err := file.New(&file.Config{
+		Filename: filepath.Join(dir, "logs", "app.log"),
+		MaxSize:  10,
+		Clock:    clock,
+	})
+	require.NoError(t, err)
+
+	for _, s := range []string{"aaaa\n", "bbbb\n", "cccc\n", "dddddddddddd\n", "e\n"} {
+		clock.Add(time.Second)
+		_, err := w.Write([]byte(s))
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Close())
+
+	assert.Equal(t, map[string]string{
+		"app-2020-01-02T03-04-08.000.log": "aaaa\nbbbb\n",
+		"app-2020-01-02T03-04-09.000.log": "cccc\n",
+		"app-2020-01-02T03-04-10.000.log": "dddddddddddd\n",
+		"app.log":                         "e\n",
+	}, files(t, filepath.Join(dir, "logs")))
+
+	_, err = w.Write([]byte("x"))
+	assert.Equal(t, file.ErrClosed, err)
+}
+
+func TestWriter_interval(t *testing.T) {
+	dir, done := tempDir(t)
+	defer done()
+
+	clock := logtest.NewClock(logtest.Timestamp)
+	path := filepath.Join(dir, "app.log")
+	w, err := file.New(&file.Config{
+		Filename: path,
+		Interval: time.Hour,
+		Clock:    clock,
+	})
+	require.NoError(t, err)
+
+	_, _ = w.Write([]byte("a\n"))
+	clock.Add(30 * time.Minute)
+	_, _ = w.Write([]byte("b\n"))
+	clock.Add(30 * time.Minute) // 04:04:05
+	_, _ = w.Write([]byte("c\n"))
+	require.NoError(t, w.Close())
+
+	assert.Equal(t, map[string]string{
+		"app-2020-01-02T04-04-05.000.log": "a\nb\n",
+		"app.log":                         "c\n",
+	}, files(t, dir))
+
+	// the file of a previous interval is rotated on the first write
+	require.NoError(t, os.Chtimes(path, logtest.Timestamp, logtest.Timestamp))
+	w, err = file.New(&file.Config{
+		Filename: path,
+		Interval: time.Hour,
+		Clock:    clock,
+	})
+	require.NoError(t, err)
+	_, _ = w.Write([]byte("d\n"))
+	require.NoError(t, w.Close())
+	assert.Len(t, files(t, dir), 3)
+}
+
+func TestWriter_retention(t *testing.T) {
+	dir, done := tempDir(t)
+	defer done()
+
+	clock := logtest.NewClock(logtest.Timestamp)
+	w, err := file.New(&file.Config{
+		Filename: filepath.Join(dir, "app.log"),
+		MaxCount: 2,
+		Compress: true,
+		Clock:    clock,
+	})
+	require.NoError(t, err)
+
+	for i := 0; i < 4; i++ {
+		clock.Add(time.Second)
+		_, _ = w.Write([]byte(strings.Repeat("x", i+1)))
+		require.NoError(t, w.Rotate())
+	}
+	require.NoError(t, w.Close())
+
+	assert.Equal(t, map[string]string{
+		"app-2020-01-02T03-04-08.000.log.gz": "xxx",
+		"app-2020-01-02T03-04-09.000.log.gz": "xxxx",
+		"app.log":                            "",
+	}, files(t, dir))
+
+	// rotated files older than MaxAge are removed, also on startup
+	clock.Add(time.Hour)
+	w, err = file.New(&file.Config{
+		Filename: filepath.Join(dir, "app.log"),
+		MaxAge:   time.Hour,
+		Clock:    clock,
+	})
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	assert.Equal(t, []string{"app-2020-01-02T03-04-09.000.log.gz", "app.log"}, names(files(t, dir)))
+}
+
+func TestWriter_reopen(t *testing.T) {
+	dir, done := tempDir(t)
+	defer done()
+
+	path := filepath.Join(dir, "app.log")
+	w, err := file.New(&file.Config{Filename: path})
+	require.NoError(t, err)
+	defer w.Close()
+
+	_, _ = w.Write([]byte("a\n"))
+	require.NoError(t, os.Rename(path, path+".1"))
+	_, _ = w.Write([]byte("b\n"))
+	require.NoError(t, w.Reopen())
+	_, _ = w.Write([]byte("c\n"))
+
+	assert.Equal(t, map[string]string{
+		"app.log.1": "a\nb\n",
+		"app.log":   "c\n",
+	}, files(t, dir))
+}
+
+func TestWriter_collision(t *testing.T) {
+	dir, done := tempDir(t)
+	defer done()
+
+	w, err := file.New(&file.Config{
+		Filename: filepath.Join(dir, "app"),
+		Clock:    logtest.NewClock(logtest.Timestamp),
+	})
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		_, _ = w.Write([]byte("a"))
+		require.NoError(t, w.Rotate())
+	}
+	require.NoError(t, w.Close())
+
+	assert.Equal(t, []string{"app", "app-2020-01-02T03-04-05.000", "app-2020-01-02T03-04-05.001"}, names(files(t, dir)))
+}
+
+func TestWriter_json(t *testing.T) {
+	dir, done := tempDir(t)
+	defer done()
+
+	w, err := file.New(&file.Config{Filename: filepath.Join(dir, "app.log")})
+	require.NoError(t, err)
+
+	l := &log.Logger{Handler: json.New(w), Level: log.InfoLevel, Clock: logtest.NewClock(logtest.Timestamp)}
+	l.Info("hello", "user", "tj")
+	require.NoError(t, w.Close())
+
+	assert.Equal(t, `{"fields":{"user":"tj"},"level":"info","timestamp":"2020-01-02T03:04:05Z","message":"hello"}`+"\n",
+		files(t, dir)["app.log"])
+}
@@ -0,0 +1,484 @@
+package filter
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/eluv-io/apexlog-go"
+)
+
+// SyntaxError is the error of invalid expressions.
+type SyntaxError struct {
+	Expr   string // Expr is the expression
+	Offset int    // Offset is the byte offset of the error in Expr
+	Msg    string // Msg describes the error
+}
+
+// Error implements error.
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("filter: %s at offset %d in %q", e.Msg, e.Offset, e.Expr)
+}
+
+// tokenKind is the kind of a token.
+type tokenKind int
+
+// Token kinds.
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenString
+	tokenNumber
+	tokenOp
+)
+
+// token is a lexical token.
+type token struct {
+	kind tokenKind
+	text string  // text is the token as written
+	off  int     // off is the offset of the token in the expression
+	str  string  // str is the value of strings
+	num  float64 // num is the value of numbers
+}
+
+// ops are the operators, longest first.
+var ops = []string{"&&", "||", "==", "!=", "<=", ">=", "=~", "!~", "!", "<", ">", "(", ")", "[", "]"}
+
+// lex splits the expression in tokens.
+func lex(expr string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '"':
+			j := i + 1
+			for ; j < len(expr) && expr[j] != '"'; j++ {
+				if expr[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(expr) {
+				return nil, &SyntaxError{Expr: expr, Offset: i, Msg: "unterminated string"}
+			}
+			s, err := strconv.Unquote(expr[i : j+1])
+			if err != nil {
+				msg := fmt.Sprintf("invalid string %s: %s, escape backslashes or use a raw string in backquotes", expr[i:j+1], err)
+				return nil, &SyntaxError{Expr: expr, Offset: i, Msg: msg}
+			}
+			tokens = append(tokens, token{kind: tokenString, text: expr[i : j+1], off: i, str: s})
+			i = j + 1
+		case c == '`':
+			j := strings.IndexByte(expr[i+1:], '`')
+			if j < 0 {
+				return nil, &SyntaxError{Expr: expr, Offset: i, Msg: "unterminated string"}
+			}
+			j += i + 1
+			tokens = append(tokens, token{kind: tokenString, text: expr[i : j+1], off: i, str: expr[i+1 : j]})
+			i = j + 1
+		case c == '-' || c == '.' || (c >= '0' && c <= '9'):
+			j := i + 1
+			for j < len(expr) && (expr[j] == '.' || expr[j] == 'e' || expr[j] == 'E' || (expr[j] >= '0' && expr[j] <= '9') ||
+				((expr[j] == '-' || expr[j] == '+') && (expr[j-1] == 'e' || expr[j-1] == 'E'))) {
+				j++
+			}
+			n, err := strconv.ParseFloat(expr[i:j], 64)
+			if err != nil {
+				return nil, &SyntaxError{Expr: expr, Offset: i, Msg: fmt.Sprintf("invalid number %q", expr[i:j])}
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: expr[i:j], off: i, num: n})
+			i = j
+		case c == '_' || isLetter(c):
+			j := i + 1
+			for j < len(expr) && (expr[j] == '_' || expr[j] == '.' || isLetter(expr[j]) || (expr[j] >= '0' && expr[j] <= '9')) {
+				j++
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: expr[i:j], off: i})
+			i = j
+		default:
+			op := ""
+			for _, o := range ops {
+				if strings.HasPrefix(expr[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				r, _ := utf8.DecodeRuneInString(expr[i:])
+				return nil, &SyntaxError{Expr: expr, Offset: i, Msg: fmt.Sprintf("unexpected character %q", r)}
+			}
+			tokens = append(tokens, token{kind: tokenOp, text: op, off: i})
+			i += len(op)
+		}
+	}
+	return append(tokens, token{kind: tokenEOF, off: len(expr)}), nil
+}
+
+// isLetter returns true for ASCII letters: identifiers are ASCII, other names
+// are quoted in fields["<name>"].
+func isLetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// cond is a compiled condition.
+type cond func(e *log.Entry) bool
+
+// operand is a compiled operand. It returns the value and whether it exists.
+type operand func(e *log.Entry) (interface{}, bool)
+
+// parser is a recursive descent parser of expressions:
+//
+//	or         = and { "||" and }
+//	and        = unary { "&&" unary }
+//	unary      = "!" unary | "(" or ")" | comparison
+//	comparison = value [ ( "==" | "!=" | "<" | "<=" | ">" | ">=" ) value
+//	               | ( "=~" | "!~" ) string ]
+//	value      = "level" | "message" | "fields." name
+//	           | "fields" "[" string "]" | string | number
+//	           | "true" | "false" | "null" | level name
+type parser struct {
+	expr   string
+	tokens []token
+	pos    int
+}
+
+// compile compiles the expression.
+func compile(expr string) (cond, error) {
+	tokens, err := lex(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{expr: expr, tokens: tokens}
+	c, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, p.errorf(t, "unexpected %q", t.text)
+	}
+	return c, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+// accept consumes the next token and returns true if it is the operator.
+func (p *parser) accept(op string) bool {
+	if t := p.peek(); t.kind == tokenOp && t.text == op {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) errorf(t token, format string, args ...interface{}) error {
+	msg := fmt.Sprintf(format, args...)
+	if t.kind == tokenEOF {
+		msg = strings.Replace(msg, `""`, "end of expression", 1)
+	}
+	return &SyntaxError{Expr: p.expr, Offset: t.off, Msg: msg}
+}
+
+func (p *parser) or() (cond, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(e *log.Entry) bool { return l(e) || right(e) }
+	}
+	return left, nil
+}
+
+func (p *parser) and() (cond, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(e *log.Entry) bool { return l(e) && right(e) }
+	}
+	return left, nil
+}
+
+func (p *parser) unary() (cond, error) {
+	if p.accept("!") {
+		c, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(e *log.Entry) bool { return !c(e) }, nil
+	}
+
+	if open := p.peek(); p.accept("(") {
+		c, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if !p.accept(")") {
+			return nil, p.errorf(p.peek(), "expected ) to close ( at offset %d, got %q", open.off, p.peek().text)
+		}
+		return c, nil
+	}
+
+	return p.comparison()
+}
+
+func (p *parser) comparison() (cond, error) {
+	left, err := p.value()
+	if err != nil {
+		return nil, err
+	}
+
+	t := p.peek()
+	if t.kind != tokenOp {
+		return func(e *log.Entry) bool { return truthy(left(e)) }, nil
+	}
+
+	switch t.text {
+	case "=~", "!~":
+		p.next()
+		rt := p.next()
+		if rt.kind != tokenString {
+			return nil, p.errorf(rt, "expected a regular expression string after %s, got %q", t.text, rt.text)
+		}
+		re, err := regexp.Compile(rt.str)
+		if err != nil {
+			return nil, p.errorf(rt, "invalid regular expression: %s", err)
+		}
+		negate := t.text == "!~"
+		return func(e *log.Entry) bool {
+			v, ok := left(e)
+			return (ok && v != nil && re.MatchString(format(v))) != negate
+		}, nil
+	case "==", "!=", "<", "<=", ">", ">=":
+		p.next()
+		right, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		op := t.text
+		return func(e *log.Entry) bool {
+			a, _ := left(e)
+			b, _ := right(e)
+			return compare(op, a, b)
+		}, nil
+	}
+	return func(e *log.Entry) bool { return truthy(left(e)) }, nil
+}
+
+func (p *parser) value() (operand, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenString:
+		s := t.str
+		return func(*log.Entry) (interface{}, bool) { return s, true }, nil
+	case tokenNumber:
+		n := t.num
+		return func(*log.Entry) (interface{}, bool) { return n, true }, nil
+	case tokenIdent:
+		switch {
+		case t.text == "level":
+			return func(e *log.Entry) (interface{}, bool) { return e.Level, true }, nil
+		case t.text == "message":
+			return func(e *log.Entry) (interface{}, bool) { return e.Message, true }, nil
+		case t.text == "true" || t.text == "false":
+			b := t.text == "true"
+			return func(*log.Entry) (interface{}, bool) { return b, true }, nil
+		case t.text == "null":
+			return func(*log.Entry) (interface{}, bool) { return nil, true }, nil
+		case t.text == "fields" && p.accept("["):
+			nt := p.next()
+			if nt.kind != tokenString {
+				return nil, p.errorf(nt, "expected a field name string after fields[, got %q", nt.text)
+			}
+			if !p.accept("]") {
+				return nil, p.errorf(p.peek(), "expected ] after the field name, got %q", p.peek().text)
+			}
+			return field(nt.str), nil
+		case strings.HasPrefix(t.text, "fields."):
+			name := strings.TrimPrefix(t.text, "fields.")
+			if name == "" {
+				return nil, p.errorf(t, "missing field name")
+			}
+			return field(name), nil
+		}
+		if l, err := log.ParseLevel(t.text); err == nil {
+			return func(*log.Entry) (interface{}, bool) { return l, true }, nil
+		}
+		return nil, p.errorf(t, "unknown identifier %q, expected level, message, fields.<name>, fields[\"<name>\"], a level name, true, false or null", t.text)
+	}
+	return nil, p.errorf(t, "expected a value, got %q", t.text)
+}
+
+// field returns the operand of the value of the named field.
+func field(name string) operand {
+	return func(e *log.Entry) (interface{}, bool) {
+		for _, f := range e.Fields {
+			if f.Name == name {
+				return f.Value, true
+			}
+		}
+		return nil, false
+	}
+}
+
+// truthy returns the truth value of a value used as a condition: missing,
+// null, false, zero and empty values are false.
+func truthy(v interface{}, ok bool) bool {
+	if !ok || v == nil {
+		return false
+	}
+	switch v := v.(type) {
+	case bool:
+		return v
+	case string:
+		return v != ""
+	}
+	if n, ok := number(v); ok {
+		return n != 0
+	}
+	return true
+}
+
+// compare compares the values. Levels are compared with levels, level names
+// and numbers, numbers with numbers and strings with strings. Other values
+// are equal if formatted the same.
+func compare(op string, a, b interface{}) bool {
+	if a == nil || b == nil {
+		switch op {
+		case "==":
+			return a == b
+		case "!=":
+			return a != b
+		}
+		return false
+	}
+
+	var c int
+	switch {
+	case isLevel(a) || isLevel(b):
+		la, oka := level(a)
+		lb, okb := level(b)
+		if !oka || !okb {
+			return op == "!="
+		}
+		c = int(la) - int(lb)
+	default:
+		na, oka := number(a)
+		nb, okb := number(b)
+		if oka && okb {
+			switch {
+			case na < nb:
+				c = -1
+			case na > nb:
+				c = 1
+			}
+			break
+		}
+		sa, oka := a.(string)
+		sb, okb := b.(string)
+		if !oka || !okb {
+			if op != "==" && op != "!=" {
+				return false
+			}
+			sa, sb = format(a), format(b)
+		}
+		c = strings.Compare(sa, sb)
+	}
+
+	switch op {
+	case "==":
+		return c == 0
+	case "!=":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	}
+	return c >= 0
+}
+
+func isLevel(v interface{}) bool {
+	_, ok := v.(log.Level)
+	return ok
+}
+
+// level converts levels, level names and numbers to levels.
+func level(v interface{}) (log.Level, bool) {
+	switch v := v.(type) {
+	case log.Level:
+		return v, true
+	case string:
+		l, err := log.ParseLevel(v)
+		return l, err == nil
+	}
+	if n, ok := number(v); ok {
+		return log.Level(n), true
+	}
+	return 0, false
+}
+
+// number converts numeric values to float64.
+func number(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int8:
+		return float64(v), true
+	case int16:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint:
+		return float64(v), true
+	case uint8:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// format formats the value for string comparisons and regular expressions.
+func format(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,103 @@
+// Package filter implements a handler passing the entries matching a filter
+// expression to another handler. Expressions are compiled once, and may be
+// changed at runtime with SetFilter, e.g. on configuration reloads:
+//
+//	h, err := filter.New(handler, `level >= warn && fields.tenant == "acme" && !(message =~ "^healthcheck")`)
+//
+// Expressions combine conditions with &&, || and !, and parentheses.
+// Conditions compare values with ==, !=, <, <=, >, >=, or match them with
+// the regular expressions of =~ and !~. Values are:
+//
+//   - level, the level of the entry, compared with level names such as warn
+//   - message, the message of the entry
+//   - fields.<name>, the value of a field, null if missing, or
+//     fields["<name>"] for names with other characters than ASCII letters,
+//     digits, _ and .
+//   - strings in double quotes, raw strings in backquotes - handy for regular
+//     expressions: message =~ `\d+` - numbers, true, false and null
+//
+// A value alone is a condition true if the value isn't missing, null, false,
+// zero or empty, e.g. fields.audit.
+package filter
+
+import (
+	"sync/atomic"
+
+	"github.com/eluv-io/apexlog-go"
+)
+
+// Filter is a compiled filter expression. Filters are safe for concurrent
+// use.
+type Filter struct {
+	expr string
+	cond cond
+}
+
+// Compile compiles the expression. Invalid expressions are reported with a
+// *SyntaxError.
+func Compile(expr string) (*Filter, error) {
+	c, err := compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	return &Filter{expr: expr, cond: c}, nil
+}
+
+// MustCompile is like Compile but panics on invalid expressions.
+func MustCompile(expr string) *Filter {
+	f, err := Compile(expr)
+	if err != nil {
+		panic(err)
+	}
+	return f
+}
+
+// Match returns true if the entry matches the filter.
+func (f *Filter) Match(e *log.Entry) bool {
+	return f.cond(e)
+}
+
+// String returns the expression of the filter.
+func (f *Filter) String() string {
+	return f.expr
+}
+
+// Handler implementation.
+type Handler struct {
+	filter  atomic.Value // filter is the current *Filter
+	Handler log.Handler
+}
+
+// New handler passing the entries matching the expression to h.
+func New(h log.Handler, expr string) (*Handler, error) {
+	ret := &Handler{Handler: h}
+	if err := ret.SetFilter(expr); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// SetFilter replaces the filter of the handler. The filter is unchanged if
+// the expression is invalid.
+func (h *Handler) SetFilter(expr string) error {
+	f, err := Compile(expr)
+	if err != nil {
+		return err
+	}
+	h.filter.Store(f)
+	return nil
+}
+
+// Filter returns the current filter.
+func (h *Handler) Filter() *Filter {
+	return h.filter.Load().(*Filter)
+}
+
+// HandleLog implements log.Handler.
+func (h *Handler) HandleLog(e *log.Entry) error {
+	if !h.Filter().Match(e) {
+		return nil
+	}
+
+	return h.Handler.HandleLog(e)
+}
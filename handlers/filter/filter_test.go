@@ -0,0 +1,129 @@
+package filter_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/eluv-io/apexlog-go"
+	"github.com/eluv-io/apexlog-go/handlers/filter"
+	"github.com/eluv-io/apexlog-go/handlers/memory"
+)
+
+func TestFilter_Match(t *testing.T) {
+	e := &log.Entry{
+		Level:   log.WarnLevel,
+		Message: "healthcheck ok",
+		Fields: log.Fields{
+			{Name: "tenant", Value: "acme"},
+			{Name: "status", Value: 503},
+			{Name: "ratio", Value: 0.5},
+			{Name: "audit", Value: true},
+			{Name: "http.method", Value: "GET"},
+			{Name: "x-request-id", Value: "42"},
+			{Name: "empty", Value: ""},
+			{Name: "none", Value: nil},
+		},
+	}
+	for expr, matches := range map[string]bool{
+		`level >= warn`:                  true,
+		`level > warn`:                   false,
+		`level == "warning"`:             true,
+		`level < 4`:                      true,
+		`level != info`:                  true,
+		`message == "healthcheck ok"`:    true,
+		`message =~ "^health"`:           true,
+		`message !~ "^health"`:           false,
+		`!(message =~ "^health")`:        false,
+		`fields.tenant == "acme"`:        true,
+		`fields.tenant != "acme"`:        false,
+		`fields.status >= 500`:           true,
+		`fields.status == "503"`:         true,
+		`fields.status < 1e3`:            true,
+		`fields.ratio == .5`:             true,
+		`fields.ratio > -1`:              true,
+		`fields.audit`:                   true,
+		`fields.audit == true`:           true,
+		`fields.audit == "true"`:         true,
+		`fields.http.method == "GET"`:    true,
+		`fields.status =~ "^5"`:          true,
+		`fields.status =~ ` + "`^\\d+$`": true,
+		`fields["x-request-id"] == "42"`: true,
+		`fields["http.method"] == "GET"`: true,
+		`fields["missing"]`:              false,
+		`fields.empty`:                   false,
+		`fields.none`:                    false,
+		`fields.none == null`:            true,
+		`fields.missing`:                 false,
+		`fields.missing == null`:         true,
+		`fields.missing != "x"`:          true,
+		`fields.missing > 1`:             false,
+		`fields.missing =~ ""`:           false,
+		`fields.tenant < "b"`:            true,
+		`fields.audit < "b"`:             false,
+		`level >= warn && fields.tenant == "acme" && !(message =~ "^healthcheck")`: false,
+		`level >= error || fields.tenant == "acme" && fields.audit`:                true,
+		`(level >= error || fields.tenant == "acme") && !fields.audit`:             false,
+		`!!fields.audit`: true,
+	} {
+		f, err := filter.Compile(expr)
+		require.NoError(t, err, expr)
+		assert.Equal(t, matches, f.Match(e), expr)
+		assert.Equal(t, expr, f.String())
+	}
+}
+
+func TestCompile_errors(t *testing.T) {
+	for expr, msg := range map[string]string{
+		``:                   `filter: expected a value, got end of expression at offset 0 in ""`,
+		`level >=`:           `filter: expected a value, got end of expression at offset 8 in "level >="`,
+		`level >= warn &&`:   `filter: expected a value, got end of expression at offset 16 in "level >= warn &&"`,
+		`lvl >= warn`:        `filter: unknown identifier "lvl", expected level, message, fields.<name>, fields["<name>"], a level name, true, false or null at offset 0 in "lvl >= warn"`,
+		`message == "abc`:    `filter: unterminated string at offset 11 in "message == \"abc"`,
+		"message =~ `abc":    "filter: unterminated string at offset 11 in \"message =~ `abc\"",
+		`message =~ "\d+"`:   `filter: invalid string "\d+": invalid syntax, escape backslashes or use a raw string in backquotes at offset 11 in "message =~ \"\\d+\""`,
+		`fields[1] == 1`:     `filter: expected a field name string after fields[, got "1" at offset 7 in "fields[1] == 1"`,
+		`fields["x" == 1`:    `filter: expected ] after the field name, got "==" at offset 11 in "fields[\"x\" == 1"`,
+		`message =~ abc`:     `filter: expected a regular expression string after =~, got "abc" at offset 11 in "message =~ abc"`,
+		`message =~ 1`:       `filter: expected a regular expression string after =~, got "1" at offset 11 in "message =~ 1"`,
+		`message =~ "("`:     "filter: invalid regular expression: error parsing regexp: missing closing ): `(` at offset 11 in \"message =~ \\\"(\\\"\"",
+		`(level >= warn`:     `filter: expected ) to close ( at offset 0, got end of expression at offset 14 in "(level >= warn"`,
+		`level >= warn)`:     `filter: unexpected ")" at offset 13 in "level >= warn)"`,
+		`level = warn`:       `filter: unexpected character '=' at offset 6 in "level = warn"`,
+		`fields.né == 1`:     `filter: unexpected character 'é' at offset 8 in "fields.né == 1"`,
+		`fields. == 1`:       `filter: missing field name at offset 0 in "fields. == 1"`,
+		`fields.x == 1.2.3`:  `filter: invalid number "1.2.3" at offset 12 in "fields.x == 1.2.3"`,
+		`level >= warn warn`: `filter: unexpected "warn" at offset 14 in "level >= warn warn"`,
+	} {
+		_, err := filter.Compile(expr)
+		require.Error(t, err, expr)
+		assert.IsType(t, &filter.SyntaxError{}, err)
+		assert.EqualError(t, err, msg, expr)
+	}
+
+	assert.Panics(t, func() { filter.MustCompile("(") })
+}
+
+func TestHandler(t *testing.T) {
+	mem := memory.New()
+	h, err := filter.New(mem, `level >= warn && fields.tenant == "acme"`)
+	require.NoError(t, err)
+
+	l := &log.Logger{Handler: h, Level: log.InfoLevel}
+	l.Warn("a", "tenant", "acme")
+	l.Info("b", "tenant", "acme")
+	l.Warn("c", "tenant", "other")
+	assert.Equal(t, 1, mem.Len())
+
+	// invalid expressions leave the filter unchanged
+	assert.Error(t, h.SetFilter(`level >=`))
+	assert.Equal(t, `level >= warn && fields.tenant == "acme"`, h.Filter().String())
+
+	require.NoError(t, h.SetFilter(`fields.tenant == "other"`))
+	l.Warn("d", "tenant", "other")
+	assert.Equal(t, "d", mem.Snapshot()[1].Message)
+
+	_, err = filter.New(mem, "")
+	assert.Error(t, err)
+}
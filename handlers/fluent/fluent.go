@@ -0,0 +1,261 @@
+// Package fluent implements a handler sending entries to Fluentd or Fluent
+// Bit with the Fluent Forward protocol, over TCP or a unix socket.
+//
+// Entries are sent in PackedForward mode: batches of MessagePack encoded
+// entries are sent in order by a batch.Handler once BatchSize entries are
+// pending or every FlushInterval.
+// With RequireAck, each batch is sent as a chunk the server must acknowledge,
+// and is sent again on a new connection until it is, for at-least-once
+// delivery.
+package fluent
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	stdlog "log"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/eluv-io/apexlog-go"
+	"github.com/eluv-io/apexlog-go/handlers/batch"
+)
+
+// ErrClosed is returned when logging to a closed handler.
+var ErrClosed = errors.New("fluent: handler closed")
+
+// Config for handler.
+type Config struct {
+	Network       string        // Network is "tcp" or "unix" (default: "tcp")
+	Address       string        // Address is the host:port or socket path of the server (default: "127.0.0.1:24224")
+	Tag           string        // Tag of the entries (default: the executable name)
+	BatchSize     int           // BatchSize is the number of entries to buffer before sending (default: 100)
+	FlushInterval time.Duration // FlushInterval is the max time entries are buffered (default: 1s)
+	RequireAck    bool          // RequireAck requests an ack for each batch, for at-least-once delivery
+	AckTimeout    time.Duration // AckTimeout is the time to wait for acks (default: 10s)
+	DialTimeout   time.Duration // DialTimeout is the timeout of connections (default: 10s)
+	WriteTimeout  time.Duration // WriteTimeout is the timeout of writes (default: 10s)
+	Retries       int           // Retries is the number of times a batch is sent again after a failure (default: 5)
+	RetryBackoff  time.Duration // RetryBackoff is the delay before reconnecting, doubled for each retry (default: 500ms)
+	MaxBackoff    time.Duration // MaxBackoff caps the delay before reconnecting (default: 30s)
+}
+
+// defaults applies defaults to the config.
+func (c *Config) defaults() {
+	if c.Network == "" {
+		c.Network = "tcp"
+	}
+
+	if c.Address == "" {
+		c.Address = "127.0.0.1:24224"
+	}
+
+	if c.Tag == "" && len(os.Args) > 0 {
+		c.Tag = filepath.Base(os.Args[0])
+	}
+
+	if c.BatchSize == 0 {
+		c.BatchSize = 100
+	}
+
+	if c.FlushInterval == 0 {
+		c.FlushInterval = time.Second
+	}
+
+	if c.AckTimeout == 0 {
+		c.AckTimeout = 10 * time.Second
+	}
+
+	if c.DialTimeout == 0 {
+		c.DialTimeout = 10 * time.Second
+	}
+
+	if c.WriteTimeout == 0 {
+		c.WriteTimeout = 10 * time.Second
+	}
+
+	if c.Retries == 0 {
+		c.Retries = 5
+	}
+
+	if c.RetryBackoff == 0 {
+		c.RetryBackoff = 500 * time.Millisecond
+	}
+
+	if c.MaxBackoff == 0 {
+		c.MaxBackoff = 30 * time.Second
+	}
+}
+
+// Handler implementation.
+type Handler struct {
+	*Config
+	batch *batch.Handler
+	sink  *sink
+}
+
+// New handler. The connection to the server is opened when the first batch
+// is sent.
+func New(config *Config) *Handler {
+	config.defaults()
+	s := &sink{Config: config}
+	return &Handler{
+		Config: config,
+		sink:   s,
+		batch: batch.New(s, &batch.Config{
+			BatchSize:     config.BatchSize,
+			FlushInterval: config.FlushInterval,
+			OnError: func(err error, entries []batch.Record) {
+				stdlog.Printf("log/fluent: failed to send %d logs: %s", len(entries), err)
+			},
+		}),
+	}
+}
+
+// HandleLog implements log.Handler.
+func (h *Handler) HandleLog(e *log.Entry) error {
+	err := h.batch.HandleLog(e)
+	if err == batch.ErrClosed {
+		return ErrClosed
+	}
+	return err
+}
+
+// Flush sends the pending entries and waits until all batches were sent.
+func (h *Handler) Flush() error {
+	return h.batch.Flush()
+}
+
+// Close flushes the handler and closes the connection. Entries logged
+// afterwards are rejected with ErrClosed.
+func (h *Handler) Close() error {
+	err := h.batch.Close()
+	h.sink.disconnect()
+	return err
+}
+
+// sink implements batch.BatchSink. Batches are sent by a single goroutine,
+// which owns the connection.
+type sink struct {
+	*Config
+
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// Encode implements batch.BatchSink, encoding the entry with MessagePack.
+func (s *sink) Encode(e *log.Entry) (batch.Record, error) {
+	return batch.Record{Data: appendEntry(nil, e)}, nil
+}
+
+// Send implements batch.BatchSink, sending the entries in a PackedForward
+// message.
+func (s *sink) Send(entries []batch.Record) error {
+	var b []byte
+	for _, e := range entries {
+		b = append(b, e.Data...)
+	}
+	return s.send(b, len(entries))
+}
+
+// send sends the entries in a PackedForward message, reconnecting and sending
+// again on failures.
+func (s *sink) send(entries []byte, count int) error {
+	if count == 0 {
+		return nil
+	}
+
+	chunk := ""
+	if s.RequireAck {
+		chunk = newChunkID()
+	}
+	msg := s.appendMessage(nil, entries, count, chunk)
+
+	backoff := s.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		err := s.write(msg, chunk)
+		if err == nil {
+			return nil
+		}
+		s.disconnect()
+		if attempt >= s.Retries {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > s.MaxBackoff {
+			backoff = s.MaxBackoff
+		}
+	}
+}
+
+// write writes the message and waits for the ack of the chunk, if any.
+func (s *sink) write(msg []byte, chunk string) error {
+	if s.conn == nil {
+		conn, err := net.DialTimeout(s.Network, s.Address, s.DialTimeout)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+		s.reader = bufio.NewReader(conn)
+	}
+
+	if err := s.conn.SetWriteDeadline(time.Now().Add(s.WriteTimeout)); err != nil {
+		return err
+	}
+	if _, err := s.conn.Write(msg); err != nil {
+		return err
+	}
+	if chunk == "" {
+		return nil
+	}
+
+	if err := s.conn.SetReadDeadline(time.Now().Add(s.AckTimeout)); err != nil {
+		return err
+	}
+	ack, err := readAck(s.reader)
+	if err != nil {
+		return err
+	}
+	if ack != chunk {
+		return fmt.Errorf("fluent: unexpected ack %q for chunk %q", ack, chunk)
+	}
+	return nil
+}
+
+// disconnect closes the connection, if any.
+func (s *sink) disconnect() {
+	if s.conn != nil {
+		_ = s.conn.Close()
+		s.conn = nil
+		s.reader = nil
+	}
+}
+
+// appendMessage appends a PackedForward message: the array of the tag, the
+// concatenated entries and the options.
+func (s *sink) appendMessage(dst []byte, entries []byte, count int, chunk string) []byte {
+	dst = appendArrayHeader(dst, 3)
+	dst = appendString(dst, s.Tag)
+	dst = appendBin(dst, entries)
+	if chunk == "" {
+		dst = appendMapHeader(dst, 1)
+	} else {
+		dst = appendMapHeader(dst, 2)
+		dst = appendString(dst, "chunk")
+		dst = appendString(dst, chunk)
+	}
+	dst = appendString(dst, "size")
+	return appendInt(dst, int64(count))
+}
+
+// newChunkID returns a random chunk id.
+func newChunkID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	return base64.StdEncoding.EncodeToString(b[:])
+}
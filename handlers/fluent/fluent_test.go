@@ -0,0 +1,427 @@
+package fluent_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/eluv-io/apexlog-go"
+	"github.com/eluv-io/apexlog-go/handlers/fluent"
+	"github.com/eluv-io/apexlog-go/logtest"
+)
+
+// decode decodes a MessagePack value. EventTime extensions are decoded as
+// time.Time, integers as int64 and maps as map[string]interface{}.
+func decode(r *bufio.Reader) (interface{}, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	readN := func(n int) ([]byte, error) {
+		buf := make([]byte, n)
+		_, err := io.ReadFull(r, buf)
+		return buf, err
+	}
+	readUint := func(n int) (uint64, error) {
+		buf, err := readN(n)
+		if err != nil {
+			return 0, err
+		}
+		var u uint64
+		for _, b := range buf {
+			u = u<<8 | uint64(b)
+		}
+		return u, nil
+	}
+	array := func(n int) (interface{}, error) {
+		ret := make([]interface{}, n)
+		for i := range ret {
+			if ret[i], err = decode(r); err != nil {
+				return nil, err
+			}
+		}
+		return ret, nil
+	}
+	object := func(n int) (interface{}, error) {
+		ret := make(map[string]interface{}, n)
+		for i := 0; i < n; i++ {
+			k, err := decode(r)
+			if err != nil {
+				return nil, err
+			}
+			if ret[k.(string)], err = decode(r); err != nil {
+				return nil, err
+			}
+		}
+		return ret, nil
+	}
+	str := func(n uint64, err error) (interface{}, error) {
+		if err != nil {
+			return nil, err
+		}
+		buf, err := readN(int(n))
+		return string(buf), err
+	}
+	bin := func(n uint64, err error) (interface{}, error) {
+		if err != nil {
+			return nil, err
+		}
+		return readN(int(n))
+	}
+
+	switch {
+	case b <= 0x7f:
+		return int64(b), nil
+	case b >= 0xe0:
+		return int64(int8(b)), nil
+	case b&0xf0 == 0x80:
+		return object(int(b & 0x0f))
+	case b&0xf0 == 0x90:
+		return array(int(b & 0x0f))
+	case b&0xe0 == 0xa0:
+		return str(uint64(b&0x1f), nil)
+	}
+
+	switch b {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4:
+		return bin(readUint(1))
+	case 0xc5:
+		return bin(readUint(2))
+	case 0xc6:
+		return bin(readUint(4))
+	case 0xcb:
+		u, err := readUint(8)
+		return math.Float64frombits(u), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		u, err := readUint(1 << (b - 0xcc))
+		return int64(u), err
+	case 0xd0:
+		u, err := readUint(1)
+		return int64(int8(u)), err
+	case 0xd1:
+		u, err := readUint(2)
+		return int64(int16(u)), err
+	case 0xd2:
+		u, err := readUint(4)
+		return int64(int32(u)), err
+	case 0xd3:
+		u, err := readUint(8)
+		return int64(u), err
+	case 0xd7:
+		buf, err := readN(9)
+		if err != nil {
+			return nil, err
+		}
+		if buf[0] != 0 {
+			return nil, fmt.Errorf("unexpected ext type %d", buf[0])
+		}
+		sec := binary.BigEndian.Uint32(buf[1:5])
+		nsec := binary.BigEndian.Uint32(buf[5:9])
+		return time.Unix(int64(sec), int64(nsec)).UTC(), nil
+	case 0xd9:
+		return str(readUint(1))
+	case 0xda:
+		return str(readUint(2))
+	case 0xdb:
+		return str(readUint(4))
+	case 0xdc:
+		n, err := readUint(2)
+		if err != nil {
+			return nil, err
+		}
+		return array(int(n))
+	case 0xde:
+		n, err := readUint(2)
+		if err != nil {
+			return nil, err
+		}
+		return object(int(n))
+	}
+	return nil, fmt.Errorf("unexpected type 0x%x", b)
+}
+
+// message is a decoded PackedForward message.
+type message struct {
+	tag     string
+	entries [][]interface{}
+	option  map[string]interface{}
+}
+
+func decodeMessage(r *bufio.Reader) (*message, error) {
+	v, err := decode(r)
+	if err != nil {
+		return nil, err
+	}
+	arr := v.([]interface{})
+	m := &message{
+		tag:    arr[0].(string),
+		option: arr[2].(map[string]interface{}),
+	}
+	entries := bufio.NewReader(bytes.NewReader(arr[1].([]byte)))
+	for {
+		e, err := decode(entries)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		m.entries = append(m.entries, e.([]interface{}))
+	}
+	return m, nil
+}
+
+// server is a stand-in for a forward input. For each connection, serve is
+// called with the connection index, the decoded message and the connection,
+// until it returns false.
+type server struct {
+	net.Listener
+
+	mu       sync.Mutex
+	messages []*message
+}
+
+func newServer(t *testing.T, ln net.Listener, serve func(i int, m *message, conn net.Conn) bool) *server {
+	s := &server{Listener: ln}
+	go func() {
+		for i := 0; ; i++ {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(i int, conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					m, err := decodeMessage(r)
+					if err != nil {
+						return
+					}
+					s.mu.Lock()
+					s.messages = append(s.messages, m)
+					s.mu.Unlock()
+					if !serve(i, m, conn) {
+						return
+					}
+				}
+			}(i, conn)
+		}
+	}()
+	return s
+}
+
+func (s *server) received() []*message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*message(nil), s.messages...)
+}
+
+func listenTCP(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	return ln
+}
+
+// ack writes the ack of the message.
+func ack(conn net.Conn, m *message) {
+	chunk := m.option["chunk"].(string)
+	buf := []byte{0x81, 0xa3, 'a', 'c', 'k', 0xa0 | byte(len(chunk))}
+	_, _ = conn.Write(append(buf, chunk...))
+}
+
+var ts = time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)
+
+func newLogger(h log.Handler) *log.Logger {
+	return &log.Logger{
+		Handler: h,
+		Level:   log.InfoLevel,
+		Clock:   logtest.NewClock(ts),
+	}
+}
+
+func TestHandler(t *testing.T) {
+	s := newServer(t, listenTCP(t), func(int, *message, net.Conn) bool { return true })
+	defer s.Close()
+
+	h := fluent.New(&fluent.Config{
+		Address:       s.Addr().String(),
+		Tag:           "app.api",
+		FlushInterval: time.Hour,
+	})
+	l := newLogger(h)
+
+	l.Info("hello",
+		"user", "tj",
+		"count", 3,
+		"negative", -300,
+		"ratio", 0.5,
+		"ok", true,
+		"nested", log.Fields{{Name: "id", Value: uint64(math.MaxUint64 >> 1)}},
+		"message", "collides")
+	l.Error("boom")
+	require.NoError(t, h.Close())
+
+	// without acks, the server may still be reading when Close returns
+	require.Eventually(t, func() bool { return len(s.received()) == 1 }, time.Second, time.Millisecond)
+	messages := s.received()
+	m := messages[0]
+	assert.Equal(t, "app.api", m.tag)
+	assert.Equal(t, map[string]interface{}{"size": int64(2)}, m.option)
+	require.Len(t, m.entries, 2)
+
+	assert.Equal(t, ts, m.entries[0][0])
+	assert.Equal(t, map[string]interface{}{
+		"level":          "info",
+		"message":        "hello",
+		"user":           "tj",
+		"count":          int64(3),
+		"negative":       int64(-300),
+		"ratio":          0.5,
+		"ok":             true,
+		"nested":         map[string]interface{}{"id": int64(math.MaxUint64 >> 1)},
+		"fields.message": "collides",
+	}, m.entries[0][1])
+	assert.Equal(t, map[string]interface{}{"level": "error", "message": "boom"}, m.entries[1][1])
+
+	assert.Equal(t, fluent.ErrClosed, h.HandleLog(&log.Entry{}))
+}
+
+func TestHandler_batch(t *testing.T) {
+	s := newServer(t, listenTCP(t), func(int, *message, net.Conn) bool { return true })
+	defer s.Close()
+
+	h := fluent.New(&fluent.Config{
+		Address:       s.Addr().String(),
+		BatchSize:     2,
+		FlushInterval: time.Hour,
+	})
+	l := newLogger(h)
+
+	for i := 0; i < 5; i++ {
+		l.Info("hello", "i", i)
+	}
+	require.NoError(t, h.Flush())
+
+	assert.Eventually(t, func() bool { return len(s.received()) == 3 }, time.Second, time.Millisecond)
+	var i int64
+	for _, m := range s.received() {
+		for _, e := range m.entries {
+			assert.Equal(t, i, e[1].(map[string]interface{})["i"])
+			i++
+		}
+	}
+	require.NoError(t, h.Close())
+}
+
+func TestHandler_ack(t *testing.T) {
+	s := newServer(t, listenTCP(t), func(_ int, m *message, conn net.Conn) bool {
+		ack(conn, m)
+		return true
+	})
+	defer s.Close()
+
+	h := fluent.New(&fluent.Config{
+		Address:       s.Addr().String(),
+		RequireAck:    true,
+		FlushInterval: time.Hour,
+	})
+	l := newLogger(h)
+
+	l.Info("hello")
+	require.NoError(t, h.Flush())
+	l.Info("world")
+	require.NoError(t, h.Close())
+
+	messages := s.received()
+	require.Len(t, messages, 2)
+	assert.NotEmpty(t, messages[0].option["chunk"])
+	assert.NotEqual(t, messages[0].option["chunk"], messages[1].option["chunk"])
+}
+
+func TestHandler_reconnect(t *testing.T) {
+	// the first connection is closed without ack
+	s := newServer(t, listenTCP(t), func(i int, m *message, conn net.Conn) bool {
+		if i == 0 {
+			return false
+		}
+		ack(conn, m)
+		return true
+	})
+	defer s.Close()
+
+	h := fluent.New(&fluent.Config{
+		Address:       s.Addr().String(),
+		RequireAck:    true,
+		RetryBackoff:  time.Millisecond,
+		FlushInterval: time.Hour,
+	})
+	l := newLogger(h)
+
+	l.Info("hello")
+	require.NoError(t, h.Close())
+
+	// the chunk was sent again with the same id
+	messages := s.received()
+	require.Len(t, messages, 2)
+	assert.Equal(t, messages[0].option["chunk"], messages[1].option["chunk"])
+	assert.Equal(t, messages[0].entries, messages[1].entries)
+}
+
+func TestHandler_unreachable(t *testing.T) {
+	ln := listenTCP(t)
+	addr := ln.Addr().String()
+	require.NoError(t, ln.Close())
+
+	h := fluent.New(&fluent.Config{
+		Address:       addr,
+		Retries:       2,
+		RetryBackoff:  time.Millisecond,
+		FlushInterval: time.Hour,
+	})
+
+	newLogger(h).Info("hello")
+	assert.Error(t, h.Close())
+}
+
+func TestHandler_unix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fluent")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "fluent.sock")
+	ln, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	s := newServer(t, ln, func(int, *message, net.Conn) bool { return true })
+	defer s.Close()
+
+	h := fluent.New(&fluent.Config{
+		Network:       "unix",
+		Address:       path,
+		FlushInterval: time.Hour,
+	})
+
+	newLogger(h).Info("hello")
+	require.NoError(t, h.Close())
+
+	assert.Eventually(t, func() bool { return len(s.received()) == 1 }, time.Second, time.Millisecond)
+}
@@ -0,0 +1,316 @@
+package fluent
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/eluv-io/apexlog-go"
+)
+
+// This file implements the subset of MessagePack used by the forward
+// protocol: encoding of entries and fields, and decoding of ack responses.
+
+// appendArrayHeader appends the header of an array of n elements.
+func appendArrayHeader(dst []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(dst, 0x90|byte(n))
+	case n <= math.MaxUint16:
+		return append(dst, 0xdc, byte(n>>8), byte(n))
+	}
+	return append(dst, 0xdd, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
+
+// appendMapHeader appends the header of a map of n entries.
+func appendMapHeader(dst []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(dst, 0x80|byte(n))
+	case n <= math.MaxUint16:
+		return append(dst, 0xde, byte(n>>8), byte(n))
+	}
+	return append(dst, 0xdf, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+}
+
+// appendString appends a str.
+func appendString(dst []byte, s string) []byte {
+	n := len(s)
+	switch {
+	case n < 32:
+		dst = append(dst, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		dst = append(dst, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		dst = append(dst, 0xda, byte(n>>8), byte(n))
+	default:
+		dst = append(dst, 0xdb, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(dst, s...)
+}
+
+// appendBin appends a bin.
+func appendBin(dst []byte, b []byte) []byte {
+	n := len(b)
+	switch {
+	case n <= math.MaxUint8:
+		dst = append(dst, 0xc4, byte(n))
+	case n <= math.MaxUint16:
+		dst = append(dst, 0xc5, byte(n>>8), byte(n))
+	default:
+		dst = append(dst, 0xc6, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(dst, b...)
+}
+
+// appendInt appends an int in its most compact form.
+func appendInt(dst []byte, i int64) []byte {
+	switch {
+	case i >= 0:
+		return appendUint(dst, uint64(i))
+	case i >= -32:
+		return append(dst, byte(i))
+	case i >= math.MinInt8:
+		return append(dst, 0xd0, byte(i))
+	case i >= math.MinInt16:
+		return append(dst, 0xd1, byte(i>>8), byte(i))
+	case i >= math.MinInt32:
+		return append(dst, 0xd2, byte(i>>24), byte(i>>16), byte(i>>8), byte(i))
+	}
+	dst = append(dst, 0xd3)
+	return appendUint64(dst, uint64(i))
+}
+
+// appendUint appends an uint in its most compact form.
+func appendUint(dst []byte, u uint64) []byte {
+	switch {
+	case u < 128:
+		return append(dst, byte(u))
+	case u <= math.MaxUint8:
+		return append(dst, 0xcc, byte(u))
+	case u <= math.MaxUint16:
+		return append(dst, 0xcd, byte(u>>8), byte(u))
+	case u <= math.MaxUint32:
+		return append(dst, 0xce, byte(u>>24), byte(u>>16), byte(u>>8), byte(u))
+	}
+	dst = append(dst, 0xcf)
+	return appendUint64(dst, u)
+}
+
+func appendUint64(dst []byte, u uint64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], u)
+	return append(dst, b[:]...)
+}
+
+// appendFloat appends a float64.
+func appendFloat(dst []byte, f float64) []byte {
+	dst = append(dst, 0xcb)
+	return appendUint64(dst, math.Float64bits(f))
+}
+
+// appendEventTime appends the time as a forward protocol EventTime: the
+// extension type 0 holding seconds and nanoseconds.
+func appendEventTime(dst []byte, t time.Time) []byte {
+	sec, nsec := uint32(t.Unix()), uint32(t.Nanosecond())
+	return append(dst, 0xd7, 0x00,
+		byte(sec>>24), byte(sec>>16), byte(sec>>8), byte(sec),
+		byte(nsec>>24), byte(nsec>>16), byte(nsec>>8), byte(nsec))
+}
+
+// appendValue appends a field value. Values of types without a MessagePack
+// counterpart are written as strings: times in the RFC 3339 format, other
+// values in their JSON encoding.
+func appendValue(dst []byte, v interface{}) []byte {
+	switch val := v.(type) {
+	case nil:
+		return append(dst, 0xc0)
+	case bool:
+		if val {
+			return append(dst, 0xc3)
+		}
+		return append(dst, 0xc2)
+	case string:
+		return appendString(dst, val)
+	case []byte:
+		return appendBin(dst, val)
+	case int:
+		return appendInt(dst, int64(val))
+	case int8:
+		return appendInt(dst, int64(val))
+	case int16:
+		return appendInt(dst, int64(val))
+	case int32:
+		return appendInt(dst, int64(val))
+	case int64:
+		return appendInt(dst, val)
+	case uint:
+		return appendUint(dst, uint64(val))
+	case uint8:
+		return appendUint(dst, uint64(val))
+	case uint16:
+		return appendUint(dst, uint64(val))
+	case uint32:
+		return appendUint(dst, uint64(val))
+	case uint64:
+		return appendUint(dst, val)
+	case float32:
+		return appendFloat(dst, float64(val))
+	case float64:
+		return appendFloat(dst, val)
+	case time.Duration:
+		return appendInt(dst, int64(val))
+	case time.Time:
+		return appendString(dst, val.Format(time.RFC3339Nano))
+	case error:
+		return appendString(dst, val.Error())
+	case log.Fields:
+		return appendFields(dst, val)
+	case map[string]interface{}:
+		dst = appendMapHeader(dst, len(val))
+		for k, elem := range val {
+			dst = appendString(dst, k)
+			dst = appendValue(dst, elem)
+		}
+		return dst
+	case []interface{}:
+		dst = appendArrayHeader(dst, len(val))
+		for _, elem := range val {
+			dst = appendValue(dst, elem)
+		}
+		return dst
+	case []string:
+		dst = appendArrayHeader(dst, len(val))
+		for _, elem := range val {
+			dst = appendString(dst, elem)
+		}
+		return dst
+	}
+
+	b, err := log.JSONEncoder{}.AppendValue(nil, v)
+	if err != nil {
+		return appendString(dst, fmt.Sprint(v))
+	}
+	return appendString(dst, string(b))
+}
+
+// appendFields appends the fields as a map.
+func appendFields(dst []byte, fields log.Fields) []byte {
+	dst = appendMapHeader(dst, len(fields))
+	for _, f := range fields {
+		dst = appendString(dst, f.Name)
+		dst = appendValue(dst, f.Value)
+	}
+	return dst
+}
+
+// appendEntry appends the entry as a forward protocol entry: the array of its
+// EventTime and its record. The record holds the level, the message and the
+// fields. Fields named "level" or "message" are prefixed with "fields.".
+func appendEntry(dst []byte, e *log.Entry) []byte {
+	dst = appendArrayHeader(dst, 2)
+	dst = appendEventTime(dst, e.Timestamp)
+	dst = appendMapHeader(dst, 2+len(e.Fields))
+	dst = appendString(dst, "level")
+	dst = appendString(dst, e.Level.String())
+	dst = appendString(dst, "message")
+	dst = appendString(dst, e.Message)
+	for _, f := range e.Fields {
+		switch f.Name {
+		case "level", "message":
+			dst = appendString(dst, "fields."+f.Name)
+		default:
+			dst = appendString(dst, f.Name)
+		}
+		dst = appendValue(dst, f.Value)
+	}
+	return dst
+}
+
+// errMalformed is returned for unexpected responses.
+var errMalformed = errors.New("fluent: malformed response")
+
+// readAck reads an ack response - a map {"ack": <chunk id>} - and returns the
+// chunk id.
+func readAck(r *bufio.Reader) (string, error) {
+	n, err := readMapHeader(r)
+	if err != nil {
+		return "", err
+	}
+	ack := ""
+	for i := 0; i < n; i++ {
+		key, err := readString(r)
+		if err != nil {
+			return "", err
+		}
+		value, err := readString(r)
+		if err != nil {
+			return "", err
+		}
+		if key == "ack" {
+			ack = value
+		}
+	}
+	return ack, nil
+}
+
+func readMapHeader(r *bufio.Reader) (int, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case b&0xf0 == 0x80:
+		return int(b & 0x0f), nil
+	case b == 0xde:
+		return readSize(r, 2)
+	case b == 0xdf:
+		return readSize(r, 4)
+	}
+	return 0, errMalformed
+}
+
+func readString(r *bufio.Reader) (string, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	var n int
+	switch {
+	case b&0xe0 == 0xa0:
+		n = int(b & 0x1f)
+	case b == 0xd9:
+		n, err = readSize(r, 1)
+	case b == 0xda:
+		n, err = readSize(r, 2)
+	case b == 0xdb:
+		n, err = readSize(r, 4)
+	default:
+		return "", errMalformed
+	}
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// readSize reads a big endian size of the given number of bytes.
+func readSize(r *bufio.Reader, size int) (int, error) {
+	var buf [4]byte
+	if _, err := io.ReadFull(r, buf[:size]); err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, b := range buf[:size] {
+		n = n<<8 | int(b)
+	}
+	return n, nil
+}
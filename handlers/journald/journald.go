@@ -0,0 +1,242 @@
+// Package journald implements a handler writing entries to the systemd
+// journal using its native protocol, so that fields are stored as journal
+// fields and shown by `journalctl -o verbose`.
+//
+// The level is written as PRIORITY, the message as MESSAGE and fields as
+// upper-cased journal fields: "user_id" becomes USER_ID. The location of the
+// logging call is written as CODE_FILE, CODE_LINE and CODE_FUNC if the
+// handler is called on the goroutine of the logging call: it is omitted behind
+// handlers passing entries to other goroutines, such as async. Entries too
+// large for a datagram are passed to journald in a sealed memfd.
+package journald
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/eluv-io/apexlog-go"
+)
+
+// ErrClosed is returned when logging to a closed handler.
+var ErrClosed = errors.New("journald: handler closed")
+
+// DefaultSocket is the path of the journal socket.
+const DefaultSocket = "/run/systemd/journal/socket"
+
+// reserved are the journal fields written by the handler. Entry fields with
+// these names are prefixed with "FIELD_".
+var reserved = map[string]bool{
+	"MESSAGE":           true,
+	"PRIORITY":          true,
+	"CODE_FILE":         true,
+	"CODE_LINE":         true,
+	"CODE_FUNC":         true,
+	"SYSLOG_IDENTIFIER": true,
+}
+
+// Config for handler.
+type Config struct {
+	Socket     string // Socket is the path of the journal socket (default: DefaultSocket)
+	Identifier string // Identifier is the SYSLOG_IDENTIFIER field (default: the executable name)
+}
+
+// defaults applies defaults to the config.
+func (c *Config) defaults() {
+	if c.Socket == "" {
+		c.Socket = DefaultSocket
+	}
+
+	if c.Identifier == "" && len(os.Args) > 0 {
+		c.Identifier = filepath.Base(os.Args[0])
+	}
+}
+
+// Handler implementation.
+type Handler struct {
+	*Config
+
+	mu     sync.Mutex
+	conn   *net.UnixConn
+	closed bool
+}
+
+// New handler. It returns an error if the journal socket can't be reached.
+func New(config *Config) (*Handler, error) {
+	config.defaults()
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: config.Socket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &Handler{
+		Config: config,
+		conn:   conn,
+	}, nil
+}
+
+// Priority returns the journal priority of the given level.
+func Priority(level log.Level) int {
+	switch level {
+	case log.TraceLevel, log.DebugLevel:
+		return 7
+	case log.InfoLevel:
+		return 6
+	case log.WarnLevel:
+		return 4
+	case log.ErrorLevel:
+		return 3
+	case log.FatalLevel:
+		return 2
+	}
+	return 5
+}
+
+// HandleLog implements log.Handler.
+func (h *Handler) HandleLog(e *log.Entry) error {
+	var buf bytes.Buffer
+	appendField(&buf, "MESSAGE", e.Message)
+	appendField(&buf, "PRIORITY", strconv.Itoa(Priority(e.Level)))
+	if h.Identifier != "" {
+		appendField(&buf, "SYSLOG_IDENTIFIER", h.Identifier)
+	}
+	if frame, ok := caller(); ok {
+		appendField(&buf, "CODE_FILE", frame.File)
+		appendField(&buf, "CODE_LINE", strconv.Itoa(frame.Line))
+		appendField(&buf, "CODE_FUNC", frame.Function)
+	}
+	for _, f := range e.Fields {
+		name := fieldName(f.Name)
+		if name == "" {
+			continue
+		}
+		appendField(&buf, name, fmt.Sprint(f.Value))
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return ErrClosed
+	}
+	_, err := h.conn.Write(buf.Bytes())
+	if err != nil && tooLarge(err) {
+		err = sendMemfd(h.conn, buf.Bytes())
+	}
+	return err
+}
+
+// Close closes the connection to the journal. Entries logged afterwards are
+// rejected with ErrClosed.
+func (h *Handler) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return nil
+	}
+	h.closed = true
+	return h.conn.Close()
+}
+
+// tooLarge returns true if the error is returned when writing a datagram too
+// large for the socket.
+func tooLarge(err error) bool {
+	return errors.Is(err, syscall.EMSGSIZE) || errors.Is(err, syscall.ENOBUFS)
+}
+
+// appendField appends a field in the native protocol format: "NAME=value\n",
+// or the name, the little endian 64 bits length and the value for values
+// holding newlines.
+func appendField(buf *bytes.Buffer, name, value string) {
+	buf.WriteString(name)
+	if strings.IndexByte(value, '\n') < 0 {
+		buf.WriteByte('=')
+		buf.WriteString(value)
+		buf.WriteByte('\n')
+		return
+	}
+	buf.WriteByte('\n')
+	var size [8]byte
+	binary.LittleEndian.PutUint64(size[:], uint64(len(value)))
+	buf.Write(size[:])
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
+
+// fieldName returns the journal field name for the given entry field name:
+// upper-cased, with characters other than A-Z, 0-9 and '_' replaced with '_',
+// without leading underscores - reserved to trusted fields - and at most 64
+// characters long. It returns an empty string if no valid name remains.
+func fieldName(name string) string {
+	b := make([]byte, 0, len(name))
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case c >= 'a' && c <= 'z':
+			c -= 'a' - 'A'
+		case c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		default:
+			c = '_'
+		}
+		if c == '_' && len(b) == 0 {
+			continue
+		}
+		b = append(b, c)
+	}
+	if len(b) == 0 {
+		return ""
+	}
+	ret := string(b)
+	if (ret[0] >= '0' && ret[0] <= '9') || reserved[ret] {
+		ret = "FIELD_" + ret
+	}
+	if len(ret) > 64 {
+		ret = ret[:64]
+	}
+	return ret
+}
+
+// module is the path of this module, whose frames are skipped by caller.
+const module = "github.com/eluv-io/apexlog-go"
+
+// caller returns the frame of the logging call: the first frame outside of
+// the log package and its handlers. It returns false if there is none, e.g. on
+// a goroutine started by a handler, whose stack ends in the runtime.
+func caller() (runtime.Frame, bool) {
+	pcs := make([]uintptr, 32)
+	n := runtime.Callers(3, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+	for {
+		frame, more := frames.Next()
+		if !internal(frame.Function) {
+			return frame, frame.Function != "" && !strings.HasPrefix(frame.Function, "runtime.")
+		}
+		if !more {
+			return runtime.Frame{}, false
+		}
+	}
+}
+
+// internal returns true if the function belongs to the log package or one of
+// its handlers.
+func internal(function string) bool {
+	slash := strings.LastIndex(function, "/")
+	dot := strings.Index(function[slash+1:], ".")
+	if dot < 0 {
+		return false
+	}
+	pkg := function[:slash+1+dot]
+	if pkg == module {
+		return true
+	}
+	return strings.HasPrefix(pkg, module+"/handlers/") && !strings.HasSuffix(pkg, "_test")
+}
@@ -0,0 +1,153 @@
+//go:build linux
+// +build linux
+
+package journald_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/eluv-io/apexlog-go"
+	"github.com/eluv-io/apexlog-go/handlers/async"
+	"github.com/eluv-io/apexlog-go/handlers/journald"
+)
+
+// listen returns a stand-in for the journal socket.
+func listen(t *testing.T) (*net.UnixConn, string, func()) {
+	dir, err := ioutil.TempDir("", "journald")
+	require.NoError(t, err)
+
+	path := filepath.Join(dir, "socket")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	require.NoError(t, err)
+
+	return conn, path, func() {
+		_ = conn.Close()
+		_ = os.RemoveAll(dir)
+	}
+}
+
+// receive reads a datagram and decodes its fields. Payloads passed in a memfd
+// are read from the file descriptor.
+func receive(t *testing.T, conn *net.UnixConn) map[string]string {
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+
+	buf := make([]byte, 1<<20)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	n, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+	require.NoError(t, err)
+	payload := buf[:n]
+
+	if oobn > 0 {
+		msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+		require.NoError(t, err)
+		require.Len(t, msgs, 1)
+		fds, err := syscall.ParseUnixRights(&msgs[0])
+		require.NoError(t, err)
+		require.Len(t, fds, 1)
+
+		// journald maps the memfd: read it from the start rather than from
+		// the offset shared with the writer
+		f := os.NewFile(uintptr(fds[0]), "memfd")
+		defer f.Close()
+		_, err = f.Seek(0, io.SeekStart)
+		require.NoError(t, err)
+		payload, err = ioutil.ReadAll(f)
+		require.NoError(t, err)
+	}
+
+	fields := make(map[string]string)
+	for len(payload) > 0 {
+		nl := bytes.IndexByte(payload, '\n')
+		require.True(t, nl >= 0)
+		line := string(payload[:nl])
+		if eq := strings.IndexByte(line, '='); eq >= 0 {
+			fields[line[:eq]] = line[eq+1:]
+			payload = payload[nl+1:]
+			continue
+		}
+		size := binary.LittleEndian.Uint64(payload[nl+1:])
+		value := payload[nl+9 : nl+9+int(size)]
+		fields[line] = string(value)
+		payload = payload[nl+9+int(size)+1:]
+	}
+	return fields
+}
+
+func TestHandler(t *testing.T) {
+	conn, path, done := listen(t)
+	defer done()
+
+	h, err := journald.New(&journald.Config{Socket: path, Identifier: "api"})
+	require.NoError(t, err)
+	defer h.Close()
+	l := &log.Logger{Handler: h, Level: log.DebugLevel}
+
+	l.Warn("careful", "user_id", 42, "multi", "line1\nline2", "message", "collides", "_trusted", "no", "1st", "x")
+
+	fields := receive(t, conn)
+	assert.Equal(t, "careful", fields["MESSAGE"])
+	assert.Equal(t, "4", fields["PRIORITY"])
+	assert.Equal(t, "api", fields["SYSLOG_IDENTIFIER"])
+	assert.Equal(t, "42", fields["USER_ID"])
+	assert.Equal(t, "line1\nline2", fields["MULTI"])
+	assert.Equal(t, "collides", fields["FIELD_MESSAGE"])
+	assert.Equal(t, "no", fields["TRUSTED"])
+	assert.Equal(t, "x", fields["FIELD_1ST"])
+	assert.True(t, strings.HasSuffix(fields["CODE_FILE"], "journald_test.go"), fields["CODE_FILE"])
+	assert.NotEmpty(t, fields["CODE_LINE"])
+	assert.Equal(t, "github.com/eluv-io/apexlog-go/handlers/journald_test.TestHandler", fields["CODE_FUNC"])
+
+	require.NoError(t, h.Close())
+	assert.Equal(t, journald.ErrClosed, h.HandleLog(&log.Entry{Message: "closed"}))
+	require.NoError(t, h.Close())
+}
+
+func TestHandler_async(t *testing.T) {
+	conn, path, done := listen(t)
+	defer done()
+
+	h, err := journald.New(&journald.Config{Socket: path})
+	require.NoError(t, err)
+	defer h.Close()
+	a := async.New(h, nil)
+	l := &log.Logger{Handler: a, Level: log.DebugLevel}
+
+	// the caller isn't known on the goroutine of the async handler
+	l.Info("hello")
+	fields := receive(t, conn)
+	assert.Equal(t, "hello", fields["MESSAGE"])
+	assert.NotContains(t, fields, "CODE_FILE")
+	assert.NotContains(t, fields, "CODE_FUNC")
+	require.NoError(t, a.Close(context.Background()))
+}
+
+func TestHandler_memfd(t *testing.T) {
+	conn, path, done := listen(t)
+	defer done()
+
+	h, err := journald.New(&journald.Config{Socket: path})
+	require.NoError(t, err)
+	defer h.Close()
+	l := &log.Logger{Handler: h, Level: log.DebugLevel}
+
+	large := strings.Repeat("x", 4<<20)
+	l.Info("large", "data", large)
+
+	fields := receive(t, conn)
+	assert.Equal(t, "large", fields["MESSAGE"])
+	assert.Equal(t, large, fields["DATA"])
+}
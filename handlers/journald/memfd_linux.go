@@ -0,0 +1,41 @@
+package journald
+
+import (
+	"net"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// sendMemfd writes the payload to a sealed memfd and passes its descriptor to
+// journald, which is how large entries are sent.
+func sendMemfd(conn *net.UnixConn, payload []byte) error {
+	fd, err := unix.MemfdCreate("journald", unix.MFD_ALLOW_SEALING|unix.MFD_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	f := os.NewFile(uintptr(fd), "journald")
+	defer f.Close()
+
+	if _, err := f.Write(payload); err != nil {
+		return err
+	}
+	_, err = unix.FcntlInt(uintptr(fd), unix.F_ADD_SEALS, unix.F_SEAL_SHRINK|unix.F_SEAL_GROW|unix.F_SEAL_WRITE|unix.F_SEAL_SEAL)
+	if err != nil {
+		return err
+	}
+
+	// WriteMsgUnix refuses connected datagram sockets: use the socket directly
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	werr := raw.Write(func(s uintptr) bool {
+		err = unix.Sendmsg(int(s), nil, unix.UnixRights(fd), nil, 0)
+		return err != unix.EAGAIN
+	})
+	if werr != nil {
+		return werr
+	}
+	return err
+}
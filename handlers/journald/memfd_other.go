@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package journald
+
+import (
+	"errors"
+	"net"
+)
+
+// sendMemfd is only supported on linux.
+func sendMemfd(conn *net.UnixConn, payload []byte) error {
+	return errors.New("journald: entry too large")
+}
@@ -5,7 +5,10 @@ import (
 	j "encoding/json"
 	"io"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/eluv-io/apexlog-go"
 )
@@ -13,29 +16,229 @@ import (
 // Default handler outputting to stderr.
 var Default = New(os.Stderr)
 
+// TimeEpochMillis is a Config.TimeFormat writing timestamps as the number of
+// milliseconds elapsed since the Unix epoch.
+const TimeEpochMillis = "epoch_millis"
+
+// LevelFormat defines how levels are written.
+type LevelFormat int
+
+// Level formats.
+const (
+	LevelLower  LevelFormat = iota // LevelLower writes levels as lower case strings: "info"
+	LevelUpper                     // LevelUpper writes levels as upper case strings: "INFO"
+	LevelNumber                    // LevelNumber writes levels as numbers: 2
+)
+
+// Config configures the JSON schema of the handler output. The zero value
+// writes entries as tagged in log.Entry:
+//
+//	{"fields":{"user":"tj"},"level":"info","timestamp":"1970-01-01T00:00:00Z","message":"hello"}
+//
+// Keys are written in the order fields, level, timestamp, message followed by
+// the static keys. When fields are flattened, they are written in place of the
+// fields object and a field with the same name as a top-level key is written
+// with the fields key as prefix: "fields.message".
+type Config struct {
+	FieldsKey    string      // FieldsKey is the key of the fields object (default: "fields")
+	LevelKey     string      // LevelKey is the key of the level (default: "level")
+	TimestampKey string      // TimestampKey is the key of the timestamp (default: "timestamp")
+	MessageKey   string      // MessageKey is the key of the message (default: "message")
+	Flatten      bool        // Flatten writes fields as top-level keys rather than in the fields object
+	TimeFormat   string      // TimeFormat is a time layout or TimeEpochMillis (default: time.RFC3339Nano)
+	UTC          bool        // UTC converts timestamps to UTC
+	LevelFormat  LevelFormat // LevelFormat defines how levels are written (default: LevelLower)
+	Static       log.Fields  // Static are top-level keys added to all entries
+	EscapeHTML   bool        // EscapeHTML escapes HTML characters in strings
+}
+
+// defaults applies defaults to the config.
+func (c *Config) defaults() {
+	if c.FieldsKey == "" {
+		c.FieldsKey = "fields"
+	}
+
+	if c.LevelKey == "" {
+		c.LevelKey = "level"
+	}
+
+	if c.TimestampKey == "" {
+		c.TimestampKey = "timestamp"
+	}
+
+	if c.MessageKey == "" {
+		c.MessageKey = "message"
+	}
+
+	if c.TimeFormat == "" {
+		c.TimeFormat = time.RFC3339Nano
+	}
+}
+
+// reserved returns true if name is a top-level key.
+func (c *Config) reserved(name string) bool {
+	switch name {
+	case c.LevelKey, c.TimestampKey, c.MessageKey:
+		return true
+	}
+	for _, f := range c.Static {
+		if f.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Encoder encodes entries with the JSON schema defined by a config. It
+// implements log.Encoder.
+type Encoder struct {
+	config *Config
+	json   log.JSONEncoder
+}
+
+// NewEncoder returns a new encoder for the given config.
+func NewEncoder(config *Config) *Encoder {
+	config.defaults()
+	return &Encoder{
+		config: config,
+		json:   log.JSONEncoder{EscapeHTML: config.EscapeHTML},
+	}
+}
+
+// AppendEntry implements log.Encoder.
+func (enc *Encoder) AppendEntry(dst []byte, e *log.Entry) ([]byte, error) {
+	c := enc.config
+	js := enc.json
+
+	var err error
+	dst = append(dst, '{')
+
+	if c.Flatten {
+		for i, f := range e.Fields {
+			if i > 0 {
+				dst = append(dst, ',')
+			}
+			if c.reserved(f.Name) {
+				dst = js.AppendKey(dst, c.FieldsKey+"."+f.Name)
+			} else {
+				dst = js.AppendKey(dst, f.Name)
+			}
+			if dst, err = js.AppendValue(dst, f.Value); err != nil {
+				return dst, err
+			}
+		}
+		if len(e.Fields) > 0 {
+			dst = append(dst, ',')
+		}
+	} else {
+		dst = js.AppendKey(dst, c.FieldsKey)
+		if dst, err = js.AppendFields(dst, e.Fields); err != nil {
+			return dst, err
+		}
+		dst = append(dst, ',')
+	}
+
+	dst = js.AppendKey(dst, c.LevelKey)
+	switch c.LevelFormat {
+	case LevelUpper:
+		dst = js.AppendString(dst, strings.ToUpper(e.Level.String()))
+	case LevelNumber:
+		dst = strconv.AppendInt(dst, int64(e.Level), 10)
+	default:
+		dst = js.AppendString(dst, e.Level.String())
+	}
+
+	dst = append(dst, ',')
+	dst = js.AppendKey(dst, c.TimestampKey)
+	ts := e.Timestamp
+	if c.UTC {
+		ts = ts.UTC()
+	}
+	switch c.TimeFormat {
+	case TimeEpochMillis:
+		dst = strconv.AppendInt(dst, ts.UnixNano()/int64(time.Millisecond), 10)
+	case time.RFC3339Nano:
+		dst = js.AppendTime(dst, ts)
+	default:
+		dst = js.AppendString(dst, ts.Format(c.TimeFormat))
+	}
+
+	dst = append(dst, ',')
+	dst = js.AppendKey(dst, c.MessageKey)
+	dst = js.AppendString(dst, e.Message)
+
+	for _, f := range c.Static {
+		dst = append(dst, ',')
+		dst = js.AppendKey(dst, f.Name)
+		if dst, err = js.AppendValue(dst, f.Value); err != nil {
+			return dst, err
+		}
+	}
+
+	return append(dst, '}'), nil
+}
+
 // Handler implementation.
 type Handler struct {
+	// Encoder is an encoding/json encoder writing to the writer of the
+	// handler, kept for compatibility with callers encoding other values on
+	// the same writer.
+	//
+	// Deprecated: entries are encoded by the handler's log.Encoder, settings
+	// such as SetEscapeHTML and SetIndent don't apply to them. Use
+	// NewWithConfig to configure the output of entries.
 	*j.Encoder
-	mu sync.Mutex
+
+	mu      sync.Mutex
+	w       io.Writer
+	encoder log.Encoder
 }
 
-// New returns a new handler. By default, the json encoder used by the handler
-// has SetEscapeHTML(false). The first escapeHtml optional params can be used
+// New returns a new handler. By default, the handler does not escape HTML
+// characters in strings. The first escapeHtml optional params can be used
 // to change this behavior.
 func New(w io.Writer, escapeHtml ...bool) *Handler {
+	config := &Config{}
+	if len(escapeHtml) > 0 {
+		config.EscapeHTML = escapeHtml[0]
+	}
+	return NewWithConfig(w, config)
+}
+
+// NewWithConfig returns a new handler writing entries with the JSON schema
+// defined by the given config.
+func NewWithConfig(w io.Writer, config *Config) *Handler {
+	ret := NewWithEncoder(w, NewEncoder(config))
+	ret.Encoder.SetEscapeHTML(config.EscapeHTML)
+	return ret
+}
+
+// NewWithEncoder returns a new handler writing entries encoded by the given
+// encoder, one per line.
+func NewWithEncoder(w io.Writer, encoder log.Encoder) *Handler {
 	ret := &Handler{
 		Encoder: j.NewEncoder(w),
+		w:       w,
+		encoder: encoder,
 	}
 	ret.Encoder.SetEscapeHTML(false)
-	if len(escapeHtml) > 0 {
-		ret.Encoder.SetEscapeHTML(escapeHtml[0])
-	}
 	return ret
 }
 
 // HandleLog implements log.Handler.
 func (h *Handler) HandleLog(e *log.Entry) error {
+	buf := log.GetBuffer()
+	defer buf.Release()
+
+	var err error
+	buf.B, err = h.encoder.AppendEntry(buf.B, e)
+	if err != nil {
+		return err
+	}
+	buf.B = append(buf.B, '\n')
+
 	h.mu.Lock()
 	defer h.mu.Unlock()
-	return h.Encoder.Encode(e)
+	_, err = h.w.Write(buf.B)
+	return err
 }
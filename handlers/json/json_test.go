@@ -9,6 +9,7 @@ import (
 	"github.com/stretchr/testify/assert"
 
 	"github.com/eluv-io/apexlog-go/handlers/json"
+	"github.com/eluv-io/apexlog-go/logtest"
 )
 
 func init() {
@@ -32,3 +33,55 @@ func Test(t *testing.T) {
 
 	assert.Equal(t, expected, buf.String())
 }
+
+func TestHandler_Encoder(t *testing.T) {
+	var buf bytes.Buffer
+
+	h := json.New(&buf)
+	assert.NoError(t, h.Encode(map[string]string{"html": "<b>"}))
+	assert.Equal(t, `{"html":"<b>"}`+"\n", buf.String())
+}
+
+func TestConfig(t *testing.T) {
+	var buf bytes.Buffer
+
+	l := &log.Logger{
+		Handler: json.NewWithConfig(&buf, &json.Config{
+			LevelKey:     "lvl",
+			TimestampKey: "ts",
+			MessageKey:   "msg",
+			Flatten:      true,
+			TimeFormat:   json.TimeEpochMillis,
+			LevelFormat:  json.LevelUpper,
+			Static:       log.Fields{{Name: "service", Value: "api"}},
+		}),
+		Level: log.InfoLevel,
+		Clock: logtest.NewClock(time.Unix(1, 500000000)),
+	}
+	l.WithField("user", "tj").Info("hello <world>", "msg", "clash")
+
+	expected := `{"user":"tj","fields.msg":"clash","lvl":"INFO","ts":1500,"msg":"hello <world>","service":"api"}
+`
+	assert.Equal(t, expected, buf.String())
+}
+
+func TestConfig_time(t *testing.T) {
+	var buf bytes.Buffer
+
+	l := &log.Logger{
+		Handler: json.NewWithConfig(&buf, &json.Config{
+			FieldsKey:   "data",
+			TimeFormat:  time.RFC3339,
+			UTC:         true,
+			LevelFormat: json.LevelNumber,
+			EscapeHTML:  true,
+		}),
+		Level: log.InfoLevel,
+		Clock: logtest.NewClock(time.Date(2020, 1, 2, 3, 4, 5, 6, time.FixedZone("CET", 3600))),
+	}
+	l.Warn("a <b>", "id", 1)
+
+	expected := `{"data":{"id":1},"level":3,"timestamp":"2020-01-02T02:04:05Z","message":"a \u003cb\u003e"}
+`
+	assert.Equal(t, expected, buf.String())
+}
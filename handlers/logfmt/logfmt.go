@@ -2,6 +2,7 @@
 package logfmt
 
 import (
+	"bytes"
 	"io"
 	"os"
 	"sync"
@@ -43,3 +44,28 @@ func (h *Handler) HandleLog(e *log.Entry) error {
 
 	return nil
 }
+
+// Encoder encodes entries in the logfmt format written by the handler,
+// without the trailing newline. It implements log.Encoder.
+type Encoder struct{}
+
+// NewEncoder returns a new encoder.
+func NewEncoder() *Encoder {
+	return &Encoder{}
+}
+
+// AppendEntry implements log.Encoder.
+func (enc *Encoder) AppendEntry(dst []byte, e *log.Entry) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	le := logfmt.NewEncoder(buf)
+
+	_ = le.EncodeKeyval("timestamp", e.Timestamp)
+	_ = le.EncodeKeyval("level", e.Level.String())
+	_ = le.EncodeKeyval("message", e.Message)
+
+	for _, field := range e.Fields {
+		_ = le.EncodeKeyval(field.Name, field.Value)
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,344 @@
+// Package loki implements a handler pushing batches of entries to the Loki
+// push API.
+//
+// A configurable subset of the fields - and optionally the level - become
+// stream labels, the other fields are encoded in the log line. Batches are
+// pushed in order by a batch.Handler once BatchSize entries or BatchBytes
+// bytes are pending, or every FlushInterval.
+package loki
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	stdlog "log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eluv-io/apexlog-go"
+	"github.com/eluv-io/apexlog-go/handlers/batch"
+	"github.com/eluv-io/apexlog-go/handlers/logfmt"
+)
+
+// ErrClosed is returned when logging to a closed handler.
+var ErrClosed = errors.New("loki: handler closed")
+
+// LevelLabel is the name of the label holding the level, if listed in
+// Config.Labels.
+const LevelLabel = "level"
+
+// Config for handler.
+type Config struct {
+	URL            string            // URL is the push API URL (default: "http://localhost:3100/loki/api/v1/push")
+	Client         *http.Client      // Client is the HTTP client (default: client with a 10s timeout)
+	Username       string            // Username for basic auth
+	Password       string            // Password for basic auth
+	TenantID       string            // TenantID is sent in the X-Scope-OrgID header of multi-tenant setups
+	StaticLabels   map[string]string // StaticLabels are added to all streams, Loki requires at least one label per stream (default: {"job": <executable name>})
+	Labels         []string          // Labels are the fields used as stream labels, LevelLabel stands for the level
+	MaxLabelValues int               // MaxLabelValues caps the distinct values of each label, further values are kept in the line (default: 100)
+	Encoder        log.Encoder       // Encoder encodes log lines (default: logfmt)
+	BatchSize      int               // BatchSize is the number of entries to buffer before pushing (default: 1000)
+	BatchBytes     int               // BatchBytes is the max size of the encoded lines of a push (default: 1MiB)
+	FlushInterval  time.Duration     // FlushInterval is the max time entries are buffered (default: 1s)
+	Retries        int               // Retries is the number of retries of pushes failing with 429 or 5xx (default: 5)
+	RetryBackoff   time.Duration     // RetryBackoff is the delay before the first retry, doubled for each retry (default: 500ms)
+}
+
+// defaults applies defaults to the config.
+func (c *Config) defaults() {
+	if c.URL == "" {
+		c.URL = "http://localhost:3100/loki/api/v1/push"
+	}
+
+	if c.Client == nil {
+		c.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	if len(c.StaticLabels) == 0 {
+		c.StaticLabels = map[string]string{"job": filepath.Base(os.Args[0])}
+	}
+
+	if c.MaxLabelValues == 0 {
+		c.MaxLabelValues = 100
+	}
+
+	if c.Encoder == nil {
+		c.Encoder = logfmt.NewEncoder()
+	}
+
+	if c.BatchSize == 0 {
+		c.BatchSize = 1000
+	}
+
+	if c.BatchBytes == 0 {
+		c.BatchBytes = 1 << 20
+	}
+
+	if c.FlushInterval == 0 {
+		c.FlushInterval = time.Second
+	}
+
+	if c.Retries == 0 {
+		c.Retries = 5
+	}
+
+	if c.RetryBackoff == 0 {
+		c.RetryBackoff = 500 * time.Millisecond
+	}
+}
+
+// Handler implementation.
+type Handler struct {
+	*Config
+	batch *batch.Handler
+}
+
+// New handler.
+func New(config *Config) *Handler {
+	config.defaults()
+	s := &sink{
+		Config: config,
+		labels: make(map[string]bool, len(config.Labels)),
+		values: make(map[string]map[string]bool, len(config.Labels)),
+	}
+	for _, name := range config.Labels {
+		s.labels[name] = true
+		s.values[name] = make(map[string]bool)
+	}
+
+	return &Handler{
+		Config: config,
+		batch: batch.New(s, &batch.Config{
+			BatchSize:     config.BatchSize,
+			BatchBytes:    config.BatchBytes,
+			FlushInterval: config.FlushInterval,
+			OnError: func(err error, lines []batch.Record) {
+				stdlog.Printf("log/loki: failed to push %d logs: %s", len(lines), err)
+			},
+		}),
+	}
+}
+
+// HandleLog implements log.Handler.
+func (h *Handler) HandleLog(e *log.Entry) error {
+	err := h.batch.HandleLog(e)
+	if err == batch.ErrClosed {
+		return ErrClosed
+	}
+	return err
+}
+
+// Flush pushes the pending entries and waits until all batches were pushed.
+func (h *Handler) Flush() error {
+	return h.batch.Flush()
+}
+
+// Close flushes the handler. Entries logged afterwards are rejected with
+// ErrClosed.
+func (h *Handler) Close() error {
+	return h.batch.Close()
+}
+
+// sink implements batch.BatchSink, keying lines by stream.
+type sink struct {
+	*Config
+
+	labels map[string]bool // labels are the label fields
+
+	mu     sync.Mutex
+	values map[string]map[string]bool // values are the label values seen so far
+}
+
+// Encode implements batch.BatchSink. The key of the record is the JSON object
+// of the stream labels, its data the JSON array of the timestamp and the line.
+func (s *sink) Encode(e *log.Entry) (batch.Record, error) {
+	labels, fields := s.split(e)
+	line, err := s.Encoder.AppendEntry(nil, &log.Entry{
+		Logger:    e.Logger,
+		Fields:    fields,
+		Level:     e.Level,
+		Timestamp: e.Timestamp,
+		Message:   e.Message,
+	})
+	if err != nil {
+		return batch.Record{}, err
+	}
+
+	var js log.JSONEncoder
+	value := append(make([]byte, 0, len(line)+32), `["`...)
+	value = strconv.AppendInt(value, e.Timestamp.UnixNano(), 10)
+	value = append(value, `",`...)
+	value = js.AppendString(value, string(line))
+	value = append(value, ']')
+	return batch.Record{Key: string(appendLabels(nil, labels)), Data: value}, nil
+}
+
+// split returns the stream labels of the entry and the fields to encode in
+// the line.
+func (s *sink) split(e *log.Entry) (labels map[string]string, fields log.Fields) {
+	labels = make(map[string]string, len(s.StaticLabels)+len(s.Labels))
+	for k, v := range s.StaticLabels {
+		labels[k] = v
+	}
+	if s.labels[LevelLabel] {
+		labels[LevelLabel] = e.Level.String()
+	}
+
+	fields = make(log.Fields, 0, len(e.Fields))
+	for _, f := range e.Fields {
+		if s.labels[f.Name] && f.Name != LevelLabel {
+			value := fmt.Sprint(f.Value)
+			if s.allow(f.Name, value) {
+				labels[f.Name] = value
+				continue
+			}
+		}
+		fields = append(fields, f)
+	}
+	return labels, fields
+}
+
+// allow returns true if the value can be used for the label without exceeding
+// MaxLabelValues.
+func (s *sink) allow(label, value string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seen := s.values[label]
+	if seen[value] {
+		return true
+	}
+	if len(seen) >= s.MaxLabelValues {
+		return false
+	}
+	seen[value] = true
+	return true
+}
+
+// Send implements batch.BatchSink, pushing the batch and retrying on
+// failures.
+func (s *sink) Send(lines []batch.Record) error {
+	body := appendBody(nil, lines)
+	backoff := s.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		retry, err := s.post(body)
+		if err == nil || !retry || attempt >= s.Retries {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// post posts the body to the push API. It returns whether the request should
+// be retried if it failed.
+func (s *sink) post(body []byte) (retry bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if s.Username != "" || s.Password != "" {
+		req.SetBasicAuth(s.Username, s.Password)
+	}
+	if s.TenantID != "" {
+		req.Header.Set("X-Scope-OrgID", s.TenantID)
+	}
+
+	res, err := s.Client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer res.Body.Close()
+	msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return false, nil
+	}
+
+	err = fmt.Errorf("loki: %s responded with %s: %s", s.URL, res.Status, strings.TrimSpace(string(msg)))
+	return res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500, err
+}
+
+// appendLabels appends the labels as a JSON object with sorted keys, which
+// identifies their stream.
+func appendLabels(dst []byte, labels map[string]string) []byte {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var js log.JSONEncoder
+	dst = append(dst, '{')
+	for i, name := range names {
+		if i > 0 {
+			dst = append(dst, ',')
+		}
+		dst = js.AppendKey(dst, name)
+		dst = js.AppendString(dst, labels[name])
+	}
+	return append(dst, '}')
+}
+
+// stream holds the values of a stream.
+type stream struct {
+	labels string
+	values [][]byte
+}
+
+// appendBody appends the push request body of the lines, grouped by stream in
+// the order streams appear. The values of each stream are sorted by
+// timestamp, since Loki rejects out of order entries.
+func appendBody(dst []byte, lines []batch.Record) []byte {
+	streams := make(map[string]*stream)
+	var order []*stream
+	for _, l := range lines {
+		st, ok := streams[l.Key]
+		if !ok {
+			st = &stream{labels: l.Key}
+			streams[l.Key] = st
+			order = append(order, st)
+		}
+		st.values = append(st.values, l.Data)
+	}
+
+	dst = append(dst, `{"streams":[`...)
+	for i, st := range order {
+		if i > 0 {
+			dst = append(dst, ',')
+		}
+		dst = append(dst, `{"stream":`...)
+		dst = append(dst, st.labels...)
+		dst = append(dst, `,"values":[`...)
+
+		sort.SliceStable(st.values, func(i, j int) bool {
+			return timestamp(st.values[i]) < timestamp(st.values[j])
+		})
+		for j, v := range st.values {
+			if j > 0 {
+				dst = append(dst, ',')
+			}
+			dst = append(dst, v...)
+		}
+		dst = append(dst, "]}"...)
+	}
+	return append(dst, "]}"...)
+}
+
+// timestamp returns the timestamp of a value encoded by Encode.
+func timestamp(value []byte) int64 {
+	end := bytes.IndexByte(value[2:], '"')
+	ns, _ := strconv.ParseInt(string(value[2:2+end]), 10, 64)
+	return ns
+}
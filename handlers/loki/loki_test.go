@@ -0,0 +1,232 @@
+package loki_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/eluv-io/apexlog-go"
+	hjson "github.com/eluv-io/apexlog-go/handlers/json"
+	"github.com/eluv-io/apexlog-go/handlers/loki"
+	"github.com/eluv-io/apexlog-go/logtest"
+)
+
+type push struct {
+	Streams []struct {
+		Stream map[string]string `json:"stream"`
+		Values [][2]string       `json:"values"`
+	} `json:"streams"`
+}
+
+// server is a stand-in for Loki, failing the first requests with the given
+// status.
+type server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	failures int
+	status   int
+	requests []*http.Request
+	pushes   []push
+}
+
+func newServer(t *testing.T, failures int, status int) *server {
+	s := &server{failures: failures, status: status}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.requests = append(s.requests, r)
+
+		if s.failures > 0 {
+			s.failures--
+			w.WriteHeader(s.status)
+			return
+		}
+
+		var p push
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&p))
+		s.pushes = append(s.pushes, p)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	return s
+}
+
+func newLogger(h log.Handler) *log.Logger {
+	return &log.Logger{
+		Handler: h,
+		Level:   log.InfoLevel,
+		Clock:   logtest.NewClock(time.Unix(0, 0).UTC()),
+	}
+}
+
+func TestHandler(t *testing.T) {
+	s := newServer(t, 0, 0)
+	defer s.Close()
+
+	h := loki.New(&loki.Config{
+		URL:           s.URL,
+		Username:      "user",
+		Password:      "secret",
+		TenantID:      "acme",
+		StaticLabels:  map[string]string{"job": "api"},
+		Labels:        []string{"level", "region"},
+		FlushInterval: time.Hour,
+	})
+	l := newLogger(h)
+
+	l.Info("hello", "region", "eu", "user", "tj")
+	l.Error("boom", "region", "eu")
+	l.Info("world", "region", "us")
+	require.NoError(t, h.Close())
+
+	require.Len(t, s.requests, 1)
+	user, password, ok := s.requests[0].BasicAuth()
+	assert.True(t, ok)
+	assert.Equal(t, "user", user)
+	assert.Equal(t, "secret", password)
+	assert.Equal(t, "acme", s.requests[0].Header.Get("X-Scope-OrgID"))
+
+	streams := s.pushes[0].Streams
+	require.Len(t, streams, 3)
+	assert.Equal(t, map[string]string{"job": "api", "level": "info", "region": "eu"}, streams[0].Stream)
+	assert.Equal(t, [][2]string{{"0", "timestamp=1970-01-01T00:00:00Z level=info message=hello user=tj"}}, streams[0].Values)
+	assert.Equal(t, map[string]string{"job": "api", "level": "error", "region": "eu"}, streams[1].Stream)
+	assert.Equal(t, map[string]string{"job": "api", "level": "info", "region": "us"}, streams[2].Stream)
+
+	assert.Equal(t, loki.ErrClosed, h.HandleLog(&log.Entry{}))
+}
+
+func TestHandler_cardinality(t *testing.T) {
+	s := newServer(t, 0, 0)
+	defer s.Close()
+
+	h := loki.New(&loki.Config{
+		URL:            s.URL,
+		StaticLabels:   map[string]string{"job": "api"},
+		Labels:         []string{"user"},
+		MaxLabelValues: 2,
+		Encoder:        hjson.NewEncoder(&hjson.Config{Flatten: true}),
+		FlushInterval:  time.Hour,
+	})
+	l := newLogger(h)
+
+	l.Info("a", "user", "alice")
+	l.Info("b", "user", "bob")
+	l.Info("c", "user", "carol")
+	l.Info("d", "user", "alice")
+	require.NoError(t, h.Close())
+
+	streams := s.pushes[0].Streams
+	require.Len(t, streams, 3)
+	assert.Equal(t, map[string]string{"job": "api", "user": "alice"}, streams[0].Stream)
+	assert.Len(t, streams[0].Values, 2)
+	assert.Equal(t, map[string]string{"job": "api", "user": "bob"}, streams[1].Stream)
+
+	// values exceeding the cap are kept in the line
+	assert.Equal(t, map[string]string{"job": "api"}, streams[2].Stream)
+	assert.Equal(t, `{"user":"carol","level":"info","timestamp":"1970-01-01T00:00:00Z","message":"c"}`, streams[2].Values[0][1])
+}
+
+func TestHandler_order(t *testing.T) {
+	s := newServer(t, 0, 0)
+	defer s.Close()
+
+	h := loki.New(&loki.Config{
+		URL:           s.URL,
+		FlushInterval: time.Hour,
+	})
+
+	for _, ts := range []int64{3, 1, 2} {
+		require.NoError(t, h.HandleLog(&log.Entry{Timestamp: time.Unix(0, ts), Message: "m"}))
+	}
+	require.NoError(t, h.Close())
+
+	assert.Equal(t, map[string]string{"job": "loki.test"}, s.pushes[0].Streams[0].Stream)
+	var ts []string
+	for _, v := range s.pushes[0].Streams[0].Values {
+		ts = append(ts, v[0])
+	}
+	assert.Equal(t, []string{"1", "2", "3"}, ts)
+}
+
+func TestHandler_batch(t *testing.T) {
+	s := newServer(t, 0, 0)
+	defer s.Close()
+
+	h := loki.New(&loki.Config{
+		URL:           s.URL,
+		BatchSize:     2,
+		FlushInterval: time.Hour,
+	})
+	l := newLogger(h)
+
+	for i := 0; i < 5; i++ {
+		l.Info("hello", "i", i)
+	}
+	require.NoError(t, h.Flush())
+	assert.Len(t, s.pushes, 3)
+
+	// pushes are made in order
+	var lines []string
+	for _, p := range s.pushes {
+		for _, v := range p.Streams[0].Values {
+			lines = append(lines, v[1])
+		}
+	}
+	require.Len(t, lines, 5)
+	for i, line := range lines {
+		assert.Contains(t, line, "i="+string(rune('0'+i)))
+	}
+	require.NoError(t, h.Close())
+}
+
+func TestHandler_interval(t *testing.T) {
+	s := newServer(t, 0, 0)
+	defer s.Close()
+
+	h := loki.New(&loki.Config{
+		URL:           s.URL,
+		FlushInterval: 10 * time.Millisecond,
+	})
+	defer h.Close()
+
+	newLogger(h).Info("hello")
+	assert.Eventually(t, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return len(s.pushes) == 1
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestHandler_retry(t *testing.T) {
+	s := newServer(t, 2, http.StatusTooManyRequests)
+	defer s.Close()
+
+	h := loki.New(&loki.Config{
+		URL:           s.URL,
+		FlushInterval: time.Hour,
+		RetryBackoff:  time.Millisecond,
+	})
+	l := newLogger(h)
+
+	l.Info("hello")
+	require.NoError(t, h.Flush())
+	assert.Len(t, s.requests, 3)
+	assert.Len(t, s.pushes, 1)
+
+	// client errors are not retried
+	s.mu.Lock()
+	s.failures = 1
+	s.status = http.StatusBadRequest
+	s.mu.Unlock()
+	l.Info("hello")
+	assert.Error(t, h.Flush())
+	assert.Len(t, s.requests, 4)
+	require.NoError(t, h.Close())
+}
@@ -1,5 +1,6 @@
 // Package memory implements an in-memory handler useful for testing, as the
-// entries can be accessed after writes.
+// entries can be accessed after writes. The handler keeps copies of the
+// logged entries, which are therefore never released to the pool.
 package memory
 
 import (
@@ -10,8 +11,10 @@ import (
 
 // Handler implementation.
 type Handler struct {
-	mu      sync.Mutex
-	Entries []*log.Entry
+	mu       sync.Mutex
+	Entries  []*log.Entry
+	Capacity int // Capacity is the max number of entries kept, oldest are dropped first (default: unbounded)
+	dropped  int
 }
 
 // New handler.
@@ -19,14 +22,69 @@ func New() *Handler {
 	return &Handler{}
 }
 
+// NewBounded returns a handler keeping at most the given number of entries.
+func NewBounded(capacity int) *Handler {
+	return &Handler{
+		Capacity: capacity,
+	}
+}
+
 // HandleLog implements log.Handler.
 func (h *Handler) HandleLog(e *log.Entry) error {
 	h.mu.Lock()
 	defer h.mu.Unlock()
-	h.Entries = append(h.Entries, e)
+	if h.Capacity > 0 && len(h.Entries) >= h.Capacity {
+		n := len(h.Entries) - h.Capacity + 1
+		copy(h.Entries, h.Entries[n:])
+		for i := len(h.Entries) - n; i < len(h.Entries); i++ {
+			h.Entries[i] = nil
+		}
+		h.Entries = h.Entries[:len(h.Entries)-n]
+		h.dropped += n
+	}
+	h.Entries = append(h.Entries, e.Clone())
 	return nil
 }
 
-func (h *Handler) Asynchronous() bool {
-	return true
+// Snapshot returns a copy of the entries captured so far. Contrary to
+// accessing Entries directly, it is safe to call while logging.
+func (h *Handler) Snapshot() []*log.Entry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ret := make([]*log.Entry, len(h.Entries))
+	copy(ret, h.Entries)
+	return ret
+}
+
+// Messages returns the messages of the entries captured so far.
+func (h *Handler) Messages() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ret := make([]string, len(h.Entries))
+	for i, e := range h.Entries {
+		ret[i] = e.Message
+	}
+	return ret
+}
+
+// Len returns the number of entries captured so far.
+func (h *Handler) Len() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.Entries)
+}
+
+// Dropped returns the number of entries dropped because of Capacity.
+func (h *Handler) Dropped() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.dropped
+}
+
+// Reset removes all captured entries.
+func (h *Handler) Reset() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.Entries = nil
+	h.dropped = 0
 }
@@ -1,36 +1,123 @@
 // Package multi implements a handler which invokes a number of handlers.
+//
+// By default, handlers are invoked in order until one fails. In the All mode,
+// every handler is invoked even if some fail - an Elasticsearch outage
+// doesn't prevent console output - and the errors are aggregated in Errors,
+// prefixed with the index of their handler.
+// The Parallel mode invokes handlers concurrently, and waits up to Timeout
+// for them.
 package multi
 
 import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
 	"github.com/eluv-io/apexlog-go"
 )
 
-// Handler implementation.
+// ErrTimeout is wrapped by the errors of handlers timing out in the Parallel
+// mode.
+var ErrTimeout = errors.New("multi: timeout")
+
+// Mode is the way handlers are invoked.
+type Mode int
+
+// Modes.
+const (
+	FailFast Mode = iota // FailFast invokes handlers in order until one fails, and returns its error
+	All                  // All invokes every handler in order
+	Parallel             // Parallel invokes every handler concurrently
+)
+
+// Config for handler.
+type Config struct {
+	Mode    Mode          // Mode is the way handlers are invoked (default: FailFast)
+	Timeout time.Duration // Timeout is the max time the Parallel mode waits for handlers, 0 for no timeout
+}
+
+// Handler implementation. Handlers may be added to Handlers before logging.
+// The zero value of the mode is FailFast, such that handlers may be built as
+// literals: &multi.Handler{Handlers: h}.
 type Handler struct {
+	Mode     Mode          // Mode is the way handlers are invoked
+	Timeout  time.Duration // Timeout is the max time the Parallel mode waits for handlers, 0 for no timeout
 	Handlers []log.Handler
-	async    bool
 }
 
 // New handler.
 func New(h ...log.Handler) *Handler {
-	async := false
-	for _, l := range h {
-		if as, ok := l.(log.Asynchronous); ok && as.Asynchronous() {
-			async = true
-		}
+	return NewWithConfig(nil, h...)
+}
+
+// NewWithConfig returns a handler with the given config, which may be nil.
+func NewWithConfig(config *Config, h ...log.Handler) *Handler {
+	if config == nil {
+		config = &Config{}
 	}
 	return &Handler{
+		Mode:     config.Mode,
+		Timeout:  config.Timeout,
 		Handlers: h,
-		async:    async,
 	}
 }
 
+// Errors holds the errors of the failing handlers in the All and Parallel
+// modes, prefixed with "handler <index>: ". They are matched by errors.Is and
+// errors.As.
+type Errors []error
+
+// Error implements error, with an error per line.
+func (e Errors) Error() string {
+	s := make([]string, len(e))
+	for i, err := range e {
+		s[i] = err.Error()
+	}
+	return strings.Join(s, "\n")
+}
+
+// Unwrap returns the errors.
+func (e Errors) Unwrap() []error {
+	return e
+}
+
+// Is returns true if one of the errors matches target, see errors.Is.
+func (e Errors) Is(target error) bool {
+	for _, err := range e {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first of the errors matching target, see errors.As.
+func (e Errors) As(target interface{}) bool {
+	for _, err := range e {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
 // HandleLog implements log.Handler.
 func (h *Handler) HandleLog(e *log.Entry) error {
+	switch h.Mode {
+	case All:
+		var errs Errors
+		for i, handler := range h.Handlers {
+			if err := handler.HandleLog(e); err != nil {
+				errs = append(errs, fmt.Errorf("handler %d: %w", i, err))
+			}
+		}
+		return errs.err()
+	case Parallel:
+		return h.parallel(e)
+	}
+
 	for _, handler := range h.Handlers {
-		// TODO(tj): maybe just write to stderr here, definitely not ideal
-		// to miss out logging to a more critical handler if something
-		// goes wrong
 		if err := handler.HandleLog(e); err != nil {
 			return err
 		}
@@ -39,6 +126,84 @@ func (h *Handler) HandleLog(e *log.Entry) error {
 	return nil
 }
 
+// err returns nil if there are no errors.
+func (e Errors) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// result is the result of a handler in the Parallel mode.
+type result struct {
+	i   int
+	err error
+}
+
+// parallel invokes the handlers concurrently. The entry is retained by each
+// goroutine, so that handlers timing out may still use it.
+func (h *Handler) parallel(e *log.Entry) error {
+	handlers := h.Handlers
+	results := make(chan result, len(handlers))
+	for i, handler := range handlers {
+		e.Retain()
+		go func(i int, handler log.Handler) {
+			defer e.Release()
+			results <- result{i: i, err: handler.HandleLog(e)}
+		}(i, handler)
+	}
+
+	var timeout <-chan time.Time
+	if h.Timeout > 0 {
+		timer := time.NewTimer(h.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	errs := make([]error, len(handlers))
+	pending := make([]bool, len(handlers))
+	for i := range pending {
+		pending[i] = true
+	}
+wait:
+	for n := 0; n < len(handlers); n++ {
+		select {
+		case r := <-results:
+			if r.err != nil {
+				errs[r.i] = fmt.Errorf("handler %d: %w", r.i, r.err)
+			}
+			pending[r.i] = false
+		case <-timeout:
+			for i := range pending {
+				if pending[i] {
+					errs[i] = fmt.Errorf("handler %d: %w after %s", i, ErrTimeout, h.Timeout)
+				}
+			}
+			break wait
+		}
+	}
+
+	var ret Errors
+	for _, err := range errs {
+		if err != nil {
+			ret = append(ret, err)
+		}
+	}
+	return ret.err()
+}
+
+// Asynchronous implements log.Asynchronous. It returns true if one of the
+// handlers is asynchronous, or if handlers may time out in the Parallel mode.
+//
+// Deprecated: see log.Asynchronous.
 func (h *Handler) Asynchronous() bool {
-	return h.async
+	if h.Mode == Parallel && h.Timeout > 0 {
+		return true
+	}
+	for _, l := range h.Handlers {
+		if as, ok := l.(log.Asynchronous); ok && as.Asynchronous() {
+			return true
+		}
+	}
+	return false
 }
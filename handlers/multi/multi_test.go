@@ -1,12 +1,18 @@
 package multi_test
 
 import (
+	"bytes"
+	"errors"
+	"os"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/eluv-io/apexlog-go"
+	"github.com/eluv-io/apexlog-go/handlers/json"
 	"github.com/eluv-io/apexlog-go/handlers/memory"
 	"github.com/eluv-io/apexlog-go/handlers/multi"
 )
@@ -29,3 +35,94 @@ func Test(t *testing.T) {
 	assert.Len(t, a.Entries, 3)
 	assert.Len(t, b.Entries, 3)
 }
+
+func TestPooled(t *testing.T) {
+	var buf bytes.Buffer
+	a := memory.New()
+
+	l := &log.Logger{
+		Handler: multi.New(a, json.New(&buf)),
+		Level:   log.InfoLevel,
+	}
+	l.WithField("user", "tj").Info("hello")
+	l.Info("world", "id", "123")
+	l.Error("boom")
+
+	assert.Len(t, a.Entries, 3)
+	assert.Equal(t, "hello", a.Entries[0].Message)
+	assert.Equal(t, log.Fields{{Name: "user", Value: "tj"}}, a.Entries[0].Fields)
+	assert.Equal(t, "world", a.Entries[1].Message)
+	assert.Equal(t, log.Fields{{Name: "id", Value: "123"}}, a.Entries[1].Fields)
+	assert.Equal(t, "boom", a.Entries[2].Message)
+	assert.Equal(t, 3, strings.Count(buf.String(), "\n"))
+}
+
+// failing is a handler failing with err, after blocking until release is
+// closed if not nil.
+type failing struct {
+	err     error
+	release chan struct{}
+}
+
+func (f *failing) HandleLog(e *log.Entry) error {
+	if f.release != nil {
+		<-f.release
+	}
+	_ = e.Message // entries stay valid after timeouts
+	return f.err
+}
+
+func TestFailFast(t *testing.T) {
+	a := memory.New()
+	h := multi.New(&failing{err: errors.New("boom")}, a)
+
+	assert.EqualError(t, h.HandleLog(&log.Entry{Message: "hello"}), "boom")
+	assert.Equal(t, 0, a.Len())
+}
+
+func TestAll(t *testing.T) {
+	a := memory.New()
+	errA, errB := errors.New("a"), &os.PathError{Op: "write", Path: "b", Err: os.ErrClosed}
+	h := multi.NewWithConfig(&multi.Config{Mode: multi.All}, &failing{err: errA}, a, &failing{err: errB})
+
+	err := h.HandleLog(&log.Entry{Message: "hello"})
+	assert.EqualError(t, err, "handler 0: a\nhandler 2: write b: file already closed")
+	assert.True(t, errors.Is(err, errA))
+	assert.True(t, errors.Is(err, os.ErrClosed))
+	var pathErr *os.PathError
+	require.True(t, errors.As(err, &pathErr))
+	assert.Equal(t, errB, pathErr)
+	assert.Equal(t, 1, a.Len())
+
+	h.Handlers = h.Handlers[1:2]
+	assert.NoError(t, h.HandleLog(&log.Entry{Message: "hello"}))
+}
+
+func TestParallel(t *testing.T) {
+	a := memory.New()
+	slow := &failing{release: make(chan struct{})}
+	h := multi.NewWithConfig(&multi.Config{Mode: multi.Parallel, Timeout: 10 * time.Millisecond},
+		a, slow, &failing{err: errors.New("boom")})
+
+	l := &log.Logger{Handler: h, Level: log.InfoLevel}
+	l.Info("hello", "user", "tj")
+	assert.Equal(t, 1, a.Len())
+	assert.Equal(t, "tj", a.Snapshot()[0].Fields.Get("user"))
+
+	err := h.HandleLog(&log.Entry{Message: "world"})
+	assert.True(t, errors.Is(err, multi.ErrTimeout))
+	assert.EqualError(t, err, "handler 1: multi: timeout after 10ms\nhandler 2: boom")
+
+	var errs multi.Errors
+	require.True(t, errors.As(err, &errs))
+	assert.Len(t, errs, 2)
+	close(slow.release)
+}
+
+func TestHandler_literal(t *testing.T) {
+	a := memory.New()
+	h := &multi.Handler{Handlers: []log.Handler{a}}
+
+	require.NoError(t, h.HandleLog(&log.Entry{Message: "hello", Level: log.InfoLevel}))
+	assert.Equal(t, []string{"hello"}, a.Messages())
+}
@@ -0,0 +1,428 @@
+// Package otlp implements a handler sending batches of entries to an
+// OpenTelemetry collector using the OTLP/HTTP JSON encoding.
+//
+// Entries are encoded as log records when logged and sent in order by a
+// batch.Handler once BatchSize records are pending or every FlushInterval. Requests failing with a network
+// error or a retryable status are retried with an exponential backoff.
+package otlp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	stdlog "log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/eluv-io/apexlog-go"
+	"github.com/eluv-io/apexlog-go/handlers/batch"
+)
+
+// ErrClosed is returned when logging to a closed handler.
+var ErrClosed = errors.New("otlp: handler closed")
+
+// ScopeName is the name of the instrumentation scope of log records.
+const ScopeName = "github.com/eluv-io/apexlog-go"
+
+// Config for handler.
+type Config struct {
+	Endpoint           string            // Endpoint is the URL of the collector logs endpoint (default: "http://localhost:4318/v1/logs")
+	Headers            map[string]string // Headers are added to all requests, e.g. for authentication
+	Client             *http.Client      // Client is the HTTP client (default: client with a 10s timeout)
+	ServiceName        string            // ServiceName is the "service.name" resource attribute (default: the executable name)
+	Hostname           string            // Hostname is the "host.name" resource attribute (default: os.Hostname())
+	ResourceAttributes log.Fields        // ResourceAttributes are additional resource attributes
+	TraceField         string            // TraceField is the field holding the hex trace ID (default: "trace_id")
+	SpanField          string            // SpanField is the field holding the hex span ID (default: "span_id")
+	BatchSize          int               // BatchSize is the number of records to buffer before sending (default: 100)
+	FlushInterval      time.Duration     // FlushInterval is the max time records are buffered (default: 5s)
+	Retries            int               // Retries is the number of retries of failed requests (default: 3)
+	RetryBackoff       time.Duration     // RetryBackoff is the delay before the first retry, doubled for each retry (default: 500ms)
+	Gzip               bool              // Gzip compresses request bodies
+}
+
+// defaults applies defaults to the config.
+func (c *Config) defaults() {
+	if c.Endpoint == "" {
+		c.Endpoint = "http://localhost:4318/v1/logs"
+	}
+
+	if c.Client == nil {
+		c.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	if c.ServiceName == "" && len(os.Args) > 0 {
+		c.ServiceName = os.Args[0]
+	}
+
+	if c.Hostname == "" {
+		c.Hostname, _ = os.Hostname()
+	}
+
+	if c.TraceField == "" {
+		c.TraceField = "trace_id"
+	}
+
+	if c.SpanField == "" {
+		c.SpanField = "span_id"
+	}
+
+	if c.BatchSize == 0 {
+		c.BatchSize = 100
+	}
+
+	if c.FlushInterval == 0 {
+		c.FlushInterval = 5 * time.Second
+	}
+
+	if c.Retries == 0 {
+		c.Retries = 3
+	}
+
+	if c.RetryBackoff == 0 {
+		c.RetryBackoff = 500 * time.Millisecond
+	}
+}
+
+// Handler implementation.
+type Handler struct {
+	*Config
+	batch *batch.Handler
+}
+
+// New handler.
+func New(config *Config) *Handler {
+	config.defaults()
+	s := &sink{Config: config}
+	s.prefix = s.appendPrefix(nil)
+	return &Handler{
+		Config: config,
+		batch: batch.New(s, &batch.Config{
+			BatchSize:     config.BatchSize,
+			FlushInterval: config.FlushInterval,
+			OnError: func(err error, records []batch.Record) {
+				stdlog.Printf("log/otlp: failed to send %d logs: %s", len(records), err)
+			},
+		}),
+	}
+}
+
+// HandleLog implements log.Handler.
+func (h *Handler) HandleLog(e *log.Entry) error {
+	err := h.batch.HandleLog(e)
+	if err == batch.ErrClosed {
+		return ErrClosed
+	}
+	return err
+}
+
+// Flush sends the pending records and waits for requests in flight.
+func (h *Handler) Flush() error {
+	return h.batch.Flush()
+}
+
+// Close flushes the handler. Entries logged afterwards are rejected with
+// ErrClosed.
+func (h *Handler) Close() error {
+	return h.batch.Close()
+}
+
+// sink implements batch.BatchSink.
+type sink struct {
+	*Config
+
+	prefix []byte // prefix of request bodies, up to the log records
+	json   log.JSONEncoder
+}
+
+// Encode implements batch.BatchSink, encoding the entry as a log record.
+func (s *sink) Encode(e *log.Entry) (batch.Record, error) {
+	record, err := s.appendRecord(nil, e)
+	if err != nil {
+		return batch.Record{}, err
+	}
+	return batch.Record{Data: record}, nil
+}
+
+// Send implements batch.BatchSink, sending the records in a single request
+// and retrying on failures.
+func (s *sink) Send(records []batch.Record) error {
+	body := s.body(records)
+
+	backoff := s.RetryBackoff
+	var err error
+	for attempt := 0; ; attempt++ {
+		var retry bool
+		retry, err = s.post(body)
+		if err == nil || !retry || attempt >= s.Retries {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// body returns the request body holding the given records.
+func (s *sink) body(records []batch.Record) []byte {
+	size := len(s.prefix) + len(suffix)
+	for _, r := range records {
+		size += len(r.Data) + 1
+	}
+
+	buf := make([]byte, 0, size)
+	buf = append(buf, s.prefix...)
+	for i, r := range records {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		buf = append(buf, r.Data...)
+	}
+	buf = append(buf, suffix...)
+
+	if !s.Gzip {
+		return buf
+	}
+
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	_, _ = w.Write(buf)
+	_ = w.Close()
+	return gz.Bytes()
+}
+
+// post posts the body to the collector. It returns whether the request should
+// be retried if it failed.
+func (s *sink) post(body []byte) (retry bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, s.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if s.Gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	for k, v := range s.Headers {
+		req.Header.Set(k, v)
+	}
+
+	res, err := s.Client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, res.Body)
+
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return false, nil
+	}
+
+	err = fmt.Errorf("otlp: %s responded with %s", s.Endpoint, res.Status)
+	switch res.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true, err
+	}
+	return false, err
+}
+
+// suffix closes the request body after the log records.
+const suffix = `]}]}]}`
+
+// appendPrefix appends the beginning of request bodies: the resource and the
+// scope up to the log records.
+func (s *sink) appendPrefix(dst []byte) []byte {
+	attrs := log.Fields{}
+	if s.ServiceName != "" {
+		attrs = append(attrs, &log.Field{Name: "service.name", Value: s.ServiceName})
+	}
+	if s.Hostname != "" {
+		attrs = append(attrs, &log.Field{Name: "host.name", Value: s.Hostname})
+	}
+	attrs = append(attrs, s.ResourceAttributes...)
+
+	dst = append(dst, `{"resourceLogs":[{"resource":{"attributes":`...)
+	dst = s.appendAttributes(dst, attrs, nil)
+	dst = append(dst, `},"scopeLogs":[{"scope":{"name":`...)
+	dst = s.json.AppendString(dst, ScopeName)
+	return append(dst, `},"logRecords":[`...)
+}
+
+// Severity returns the OpenTelemetry severity number and text of the given
+// level.
+func Severity(level log.Level) (number int, text string) {
+	switch level {
+	case log.TraceLevel:
+		return 1, "TRACE"
+	case log.DebugLevel:
+		return 5, "DEBUG"
+	case log.InfoLevel:
+		return 9, "INFO"
+	case log.WarnLevel:
+		return 13, "WARN"
+	case log.ErrorLevel:
+		return 17, "ERROR"
+	case log.FatalLevel:
+		return 21, "FATAL"
+	}
+	return 0, ""
+}
+
+// appendRecord appends the entry encoded as a log record.
+func (s *sink) appendRecord(dst []byte, e *log.Entry) ([]byte, error) {
+	number, text := Severity(e.Level)
+
+	dst = append(dst, `{"timeUnixNano":"`...)
+	dst = strconv.AppendInt(dst, e.Timestamp.UnixNano(), 10)
+	dst = append(dst, `","severityNumber":`...)
+	dst = strconv.AppendInt(dst, int64(number), 10)
+	dst = append(dst, `,"severityText":`...)
+	dst = s.json.AppendString(dst, text)
+	dst = append(dst, `,"body":{"stringValue":`...)
+	dst = s.json.AppendString(dst, e.Message)
+	dst = append(dst, `},"attributes":`...)
+
+	traceID, spanID := "", ""
+	for _, f := range e.Fields {
+		switch f.Name {
+		case s.TraceField:
+			traceID = hexID(f.Value, 16)
+		case s.SpanField:
+			spanID = hexID(f.Value, 8)
+		}
+	}
+	skip := func(f *log.Field) bool {
+		return (f.Name == s.TraceField && traceID != "") || (f.Name == s.SpanField && spanID != "")
+	}
+	dst = s.appendAttributes(dst, e.Fields, skip)
+
+	if traceID != "" {
+		dst = append(dst, `,"traceId":"`...)
+		dst = append(dst, traceID...)
+		dst = append(dst, '"')
+	}
+	if spanID != "" {
+		dst = append(dst, `,"spanId":"`...)
+		dst = append(dst, spanID...)
+		dst = append(dst, '"')
+	}
+	return append(dst, '}'), nil
+}
+
+// hexID returns the value if it is a valid hex ID of the given number of
+// bytes, or an empty string.
+func hexID(value interface{}, size int) string {
+	s, ok := value.(string)
+	if !ok || len(s) != 2*size {
+		return ""
+	}
+	if _, err := hex.DecodeString(s); err != nil {
+		return ""
+	}
+	return s
+}
+
+// appendAttributes appends the fields as an array of key values, omitting the
+// fields for which skip returns true.
+func (s *sink) appendAttributes(dst []byte, fields log.Fields, skip func(*log.Field) bool) []byte {
+	dst = append(dst, '[')
+	first := true
+	for _, f := range fields {
+		if skip != nil && skip(f) {
+			continue
+		}
+		if !first {
+			dst = append(dst, ',')
+		}
+		first = false
+		dst = append(dst, `{"key":`...)
+		dst = s.json.AppendString(dst, f.Name)
+		dst = append(dst, `,"value":`...)
+		dst = s.appendAnyValue(dst, f.Value)
+		dst = append(dst, '}')
+	}
+	return append(dst, ']')
+}
+
+// appendUintValue appends the beginning of an OTLP AnyValue holding n: an
+// intValue, or a stringValue beyond the range of intValue.
+func appendUintValue(dst []byte, n uint64) []byte {
+	if n > math.MaxInt64 {
+		dst = append(dst, `{"stringValue":"`...)
+	} else {
+		dst = append(dst, `{"intValue":"`...)
+	}
+	dst = strconv.AppendUint(dst, n, 10)
+	return append(dst, '"')
+}
+
+// appendAnyValue appends the value encoded as an OTLP AnyValue. Values of
+// types without an OTLP counterpart are written as their JSON encoding.
+func (s *sink) appendAnyValue(dst []byte, value interface{}) []byte {
+	switch v := value.(type) {
+	case string:
+		dst = append(dst, `{"stringValue":`...)
+		dst = s.json.AppendString(dst, v)
+	case bool:
+		dst = append(dst, `{"boolValue":`...)
+		dst = strconv.AppendBool(dst, v)
+	case int, int8, int16, int32, int64, uint8, uint16, uint32, time.Duration:
+		// 64 bits integers are strings in the protobuf JSON mapping
+		dst = append(dst, `{"intValue":"`...)
+		dst, _ = s.json.AppendValue(dst, v)
+		dst = append(dst, '"')
+	case uint:
+		dst = appendUintValue(dst, uint64(v))
+	case uint64:
+		dst = appendUintValue(dst, v)
+	case float32, float64:
+		dst = append(dst, `{"doubleValue":`...)
+		var err error
+		if dst, err = s.json.AppendValue(dst, v); err != nil {
+			// NaN and infinities
+			dst = s.json.AppendString(dst, fmt.Sprint(v))
+		}
+	case log.Fields:
+		dst = append(dst, `{"kvlistValue":{"values":`...)
+		dst = s.appendAttributes(dst, v, nil)
+		dst = append(dst, '}')
+	case []interface{}:
+		dst = append(dst, `{"arrayValue":{"values":[`...)
+		for i, elem := range v {
+			if i > 0 {
+				dst = append(dst, ',')
+			}
+			dst = s.appendAnyValue(dst, elem)
+		}
+		dst = append(dst, `]}`...)
+	case []string:
+		dst = append(dst, `{"arrayValue":{"values":[`...)
+		for i, elem := range v {
+			if i > 0 {
+				dst = append(dst, ',')
+			}
+			dst = s.appendAnyValue(dst, elem)
+		}
+		dst = append(dst, `]}`...)
+	default:
+		dst = append(dst, `{"stringValue":`...)
+		b, err := s.json.AppendValue(nil, v)
+		if err != nil {
+			b = []byte(fmt.Sprint(v))
+		} else if len(b) > 0 && b[0] == '"' {
+			// a JSON string, e.g. for time.Time: write its content
+			s, err := strconv.Unquote(string(b))
+			if err == nil {
+				b = []byte(s)
+			}
+		}
+		dst = s.json.AppendString(dst, string(b))
+	}
+	return append(dst, '}')
+}
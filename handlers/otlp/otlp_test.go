@@ -0,0 +1,214 @@
+package otlp_test
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/eluv-io/apexlog-go"
+	"github.com/eluv-io/apexlog-go/handlers/otlp"
+)
+
+// collector is a stand-in for an OpenTelemetry collector, failing the first
+// requests with the given status.
+type collector struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	failures int
+	status   int
+	requests []*http.Request
+	bodies   []map[string]interface{}
+}
+
+func newCollector(t *testing.T, failures int, status int) *collector {
+	c := &collector{failures: failures, status: status}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.requests = append(c.requests, r)
+
+		if c.failures > 0 {
+			c.failures--
+			w.WriteHeader(c.status)
+			return
+		}
+
+		var body io.Reader = r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(r.Body)
+			require.NoError(t, err)
+			body = gz
+		}
+		var doc map[string]interface{}
+		require.NoError(t, json.NewDecoder(body).Decode(&doc))
+		c.bodies = append(c.bodies, doc)
+	}))
+	return c
+}
+
+// records returns the log records received by the collector.
+func (c *collector) records() []map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var ret []map[string]interface{}
+	for _, doc := range c.bodies {
+		rl := doc["resourceLogs"].([]interface{})[0].(map[string]interface{})
+		sl := rl["scopeLogs"].([]interface{})[0].(map[string]interface{})
+		for _, r := range sl["logRecords"].([]interface{}) {
+			ret = append(ret, r.(map[string]interface{}))
+		}
+	}
+	return ret
+}
+
+func TestHandler(t *testing.T) {
+	c := newCollector(t, 0, 0)
+	defer c.Close()
+
+	h := otlp.New(&otlp.Config{
+		Endpoint:      c.URL,
+		ServiceName:   "api",
+		Hostname:      "host-1",
+		Headers:       map[string]string{"Authorization": "Bearer token"},
+		Gzip:          true,
+		FlushInterval: time.Hour,
+	})
+	l := &log.Logger{Handler: h, Level: log.InfoLevel}
+
+	l.Info("hello",
+		"user", "tj",
+		"count", 3,
+		"trace_id", "4bf92f3577b34da6a3ce929d0e0e4736",
+		"span_id", "00f067aa0ba902b7")
+	l.Warn("careful", "trace_id", "not-a-trace-id")
+	require.NoError(t, h.Close())
+
+	require.Len(t, c.requests, 1)
+	assert.Equal(t, "Bearer token", c.requests[0].Header.Get("Authorization"))
+	assert.Equal(t, "gzip", c.requests[0].Header.Get("Content-Encoding"))
+
+	rl := c.bodies[0]["resourceLogs"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"key": "service.name", "value": map[string]interface{}{"stringValue": "api"}},
+		map[string]interface{}{"key": "host.name", "value": map[string]interface{}{"stringValue": "host-1"}},
+	}, rl["resource"].(map[string]interface{})["attributes"])
+
+	records := c.records()
+	require.Len(t, records, 2)
+
+	assert.Equal(t, 9.0, records[0]["severityNumber"])
+	assert.Equal(t, "INFO", records[0]["severityText"])
+	assert.Equal(t, map[string]interface{}{"stringValue": "hello"}, records[0]["body"])
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", records[0]["traceId"])
+	assert.Equal(t, "00f067aa0ba902b7", records[0]["spanId"])
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"key": "user", "value": map[string]interface{}{"stringValue": "tj"}},
+		map[string]interface{}{"key": "count", "value": map[string]interface{}{"intValue": "3"}},
+	}, records[0]["attributes"])
+
+	// invalid trace ids are kept as attributes
+	assert.Equal(t, 13.0, records[1]["severityNumber"])
+	assert.NotContains(t, records[1], "traceId")
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"key": "trace_id", "value": map[string]interface{}{"stringValue": "not-a-trace-id"}},
+	}, records[1]["attributes"])
+
+	assert.Equal(t, otlp.ErrClosed, h.HandleLog(&log.Entry{Fields: log.Fields{}}))
+}
+
+func TestHandler_batch(t *testing.T) {
+	c := newCollector(t, 0, 0)
+	defer c.Close()
+
+	h := otlp.New(&otlp.Config{
+		Endpoint:      c.URL,
+		BatchSize:     2,
+		FlushInterval: time.Hour,
+	})
+	l := &log.Logger{Handler: h, Level: log.InfoLevel}
+
+	for i := 0; i < 5; i++ {
+		l.Info("hello", "i", i)
+	}
+	require.NoError(t, h.Flush())
+
+	assert.Len(t, c.records(), 5)
+	assert.Len(t, c.requests, 3)
+	require.NoError(t, h.Close())
+}
+
+func TestHandler_interval(t *testing.T) {
+	c := newCollector(t, 0, 0)
+	defer c.Close()
+
+	h := otlp.New(&otlp.Config{
+		Endpoint:      c.URL,
+		FlushInterval: 10 * time.Millisecond,
+	})
+	defer h.Close()
+	l := &log.Logger{Handler: h, Level: log.InfoLevel}
+
+	l.Info("hello")
+	assert.Eventually(t, func() bool {
+		return len(c.records()) == 1
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestHandler_interval_flush(t *testing.T) {
+	c := newCollector(t, 1, http.StatusServiceUnavailable)
+	defer c.Close()
+
+	h := otlp.New(&otlp.Config{
+		Endpoint:      c.URL,
+		FlushInterval: 10 * time.Millisecond,
+		RetryBackoff:  100 * time.Millisecond,
+	})
+	defer h.Close()
+	l := &log.Logger{Handler: h, Level: log.InfoLevel}
+
+	// Flush waits for the batch retried after the first tick
+	l.Info("hello", "small", uint(3), "large", uint64(1<<63))
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, h.Flush())
+
+	records := c.records()
+	require.Len(t, records, 1)
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"key": "small", "value": map[string]interface{}{"intValue": "3"}},
+		map[string]interface{}{"key": "large", "value": map[string]interface{}{"stringValue": "9223372036854775808"}},
+	}, records[0]["attributes"])
+}
+
+func TestHandler_retry(t *testing.T) {
+	c := newCollector(t, 2, http.StatusServiceUnavailable)
+	defer c.Close()
+
+	h := otlp.New(&otlp.Config{
+		Endpoint:      c.URL,
+		FlushInterval: time.Hour,
+		RetryBackoff:  time.Millisecond,
+	})
+	l := &log.Logger{Handler: h, Level: log.InfoLevel}
+
+	l.Info("hello")
+	require.NoError(t, h.Flush())
+	assert.Len(t, c.requests, 3)
+	assert.Len(t, c.records(), 1)
+
+	// client errors are not retried
+	c.failures = 1
+	c.status = http.StatusBadRequest
+	l.Info("hello")
+	assert.Error(t, h.Flush())
+	assert.Len(t, c.requests, 4)
+	require.NoError(t, h.Close())
+}
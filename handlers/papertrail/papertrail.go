@@ -51,7 +51,7 @@ func New(config *Config) *Handler {
 
 // HandleLog implements log.Handler.
 func (h *Handler) HandleLog(e *log.Entry) error {
-	ts := time.Now().Format(time.Stamp)
+	ts := e.Timestamp.Format(time.Stamp)
 
 	var buf bytes.Buffer
 
@@ -0,0 +1,367 @@
+// Package ratelimit implements a handler limiting the entries passed to
+// another handler with token buckets: globally, per level, per value of a key
+// field such as a tenant or a client IP, and by encoded size.
+//
+//	ratelimit.New(esHandler, &ratelimit.Config{
+//		Levels:   map[log.Level]ratelimit.Limit{log.ErrorLevel: {Rate: 100}},
+//		Key:      "client_ip",
+//		PerKey:   &ratelimit.Limit{Rate: 10, Burst: 100},
+//		Bytes:    10 << 20,
+//		Interval: time.Minute,
+//	})
+//
+// An entry is passed only if all the buckets applying to it have tokens left.
+// It is encoded to measure its size only if the other buckets allow it.
+// Suppressed entries are counted per level and per key - up to MaxKeys keys,
+// the others in "other_keys" - and reported by a warning passed to the
+// wrapped handler ReportInterval after the first of them, or when the handler
+// is closed.
+package ratelimit
+
+import (
+	"container/list"
+	"fmt"
+	stdlog "log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/eluv-io/apexlog-go"
+)
+
+// Limit is the limit of a token bucket.
+type Limit struct {
+	Rate  float64 // Rate is the number of entries per second
+	Burst int     // Burst is the max number of entries at once (default: Rate rounded up, at least 1)
+}
+
+// Config for handler.
+type Config struct {
+	Global         *Limit              // Global limits all entries, nil for no limit
+	Levels         map[log.Level]Limit // Levels limits the entries of levels, levels without limit aren't limited
+	Key            string              // Key is the name of the field whose values have their own bucket
+	PerKey         *Limit              // PerKey limits the entries of each value of Key, entries without Key aren't limited
+	MaxKeys        int                 // MaxKeys is the max number of tracked keys, the least recently used are evicted beyond (default: 10000)
+	Bytes          int                 // Bytes is the budget of encoded bytes per Interval, 0 for no budget. Larger entries pass only with the full budget, and take from the next intervals
+	Interval       time.Duration       // Interval is the period of the byte budget (default: 1s)
+	Encoder        log.Encoder         // Encoder measures the size of entries (default: log.JSONEncoder)
+	ReportInterval time.Duration       // ReportInterval is the delay of reports after the first suppressed entry (default: 1m)
+	Clock          log.Clock           // Clock is used for buckets and reports (default: log.SystemClock)
+}
+
+// defaults applies defaults to the config.
+func (c *Config) defaults() {
+	if c.MaxKeys == 0 {
+		c.MaxKeys = 10000
+	}
+
+	if c.Interval == 0 {
+		c.Interval = time.Second
+	}
+
+	if c.Encoder == nil {
+		c.Encoder = log.JSONEncoder{}
+	}
+
+	if c.ReportInterval == 0 {
+		c.ReportInterval = time.Minute
+	}
+
+	if c.Clock == nil {
+		c.Clock = log.SystemClock
+	}
+}
+
+// bucket is a token bucket, full when created.
+type bucket struct {
+	rate   float64 // rate is the number of tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(l Limit) *bucket {
+	burst := float64(l.Burst)
+	if burst <= 0 {
+		burst = math.Max(1, math.Ceil(l.Rate))
+	}
+	return &bucket{rate: l.Rate, burst: burst, tokens: burst}
+}
+
+// allow refills the bucket and returns true if it holds n tokens, or is full:
+// n may exceed the burst, the tokens are then negative once taken.
+func (b *bucket) allow(now time.Time, n float64) bool {
+	if !b.last.IsZero() && now.After(b.last) {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	if b.last.IsZero() || now.After(b.last) {
+		b.last = now
+	}
+	return b.tokens >= n || b.tokens >= b.burst
+}
+
+// keyBucket is the bucket of a key.
+type keyBucket struct {
+	key string
+	*bucket
+}
+
+// Handler implementation.
+type Handler struct {
+	*Config
+	handler log.Handler
+
+	mu         sync.Mutex
+	global     *bucket
+	levels     map[log.Level]*bucket
+	keys       map[string]*list.Element // keys are the elements of lru
+	lru        *list.List               // lru are the keyBuckets, most recently used first
+	bytes      *bucket
+	suppressed uint64            // suppressed is the total number of suppressed entries
+	pending    uint64            // pending is the number of suppressed entries not reported yet
+	byLevel    map[string]uint64 // byLevel are the pending suppressed entries per level
+	byKey      map[string]uint64 // byKey are the pending suppressed entries per key, for up to MaxKeys keys
+	otherKeys  uint64            // otherKeys is the number of pending suppressed entries of keys beyond MaxKeys
+	report     time.Time         // report is the time of the next report
+	timer      log.Timer         // timer reports the pending suppressed entries after ReportInterval
+	gen        int               // gen is incremented by reports, to ignore the timers of previous ones
+	closed     bool
+}
+
+// New handler passing the entries within limits to h. The config may be nil.
+func New(h log.Handler, config *Config) *Handler {
+	if config == nil {
+		config = &Config{}
+	}
+	config.defaults()
+
+	ret := &Handler{
+		Config:  config,
+		handler: h,
+		levels:  make(map[log.Level]*bucket),
+		keys:    make(map[string]*list.Element),
+		lru:     list.New(),
+		byLevel: make(map[string]uint64),
+		byKey:   make(map[string]uint64),
+	}
+	if config.Global != nil {
+		ret.global = newBucket(*config.Global)
+	}
+	for level, l := range config.Levels {
+		ret.levels[level] = newBucket(l)
+	}
+	if config.Bytes > 0 {
+		ret.bytes = newBucket(Limit{
+			Rate:  float64(config.Bytes) / config.Interval.Seconds(),
+			Burst: config.Bytes,
+		})
+	}
+	return ret
+}
+
+// HandleLog implements log.Handler.
+func (h *Handler) HandleLog(e *log.Entry) error {
+	key, hasKey := "", false
+	if h.Key != "" {
+		for _, f := range e.Fields {
+			if f.Name == h.Key {
+				key, hasKey = fmt.Sprint(f.Value), true
+				break
+			}
+		}
+	}
+
+	h.mu.Lock()
+	var buckets [3]*bucket
+	n := 0
+	if h.global != nil {
+		buckets[n] = h.global
+		n++
+	}
+	if b, ok := h.levels[e.Level]; ok {
+		buckets[n] = b
+		n++
+	}
+	if hasKey && h.PerKey != nil {
+		buckets[n] = h.keyBucket(key)
+		n++
+	}
+	allowed := allow(h.Clock.Now(), buckets[:n])
+	h.mu.Unlock()
+
+	// entries are encoded only if the count buckets allow them
+	size := 0
+	if allowed && h.bytes != nil {
+		var err error
+		buf := log.GetBuffer()
+		buf.B, err = h.Encoder.AppendEntry(buf.B, e)
+		size = len(buf.B)
+		buf.Release()
+		if err != nil {
+			return err
+		}
+	}
+
+	h.mu.Lock()
+	now := h.Clock.Now()
+	if allowed {
+		// checked again since other entries may have taken the tokens
+		allowed = allow(now, buckets[:n]) && (h.bytes == nil || h.bytes.allow(now, float64(size)))
+	}
+
+	if allowed {
+		for _, b := range buckets[:n] {
+			b.tokens--
+		}
+		if h.bytes != nil {
+			h.bytes.tokens -= float64(size)
+		}
+	} else {
+		h.suppress(now, e.Level, key, hasKey)
+	}
+
+	var summary *log.Entry
+	if h.pending > 0 && !now.Before(h.report) {
+		summary = h.summary(now)
+	}
+	h.mu.Unlock()
+
+	if summary != nil {
+		if err := h.handler.HandleLog(summary); err != nil {
+			return err
+		}
+	}
+	if !allowed {
+		return nil
+	}
+	return h.handler.HandleLog(e)
+}
+
+// allow returns true if all the buckets hold a token.
+func allow(now time.Time, buckets []*bucket) bool {
+	allowed := true
+	for _, b := range buckets {
+		allowed = b.allow(now, 1) && allowed
+	}
+	return allowed
+}
+
+// suppress counts a suppressed entry, and starts the report timer for the
+// first one. h.mu must be held.
+func (h *Handler) suppress(now time.Time, level log.Level, key string, hasKey bool) {
+	if h.pending == 0 {
+		h.report = now.Add(h.ReportInterval)
+		if !h.closed {
+			gen := h.gen
+			h.timer = h.Clock.AfterFunc(h.ReportInterval, func() {
+				h.tick(gen)
+			})
+		}
+	}
+
+	h.suppressed++
+	h.pending++
+	h.byLevel[level.String()]++
+	if hasKey {
+		if _, ok := h.byKey[key]; ok || len(h.byKey) < h.MaxKeys {
+			h.byKey[key]++
+		} else {
+			h.otherKeys++
+		}
+	}
+}
+
+// tick reports the pending suppressed entries, unless they were reported
+// since the timer of the given report generation was started.
+func (h *Handler) tick(gen int) {
+	h.mu.Lock()
+	if h.gen != gen || h.pending == 0 {
+		h.mu.Unlock()
+		return
+	}
+	summary := h.summary(h.Clock.Now())
+	h.mu.Unlock()
+
+	if err := h.handler.HandleLog(summary); err != nil {
+		stdlog.Printf("log/ratelimit: failed to report suppressed logs: %s", err)
+	}
+}
+
+// keyBucket returns the bucket of the key, evicting the least recently used
+// one if needed. h.mu must be held.
+func (h *Handler) keyBucket(key string) *bucket {
+	if el, ok := h.keys[key]; ok {
+		h.lru.MoveToFront(el)
+		return el.Value.(*keyBucket).bucket
+	}
+
+	if h.lru.Len() >= h.MaxKeys {
+		oldest := h.lru.Back()
+		h.lru.Remove(oldest)
+		delete(h.keys, oldest.Value.(*keyBucket).key)
+	}
+	b := &keyBucket{key: key, bucket: newBucket(*h.PerKey)}
+	h.keys[key] = h.lru.PushFront(b)
+	return b.bucket
+}
+
+// summary returns the report of the pending suppressed entries and resets
+// them. h.mu must be held.
+func (h *Handler) summary(now time.Time) *log.Entry {
+	e := &log.Entry{
+		Level:     log.WarnLevel,
+		Timestamp: now,
+		Message:   fmt.Sprintf("ratelimit: suppressed %d logs", h.pending),
+		Fields: log.Fields{
+			{Name: "suppressed", Value: h.pending},
+			{Name: "levels", Value: h.byLevel},
+		},
+	}
+	if h.Key != "" {
+		e.Fields = append(e.Fields,
+			&log.Field{Name: "key", Value: h.Key},
+			&log.Field{Name: "keys", Value: h.byKey},
+			&log.Field{Name: "other_keys", Value: h.otherKeys})
+	}
+
+	if h.timer != nil {
+		h.timer.Stop()
+		h.timer = nil
+	}
+	h.gen++
+	h.pending = 0
+	h.byLevel = make(map[string]uint64)
+	h.byKey = make(map[string]uint64)
+	h.otherKeys = 0
+	return e
+}
+
+// Suppressed returns the number of entries suppressed so far.
+func (h *Handler) Suppressed() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.suppressed
+}
+
+// Close reports the suppressed entries not reported yet, then closes the
+// wrapped handler if it implements Close() error.
+func (h *Handler) Close() error {
+	h.mu.Lock()
+	h.closed = true
+	var summary *log.Entry
+	if h.pending > 0 {
+		summary = h.summary(h.Clock.Now())
+	}
+	h.mu.Unlock()
+
+	var err error
+	if summary != nil {
+		err = h.handler.HandleLog(summary)
+	}
+	if c, ok := h.handler.(interface{ Close() error }); ok {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
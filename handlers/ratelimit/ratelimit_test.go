@@ -0,0 +1,198 @@
+package ratelimit_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/eluv-io/apexlog-go"
+	"github.com/eluv-io/apexlog-go/handlers/memory"
+	"github.com/eluv-io/apexlog-go/handlers/ratelimit"
+	"github.com/eluv-io/apexlog-go/logtest"
+)
+
+func TestHandler_global(t *testing.T) {
+	mem := memory.New()
+	clock := logtest.NewClock(logtest.Timestamp)
+	h := ratelimit.New(mem, &ratelimit.Config{
+		Global:         &ratelimit.Limit{Rate: 2},
+		ReportInterval: 10 * time.Second,
+		Clock:          clock,
+	})
+	l := &log.Logger{Handler: h, Level: log.InfoLevel, Clock: clock}
+
+	for _, msg := range []string{"a", "b", "c", "d"} {
+		l.Info(msg)
+	}
+	assert.Equal(t, []string{"a", "b"}, mem.Messages())
+
+	// refilled at Rate
+	clock.Add(500 * time.Millisecond)
+	l.Info("e")
+	l.Info("f")
+	assert.Equal(t, []string{"a", "b", "e"}, mem.Messages())
+	assert.Equal(t, uint64(3), h.Suppressed())
+
+	// reported once the interval elapsed
+	clock.Add(10 * time.Second)
+	l.Error("g")
+	assert.Equal(t, []string{"a", "b", "e", "ratelimit: suppressed 3 logs", "g"}, mem.Messages())
+	summary := mem.Snapshot()[3]
+	assert.Equal(t, log.WarnLevel, summary.Level)
+	assert.Equal(t, uint64(3), summary.Fields.Get("suppressed"))
+	assert.Equal(t, map[string]uint64{"info": 3}, summary.Fields.Get("levels"))
+
+	// nothing left to report
+	require.NoError(t, h.Close())
+	assert.Equal(t, 5, mem.Len())
+}
+
+func TestHandler_levels(t *testing.T) {
+	mem := memory.New()
+	h := ratelimit.New(mem, &ratelimit.Config{
+		Levels: map[log.Level]ratelimit.Limit{log.ErrorLevel: {Rate: 1, Burst: 2}},
+		Clock:  logtest.NewClock(logtest.Timestamp),
+	})
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, h.HandleLog(&log.Entry{Level: log.ErrorLevel, Message: "error"}))
+		require.NoError(t, h.HandleLog(&log.Entry{Level: log.InfoLevel, Message: "info"}))
+	}
+	assert.Equal(t, []string{"error", "info", "error", "info", "info"}, mem.Messages())
+
+	require.NoError(t, h.Close())
+	summary := mem.Snapshot()[5]
+	assert.Equal(t, "ratelimit: suppressed 1 logs", summary.Message)
+	assert.Equal(t, map[string]uint64{"error": 1}, summary.Fields.Get("levels"))
+}
+
+func TestHandler_perKey(t *testing.T) {
+	mem := memory.New()
+	h := ratelimit.New(mem, &ratelimit.Config{
+		Key:     "tenant",
+		PerKey:  &ratelimit.Limit{Rate: 1},
+		MaxKeys: 2,
+		Clock:   logtest.NewClock(logtest.Timestamp),
+	})
+	l := &log.Logger{Handler: h, Level: log.InfoLevel}
+
+	l.Info("a1", "tenant", "a")
+	l.Info("a2", "tenant", "a")
+	l.Info("b1", "tenant", "b")
+	l.Info("b2", "tenant", "b")
+	l.Info("none")
+	l.Info("none")
+	assert.Equal(t, []string{"a1", "b1", "none", "none"}, mem.Messages())
+
+	// the least recently used key is evicted beyond MaxKeys
+	l.Info("c1", "tenant", "c")
+	l.Info("a3", "tenant", "a")
+	assert.Equal(t, []string{"a1", "b1", "none", "none", "c1", "a3"}, mem.Messages())
+
+	require.NoError(t, h.Close())
+	summary := mem.Snapshot()[6]
+	assert.Equal(t, "tenant", summary.Fields.Get("key"))
+	assert.Equal(t, map[string]uint64{"a": 1, "b": 1}, summary.Fields.Get("keys"))
+}
+
+func TestHandler_bytes(t *testing.T) {
+	mem := memory.New()
+	clock := logtest.NewClock(logtest.Timestamp)
+	e := &log.Entry{Level: log.InfoLevel, Message: "hello", Timestamp: logtest.Timestamp}
+	size := len(`{"fields":{},"level":"info","timestamp":"2020-01-02T03:04:05Z","message":"hello"}`)
+	h := ratelimit.New(mem, &ratelimit.Config{
+		Bytes:    2 * size,
+		Interval: time.Minute,
+		Clock:    clock,
+	})
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, h.HandleLog(e))
+	}
+	assert.Equal(t, 2, mem.Len())
+
+	clock.Add(30 * time.Second)
+	require.NoError(t, h.HandleLog(e))
+	require.NoError(t, h.HandleLog(e))
+	assert.Equal(t, 3, mem.Len())
+	assert.Equal(t, uint64(2), h.Suppressed())
+
+	// entries larger than Bytes pass with the full budget only
+	mem = memory.New()
+	h = ratelimit.New(mem, &ratelimit.Config{
+		Bytes:          size / 2,
+		Interval:       time.Minute,
+		ReportInterval: time.Hour,
+		Clock:          clock,
+	})
+	require.NoError(t, h.HandleLog(e))
+	require.NoError(t, h.HandleLog(e))
+	assert.Equal(t, 1, mem.Len())
+
+	clock.Add(time.Minute)
+	require.NoError(t, h.HandleLog(e))
+	assert.Equal(t, 1, mem.Len())
+	clock.Add(2 * time.Minute)
+	require.NoError(t, h.HandleLog(e))
+	assert.Equal(t, 2, mem.Len())
+}
+
+func TestHandler_reportTimer(t *testing.T) {
+	mem := memory.New()
+	clock := logtest.NewClock(logtest.Timestamp)
+	h := ratelimit.New(mem, &ratelimit.Config{
+		Key:            "tenant",
+		PerKey:         &ratelimit.Limit{Rate: 1},
+		MaxKeys:        1,
+		ReportInterval: time.Minute,
+		Clock:          clock,
+	})
+	l := &log.Logger{Handler: h, Level: log.InfoLevel}
+
+	for _, tenant := range []string{"a", "a", "a", "b", "b"} {
+		l.Info(tenant, "tenant", tenant)
+	}
+	assert.Equal(t, []string{"a", "b"}, mem.Messages())
+
+	// reported without further entries, keys beyond MaxKeys counted apart
+	clock.Add(59 * time.Second)
+	assert.Equal(t, 2, mem.Len())
+	clock.Add(time.Second)
+	require.Equal(t, 3, mem.Len())
+	summary := mem.Snapshot()[2]
+	assert.Equal(t, "ratelimit: suppressed 3 logs", summary.Message)
+	assert.Equal(t, map[string]uint64{"a": 2}, summary.Fields.Get("keys"))
+	assert.Equal(t, uint64(1), summary.Fields.Get("other_keys"))
+
+	require.NoError(t, h.Close())
+	assert.Equal(t, 3, mem.Len())
+}
+
+// countingEncoder counts the encoded entries.
+type countingEncoder struct {
+	log.JSONEncoder
+	n int
+}
+
+func (c *countingEncoder) AppendEntry(dst []byte, e *log.Entry) ([]byte, error) {
+	c.n++
+	return c.JSONEncoder.AppendEntry(dst, e)
+}
+
+func TestHandler_bytesEncoding(t *testing.T) {
+	enc := &countingEncoder{}
+	h := ratelimit.New(memory.New(), &ratelimit.Config{
+		Global:  &ratelimit.Limit{Rate: 1},
+		Bytes:   1 << 20,
+		Encoder: enc,
+		Clock:   logtest.NewClock(logtest.Timestamp),
+	})
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, h.HandleLog(&log.Entry{Level: log.InfoLevel, Message: "hello"}))
+	}
+	assert.Equal(t, uint64(2), h.Suppressed())
+	assert.Equal(t, 1, enc.n)
+}
@@ -0,0 +1,144 @@
+// Package route implements a handler passing entries to handlers based on
+// rules over their level, message and fields:
+//
+//	h, err := route.New(&route.Config{
+//		Rules: []*route.Rule{
+//			{Fields: map[string]string{"audit": "true"}, Handler: auditHandler},
+//			{Fields: map[string]string{"component": "db"}, Handler: dbHandler},
+//		},
+//		Default: defaultHandler,
+//	})
+//
+// Entries are passed to the handler of the first matching rule, or to the
+// handlers of all matching rules in the AllMatches mode. Entries matching no
+// rule are passed to the Default handler.
+package route
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/eluv-io/apexlog-go"
+	"github.com/eluv-io/apexlog-go/handlers/multi"
+)
+
+// Mode is the way rules are applied.
+type Mode int
+
+// Modes.
+const (
+	FirstMatch Mode = iota // FirstMatch passes entries to the handler of the first matching rule
+	AllMatches             // AllMatches passes entries to the handlers of all matching rules
+)
+
+// Rule passes the entries matching all its conditions to its handler. A rule
+// without conditions matches all entries.
+type Rule struct {
+	Level   log.Level               // Level is the min level of matched entries
+	Prefix  string                  // Prefix matches messages starting with it
+	Regexp  *regexp.Regexp          // Regexp matches messages
+	Has     []string                // Has are the names of fields matched entries have
+	Fields  map[string]string       // Fields are the values of fields of matched entries, compared to values formatted with fmt.Sprint
+	Match   func(e *log.Entry) bool // Match is a custom condition
+	Handler log.Handler             // Handler is passed the matched entries
+}
+
+// Matches returns true if the entry matches the rule.
+func (r *Rule) Matches(e *log.Entry) bool {
+	if e.Level < r.Level {
+		return false
+	}
+
+	if r.Prefix != "" && !strings.HasPrefix(e.Message, r.Prefix) {
+		return false
+	}
+
+	if r.Regexp != nil && !r.Regexp.MatchString(e.Message) {
+		return false
+	}
+
+	for _, name := range r.Has {
+		if _, ok := lookup(e.Fields, name); !ok {
+			return false
+		}
+	}
+
+	for name, value := range r.Fields {
+		v, ok := lookup(e.Fields, name)
+		if !ok || fmt.Sprint(v) != value {
+			return false
+		}
+	}
+
+	return r.Match == nil || r.Match(e)
+}
+
+// lookup returns the value of the field and true, or false if the field
+// doesn't exist.
+func lookup(fields log.Fields, name string) (interface{}, bool) {
+	for _, f := range fields {
+		if f.Name == name {
+			return f.Value, true
+		}
+	}
+	return nil, false
+}
+
+// Config for handler.
+type Config struct {
+	Rules   []*Rule     // Rules are applied in order
+	Mode    Mode        // Mode is the way rules are applied (default: FirstMatch)
+	Default log.Handler // Default is passed the entries matching no rule, nil to drop them
+}
+
+// Handler implementation.
+type Handler struct {
+	*Config
+}
+
+// New handler. The config may be nil, entries are then dropped. It returns
+// an error if a rule has no handler.
+func New(config *Config) (*Handler, error) {
+	if config == nil {
+		config = &Config{}
+	}
+
+	for i, r := range config.Rules {
+		if r == nil || r.Handler == nil {
+			return nil, fmt.Errorf("route: rule %d has no handler", i)
+		}
+	}
+
+	return &Handler{
+		Config: config,
+	}, nil
+}
+
+// HandleLog implements log.Handler. In the AllMatches mode, the errors of the
+// handlers are aggregated in multi.Errors.
+func (h *Handler) HandleLog(e *log.Entry) error {
+	matched := false
+	var errs multi.Errors
+	for _, r := range h.Rules {
+		if !r.Matches(e) {
+			continue
+		}
+		if h.Mode == FirstMatch {
+			return r.Handler.HandleLog(e)
+		}
+		matched = true
+		if err := r.Handler.HandleLog(e); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if !matched && h.Default != nil {
+		return h.Default.HandleLog(e)
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package route_test
+
+import (
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/eluv-io/apexlog-go"
+	"github.com/eluv-io/apexlog-go/handlers/memory"
+	"github.com/eluv-io/apexlog-go/handlers/multi"
+	"github.com/eluv-io/apexlog-go/handlers/route"
+)
+
+func TestRule_Matches(t *testing.T) {
+	e := &log.Entry{
+		Level:   log.WarnLevel,
+		Message: "db: slow query",
+		Fields:  log.Fields{{Name: "audit", Value: true}, {Name: "ms", Value: 120}, {Name: "user", Value: nil}},
+	}
+	for _, c := range []struct {
+		rule    route.Rule
+		matches bool
+	}{
+		{route.Rule{}, true},
+		{route.Rule{Level: log.WarnLevel}, true},
+		{route.Rule{Level: log.ErrorLevel}, false},
+		{route.Rule{Prefix: "db:"}, true},
+		{route.Rule{Prefix: "http:"}, false},
+		{route.Rule{Regexp: regexp.MustCompile(`slow \w+$`)}, true},
+		{route.Rule{Regexp: regexp.MustCompile(`^slow`)}, false},
+		{route.Rule{Has: []string{"user", "ms"}}, true},
+		{route.Rule{Has: []string{"user", "id"}}, false},
+		{route.Rule{Fields: map[string]string{"audit": "true", "ms": "120"}}, true},
+		{route.Rule{Fields: map[string]string{"audit": "false"}}, false},
+		{route.Rule{Fields: map[string]string{"id": ""}}, false},
+		{route.Rule{Prefix: "db:", Level: log.ErrorLevel}, false},
+		{route.Rule{Match: func(e *log.Entry) bool { return len(e.Fields) == 3 }}, true},
+		{route.Rule{Match: func(e *log.Entry) bool { return false }}, false},
+	} {
+		assert.Equal(t, c.matches, c.rule.Matches(e), "%+v", c.rule)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	audit, db, def := memory.New(), memory.New(), memory.New()
+	h, err := route.New(&route.Config{
+		Rules: []*route.Rule{
+			{Fields: map[string]string{"audit": "true"}, Handler: audit},
+			{Fields: map[string]string{"component": "db"}, Handler: db},
+		},
+		Default: def,
+	})
+	require.NoError(t, err)
+
+	l := &log.Logger{Handler: h, Level: log.InfoLevel}
+	l.Info("login", "audit", true)
+	l.Info("query", "component", "db")
+	l.Info("dropped table", "component", "db", "audit", "true")
+	l.Info("hello")
+
+	assert.Equal(t, []string{"login", "dropped table"}, audit.Messages())
+	assert.Equal(t, []string{"query"}, db.Messages())
+	assert.Equal(t, []string{"hello"}, def.Messages())
+
+	// without default, unmatched entries are dropped
+	h.Default = nil
+	l.Info("dropped")
+	assert.Equal(t, 1, def.Len())
+}
+
+func TestHandler_allMatches(t *testing.T) {
+	audit, db, def := memory.New(), memory.New(), memory.New()
+	errA := errors.New("a")
+	h, err := route.New(&route.Config{
+		Rules: []*route.Rule{
+			{Fields: map[string]string{"audit": "true"}, Handler: audit},
+			{Fields: map[string]string{"component": "db"}, Handler: db},
+			{Level: log.ErrorLevel, Handler: log.HandlerFunc(func(*log.Entry) error { return errA })},
+		},
+		Mode:    route.AllMatches,
+		Default: def,
+	})
+	require.NoError(t, err)
+
+	l := &log.Logger{Handler: h, Level: log.InfoLevel}
+	l.Info("dropped table", "component", "db", "audit", true)
+	l.Info("hello")
+	assert.Equal(t, []string{"dropped table"}, audit.Messages())
+	assert.Equal(t, []string{"dropped table"}, db.Messages())
+	assert.Equal(t, []string{"hello"}, def.Messages())
+
+	err = h.HandleLog(&log.Entry{Level: log.ErrorLevel, Fields: log.Fields{{Name: "audit", Value: true}}})
+	assert.Equal(t, multi.Errors{errA}, err)
+	assert.Equal(t, 2, audit.Len())
+	assert.Equal(t, 1, def.Len())
+}
+
+func TestNew(t *testing.T) {
+	h, err := route.New(nil)
+	require.NoError(t, err)
+	assert.NoError(t, h.HandleLog(&log.Entry{Message: "dropped"}))
+
+	_, err = route.New(&route.Config{Rules: []*route.Rule{{Handler: memory.New()}, {Level: log.ErrorLevel}}})
+	assert.EqualError(t, err, "route: rule 1 has no handler")
+}
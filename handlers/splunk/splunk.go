@@ -0,0 +1,409 @@
+// Package splunk implements a handler sending batches of entries to the
+// Splunk HTTP Event Collector (HEC).
+//
+// Each entry is sent as an event holding the message and the level, with its
+// fields in the "fields" object for indexed extraction. Batches are posted in
+// order by a batch.Handler once BatchSize entries or BatchBytes bytes are
+// pending, or every FlushInterval. With UseAck, each batch is sent again until
+// the indexer acknowledges it.
+package splunk
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	stdlog "log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eluv-io/apexlog-go"
+	"github.com/eluv-io/apexlog-go/handlers/batch"
+)
+
+// ErrClosed is returned when logging to a closed handler.
+var ErrClosed = errors.New("splunk: handler closed")
+
+// ErrAckTimeout is returned when a batch wasn't acknowledged within
+// AckTimeout.
+var ErrAckTimeout = errors.New("splunk: ack timeout")
+
+// Config for handler.
+type Config struct {
+	URL             string        // URL is the HEC event endpoint (default: "http://localhost:8088/services/collector/event")
+	Token           string        // Token is the HEC token
+	Client          *http.Client  // Client is the HTTP client (default: client with a 10s timeout)
+	Index           string        // Index of the events, the default index of the token if empty
+	Source          string        // Source of the events, the default source of the token if empty
+	Sourcetype      string        // Sourcetype of the events, the default sourcetype of the token if empty
+	Host            string        // Host of the events (default: os.Hostname())
+	Gzip            bool          // Gzip compresses request bodies
+	UseAck          bool          // UseAck waits for the indexer acknowledgement of each batch, the token must have acks enabled
+	Channel         string        // Channel is the request channel, required with UseAck (default: a random channel)
+	AckTimeout      time.Duration // AckTimeout is the max time to wait for an ack before sending the batch again (default: 1m)
+	AckPollInterval time.Duration // AckPollInterval is the delay between ack queries (default: 1s)
+	BatchSize       int           // BatchSize is the number of entries to buffer before sending (default: 100)
+	BatchBytes      int           // BatchBytes is the size of events to buffer before sending (default: 1MiB)
+	FlushInterval   time.Duration // FlushInterval is the max time entries are buffered (default: 1s)
+	Retries         int           // Retries is the number of retries of failed requests (default: 5)
+	RetryBackoff    time.Duration // RetryBackoff is the delay before the first retry, doubled for each retry (default: 500ms)
+}
+
+// defaults applies defaults to the config.
+func (c *Config) defaults() {
+	if c.URL == "" {
+		c.URL = "http://localhost:8088/services/collector/event"
+	}
+
+	if c.Client == nil {
+		c.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	if c.Host == "" {
+		c.Host, _ = os.Hostname()
+	}
+
+	if c.UseAck && c.Channel == "" {
+		c.Channel = newChannel()
+	}
+
+	if c.AckTimeout == 0 {
+		c.AckTimeout = time.Minute
+	}
+
+	if c.AckPollInterval == 0 {
+		c.AckPollInterval = time.Second
+	}
+
+	if c.BatchSize == 0 {
+		c.BatchSize = 100
+	}
+
+	if c.BatchBytes == 0 {
+		c.BatchBytes = 1 << 20
+	}
+
+	if c.FlushInterval == 0 {
+		c.FlushInterval = time.Second
+	}
+
+	if c.Retries == 0 {
+		c.Retries = 5
+	}
+
+	if c.RetryBackoff == 0 {
+		c.RetryBackoff = 500 * time.Millisecond
+	}
+}
+
+// Handler implementation.
+type Handler struct {
+	*Config
+	batch *batch.Handler
+}
+
+// New handler.
+func New(config *Config) *Handler {
+	config.defaults()
+	s := &sink{Config: config, ackURL: ackURL(config.URL)}
+	s.meta = s.appendMeta(nil)
+	return &Handler{
+		Config: config,
+		batch: batch.New(s, &batch.Config{
+			BatchSize:     config.BatchSize,
+			BatchBytes:    config.BatchBytes,
+			FlushInterval: config.FlushInterval,
+			OnError: func(err error, events []batch.Record) {
+				stdlog.Printf("log/splunk: failed to send %d logs: %s", len(events), err)
+			},
+		}),
+	}
+}
+
+// HandleLog implements log.Handler.
+func (h *Handler) HandleLog(e *log.Entry) error {
+	err := h.batch.HandleLog(e)
+	if err == batch.ErrClosed {
+		return ErrClosed
+	}
+	return err
+}
+
+// Flush sends the pending entries and waits until all batches were sent.
+func (h *Handler) Flush() error {
+	return h.batch.Flush()
+}
+
+// Close flushes the handler. Entries logged afterwards are rejected with
+// ErrClosed.
+func (h *Handler) Close() error {
+	return h.batch.Close()
+}
+
+// sink implements batch.BatchSink.
+type sink struct {
+	*Config
+
+	meta   []byte // meta are the encoded metadata keys common to all events
+	ackURL string
+}
+
+// Encode implements batch.BatchSink, encoding the entry as an event.
+func (s *sink) Encode(e *log.Entry) (batch.Record, error) {
+	event, err := s.appendEvent(nil, e)
+	if err != nil {
+		return batch.Record{}, err
+	}
+	return batch.Record{Data: event}, nil
+}
+
+// Send implements batch.BatchSink, sending the concatenated events.
+func (s *sink) Send(events []batch.Record) error {
+	var b []byte
+	for _, e := range events {
+		b = append(b, e.Data...)
+	}
+	return s.send(b)
+}
+
+// send sends the events in a single request, retrying on failures. With
+// UseAck, it then waits for the acknowledgement of the batch and sends it
+// again if it doesn't come.
+func (s *sink) send(events []byte) error {
+	body := events
+	if s.Gzip {
+		var gz bytes.Buffer
+		w := gzip.NewWriter(&gz)
+		_, _ = w.Write(events)
+		_ = w.Close()
+		body = gz.Bytes()
+	}
+
+	backoff := s.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		retry, err := s.post(body)
+		if err == nil || !retry || attempt >= s.Retries {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// response is the body of HEC responses.
+type response struct {
+	Text  string `json:"text"`
+	Code  int    `json:"code"`
+	AckID *int64 `json:"ackId"`
+}
+
+// post posts the body to the event endpoint and waits for its ack if
+// required. It returns whether the request should be retried if it failed.
+func (s *sink) post(body []byte) (retry bool, err error) {
+	req, err := s.newRequest(s.URL, body)
+	if err != nil {
+		return false, err
+	}
+	if s.Gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+
+	var res response
+	retry, err = s.do(req, &res)
+	if err != nil || !s.UseAck {
+		return retry, err
+	}
+
+	if res.AckID == nil {
+		return false, errors.New("splunk: acks are not enabled for the token")
+	}
+	if err := s.waitAck(*res.AckID); err != nil {
+		return true, err
+	}
+	return false, nil
+}
+
+// waitAck polls the ack endpoint until the given ack is true or AckTimeout
+// elapsed.
+func (s *sink) waitAck(id int64) error {
+	body := []byte(`{"acks":[` + strconv.FormatInt(id, 10) + `]}`)
+	deadline := time.Now().Add(s.AckTimeout)
+
+	for {
+		req, err := s.newRequest(s.ackURL, body)
+		if err != nil {
+			return err
+		}
+
+		var res struct {
+			Acks map[string]bool `json:"acks"`
+		}
+		if _, err := s.do(req, &res); err != nil {
+			return err
+		}
+		if res.Acks[strconv.FormatInt(id, 10)] {
+			return nil
+		}
+
+		if time.Now().Add(s.AckPollInterval).After(deadline) {
+			return ErrAckTimeout
+		}
+		time.Sleep(s.AckPollInterval)
+	}
+}
+
+// newRequest returns a request posting the body to the given URL with the
+// authentication and channel headers.
+func (s *sink) newRequest(url string, body []byte) (*http.Request, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if s.Token != "" {
+		req.Header.Set("Authorization", "Splunk "+s.Token)
+	}
+	if s.Channel != "" {
+		req.Header.Set("X-Splunk-Request-Channel", s.Channel)
+	}
+	return req, nil
+}
+
+// do sends the request and decodes the response body into v. It returns
+// whether the request should be retried if it failed: on network errors,
+// 429 - the server is busy - and 5xx responses.
+func (s *sink) do(req *http.Request, v interface{}) (retry bool, err error) {
+	res, err := s.Client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer res.Body.Close()
+	msg, err := ioutil.ReadAll(io.LimitReader(res.Body, 64<<10))
+	if err != nil {
+		return true, err
+	}
+
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		if err := json.Unmarshal(msg, v); err != nil {
+			return false, fmt.Errorf("splunk: invalid response from %s: %s", req.URL, err)
+		}
+		return false, nil
+	}
+
+	var hec response
+	if json.Unmarshal(msg, &hec) == nil && hec.Text != "" {
+		err = fmt.Errorf("splunk: %s responded with %s: %s (code %d)", req.URL, res.Status, hec.Text, hec.Code)
+	} else {
+		err = fmt.Errorf("splunk: %s responded with %s: %s", req.URL, res.Status, strings.TrimSpace(string(msg)))
+	}
+	return res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500, err
+}
+
+// appendMeta appends the metadata keys of the config.
+func (s *sink) appendMeta(dst []byte) []byte {
+	var js log.JSONEncoder
+	for _, kv := range [][2]string{
+		{"host", s.Host},
+		{"source", s.Source},
+		{"sourcetype", s.Sourcetype},
+		{"index", s.Index},
+	} {
+		if kv[1] == "" {
+			continue
+		}
+		dst = append(dst, ',')
+		dst = js.AppendKey(dst, kv[0])
+		dst = js.AppendString(dst, kv[1])
+	}
+	return dst
+}
+
+// appendEvent appends the entry as an event: its timestamp in epoch seconds,
+// the metadata, the message and level as event data and the fields as
+// indexed fields.
+func (s *sink) appendEvent(dst []byte, e *log.Entry) ([]byte, error) {
+	var js log.JSONEncoder
+
+	dst = append(dst, `{"time":`...)
+	dst = appendTime(dst, e.Timestamp)
+	dst = append(dst, s.meta...)
+	dst = append(dst, `,"event":{"message":`...)
+	dst = js.AppendString(dst, e.Message)
+	dst = append(dst, `,"level":"`...)
+	dst = append(dst, e.Level.String()...)
+	dst = append(dst, `"}`...)
+
+	if len(e.Fields) > 0 {
+		dst = append(dst, `,"fields":{`...)
+		for i, f := range e.Fields {
+			if i > 0 {
+				dst = append(dst, ',')
+			}
+			dst = js.AppendKey(dst, f.Name)
+			var err error
+			if dst, err = appendField(dst, f.Value); err != nil {
+				return nil, err
+			}
+		}
+		dst = append(dst, '}')
+	}
+
+	return append(dst, '}'), nil
+}
+
+// appendField appends the value of an indexed field. Indexed fields must be
+// flat: objects and arrays are sent as their JSON encoding in a string.
+func appendField(dst []byte, v interface{}) ([]byte, error) {
+	var js log.JSONEncoder
+	if err, ok := v.(error); ok {
+		return js.AppendString(dst, err.Error()), nil
+	}
+
+	n := len(dst)
+	dst, err := js.AppendValue(dst, v)
+	if err != nil {
+		return nil, err
+	}
+	if n < len(dst) && (dst[n] == '{' || dst[n] == '[') {
+		value := string(dst[n:])
+		dst = js.AppendString(dst[:n], value)
+	}
+	return dst, nil
+}
+
+// appendTime appends the time in epoch seconds, with nanoseconds as the
+// fractional part.
+func appendTime(dst []byte, t time.Time) []byte {
+	dst = strconv.AppendInt(dst, t.Unix(), 10)
+	nsec := t.Nanosecond()
+	if nsec == 0 {
+		return dst
+	}
+	frac := strconv.AppendInt(nil, int64(nsec)+1e9, 10)[1:] // zero padded to 9 digits
+	return append(append(dst, '.'), bytes.TrimRight(frac, "0")...)
+}
+
+// ackURL returns the URL of the ack endpoint for the given event endpoint.
+func ackURL(url string) string {
+	url = strings.TrimSuffix(url, "/")
+	url = strings.TrimSuffix(url, "/event")
+	url = strings.TrimSuffix(url, "/raw")
+	return url + "/ack"
+}
+
+// newChannel returns a random channel identifier in the GUID format.
+func newChannel() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
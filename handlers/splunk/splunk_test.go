@@ -0,0 +1,325 @@
+package splunk_test
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/eluv-io/apexlog-go"
+	"github.com/eluv-io/apexlog-go/handlers/splunk"
+	"github.com/eluv-io/apexlog-go/logtest"
+)
+
+// collector is a stand-in for the HTTP Event Collector. status returns the
+// status and body of the n-th event request, all requests succeed if nil.
+type collector struct {
+	*httptest.Server
+	status func(n int) (int, string)
+
+	mu       sync.Mutex
+	requests []*http.Request
+	batches  [][]map[string]interface{}
+	acked    map[string]bool // acked are the acks queried so far
+}
+
+func newCollector(t *testing.T, status func(n int) (int, string)) *collector {
+	c := &collector{status: status, acked: make(map[string]bool)}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		if r.URL.Path == "/services/collector/ack" {
+			var req struct {
+				Acks []int `json:"acks"`
+			}
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+			// acks are true from the second query on
+			acks := make(map[string]bool)
+			for _, id := range req.Acks {
+				key := strconv.Itoa(id)
+				acks[key] = c.acked[key]
+				c.acked[key] = true
+			}
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"acks": acks})
+			return
+		}
+
+		var body io.Reader = r.Body
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(r.Body)
+			require.NoError(t, err)
+			body = gz
+		}
+		var events []map[string]interface{}
+		dec := json.NewDecoder(body)
+		dec.UseNumber()
+		for {
+			var event map[string]interface{}
+			err := dec.Decode(&event)
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			events = append(events, event)
+		}
+
+		n := len(c.requests)
+		c.requests = append(c.requests, r)
+		if c.status != nil {
+			if status, body := c.status(n); status != http.StatusOK {
+				w.WriteHeader(status)
+				_, _ = w.Write([]byte(body))
+				return
+			}
+		}
+		c.batches = append(c.batches, events)
+		_, _ = w.Write([]byte(`{"text":"Success","code":0,"ackId":` + strconv.Itoa(len(c.batches)-1) + `}`))
+	}))
+	return c
+}
+
+func (c *collector) received() ([]*http.Request, [][]map[string]interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]*http.Request(nil), c.requests...), append([][]map[string]interface{}(nil), c.batches...)
+}
+
+var ts = time.Date(2020, 1, 2, 3, 4, 5, 6000000, time.UTC)
+
+func newLogger(h log.Handler) *log.Logger {
+	return &log.Logger{
+		Handler: h,
+		Level:   log.InfoLevel,
+		Clock:   logtest.NewClock(ts),
+	}
+}
+
+func TestHandler(t *testing.T) {
+	c := newCollector(t, nil)
+	defer c.Close()
+
+	h := splunk.New(&splunk.Config{
+		URL:           c.URL + "/services/collector/event",
+		Token:         "secret",
+		Index:         "main",
+		Source:        "api",
+		Sourcetype:    "_json",
+		Host:          "web-1",
+		FlushInterval: time.Hour,
+	})
+	l := newLogger(h)
+
+	l.Info("hello",
+		"user", "tj",
+		"count", 3,
+		"error", errors.New("boom"),
+		"nested", log.Fields{{Name: "id", Value: 1}},
+		"tags", []string{"a", "b"})
+	l.Warn("careful")
+	require.NoError(t, h.Close())
+
+	requests, batches := c.received()
+	require.Len(t, requests, 1)
+	assert.Equal(t, "Splunk secret", requests[0].Header.Get("Authorization"))
+	assert.Empty(t, requests[0].Header.Get("X-Splunk-Request-Channel"))
+
+	require.Len(t, batches, 1)
+	require.Len(t, batches[0], 2)
+	assert.Equal(t, map[string]interface{}{
+		"time":       json.Number("1577934245.006"),
+		"host":       "web-1",
+		"source":     "api",
+		"sourcetype": "_json",
+		"index":      "main",
+		"event":      map[string]interface{}{"message": "hello", "level": "info"},
+		"fields": map[string]interface{}{
+			"user":   "tj",
+			"count":  json.Number("3"),
+			"error":  "boom",
+			"nested": `{"id":1}`,
+			"tags":   `["a","b"]`,
+		},
+	}, batches[0][0])
+	assert.Equal(t, map[string]interface{}{"message": "careful", "level": "warn"}, batches[0][1]["event"])
+	assert.NotContains(t, batches[0][1], "fields")
+
+	assert.Equal(t, splunk.ErrClosed, h.HandleLog(&log.Entry{}))
+}
+
+func TestHandler_gzip(t *testing.T) {
+	c := newCollector(t, nil)
+	defer c.Close()
+
+	h := splunk.New(&splunk.Config{
+		URL:           c.URL + "/services/collector/event",
+		Gzip:          true,
+		BatchSize:     2,
+		FlushInterval: time.Hour,
+	})
+	l := newLogger(h)
+
+	for i := 0; i < 5; i++ {
+		l.Info("hello", "i", i)
+	}
+	require.NoError(t, h.Close())
+
+	_, batches := c.received()
+	require.Len(t, batches, 3)
+	assert.Len(t, batches[2], 1)
+	assert.Equal(t, json.Number("4"), batches[2][0]["fields"].(map[string]interface{})["i"])
+}
+
+func TestHandler_interval(t *testing.T) {
+	c := newCollector(t, nil)
+	defer c.Close()
+
+	h := splunk.New(&splunk.Config{
+		URL:           c.URL + "/services/collector/event",
+		FlushInterval: 10 * time.Millisecond,
+	})
+	defer h.Close()
+
+	newLogger(h).Info("hello")
+
+	assert.Eventually(t, func() bool {
+		_, batches := c.received()
+		return len(batches) == 1
+	}, time.Second, time.Millisecond)
+}
+
+func TestHandler_retry(t *testing.T) {
+	c := newCollector(t, func(n int) (int, string) {
+		if n < 2 {
+			return http.StatusServiceUnavailable, `{"text":"Server is busy","code":9}`
+		}
+		return http.StatusOK, ""
+	})
+	defer c.Close()
+
+	h := splunk.New(&splunk.Config{
+		URL:           c.URL + "/services/collector/event",
+		RetryBackoff:  time.Millisecond,
+		FlushInterval: time.Hour,
+	})
+
+	newLogger(h).Info("hello")
+	require.NoError(t, h.Close())
+
+	requests, batches := c.received()
+	assert.Len(t, requests, 3)
+	assert.Len(t, batches, 1)
+}
+
+func TestHandler_error(t *testing.T) {
+	c := newCollector(t, func(int) (int, string) {
+		return http.StatusForbidden, `{"text":"Invalid token","code":4}`
+	})
+	defer c.Close()
+
+	h := splunk.New(&splunk.Config{
+		URL:           c.URL + "/services/collector/event",
+		Token:         "wrong",
+		FlushInterval: time.Hour,
+	})
+
+	newLogger(h).Info("hello")
+	err := h.Flush()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Invalid token (code 4)")
+
+	// not retried
+	requests, _ := c.received()
+	assert.Len(t, requests, 1)
+	require.NoError(t, h.Close())
+}
+
+func TestHandler_ack(t *testing.T) {
+	c := newCollector(t, nil)
+	defer c.Close()
+
+	h := splunk.New(&splunk.Config{
+		URL:             c.URL + "/services/collector/event",
+		UseAck:          true,
+		AckPollInterval: time.Millisecond,
+		FlushInterval:   time.Hour,
+	})
+	l := newLogger(h)
+
+	l.Info("hello")
+	require.NoError(t, h.Flush())
+	l.Info("world")
+	require.NoError(t, h.Close())
+
+	requests, batches := c.received()
+	require.Len(t, batches, 2)
+	assert.Len(t, requests[0].Header.Get("X-Splunk-Request-Channel"), 36)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	assert.Equal(t, map[string]bool{"0": true, "1": true}, c.acked)
+}
+
+func TestHandler_ackTimeout(t *testing.T) {
+	// acks are never true
+	var mu sync.Mutex
+	posts := 0
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(ioutil.Discard, r.Body)
+		if r.URL.Path == "/services/collector/ack" {
+			_, _ = w.Write([]byte(`{"acks":{"0":false}}`))
+			return
+		}
+		mu.Lock()
+		posts++
+		mu.Unlock()
+		_, _ = w.Write([]byte(`{"text":"Success","code":0,"ackId":0}`))
+	}))
+	defer s.Close()
+
+	h := splunk.New(&splunk.Config{
+		URL:             s.URL + "/services/collector/event",
+		UseAck:          true,
+		AckTimeout:      5 * time.Millisecond,
+		AckPollInterval: time.Millisecond,
+		Retries:         1,
+		RetryBackoff:    time.Millisecond,
+		FlushInterval:   time.Hour,
+	})
+
+	newLogger(h).Info("hello")
+	assert.Equal(t, splunk.ErrAckTimeout, h.Close())
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 2, posts)
+}
+
+func TestHandler_ackDisabled(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(ioutil.Discard, r.Body)
+		_, _ = w.Write([]byte(`{"text":"Success","code":0}`))
+	}))
+	defer s.Close()
+
+	h := splunk.New(&splunk.Config{
+		URL:           s.URL + "/services/collector/event",
+		UseAck:        true,
+		FlushInterval: time.Hour,
+	})
+
+	newLogger(h).Info("hello")
+	err := h.Close()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "acks are not enabled")
+}
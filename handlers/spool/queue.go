@@ -0,0 +1,308 @@
+package spool
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	stdlog "log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// segmentSuffix is the suffix of segment files.
+const segmentSuffix = ".seg"
+
+// cursorName is the name of the file holding the read position.
+const cursorName = "cursor"
+
+// headerSize is the size of record headers: the length and the CRC-32 of the
+// payload, big endian.
+const headerSize = 8
+
+// position is a position in the queue.
+type position struct {
+	seq uint64 // seq is the sequence number of the segment
+	off int64  // off is the offset in the segment
+}
+
+// segment is a segment file.
+type segment struct {
+	seq  uint64
+	size int64
+}
+
+// queue is a FIFO queue of records persisted in segment files of a
+// directory. Records are appended to the last segment - a new one is created
+// beyond segmentSize and on startup - and read from the cursor, persisted in
+// a file so that delivered records aren't replayed after a restart. Segments
+// are removed once fully read.
+type queue struct {
+	dir         string
+	segmentSize int64
+	maxSize     int64
+
+	mu       sync.Mutex
+	segments []segment // segments are oldest first, the cursor is in the first one
+	total    int64     // total is the size of the segments
+	cursor   position
+	w        *os.File // w is the last segment, opened on the first append
+	closed   bool
+}
+
+// openQueue opens the queue of the directory, creating it if needed.
+func openQueue(dir string, segmentSize, maxSize int64) (*queue, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	q := &queue{dir: dir, segmentSize: segmentSize, maxSize: maxSize}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		var seq uint64
+		name := info.Name()
+		if info.IsDir() || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		if _, err := fmt.Sscanf(strings.TrimSuffix(name, segmentSuffix), "%d", &seq); err != nil {
+			continue
+		}
+		q.segments = append(q.segments, segment{seq: seq, size: info.Size()})
+	}
+	sort.Slice(q.segments, func(i, j int) bool {
+		return q.segments[i].seq < q.segments[j].seq
+	})
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, cursorName))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if _, err := fmt.Sscanf(string(b), "%d %d", &q.cursor.seq, &q.cursor.off); err != nil {
+			return nil, fmt.Errorf("spool: invalid cursor: %s", err)
+		}
+	}
+
+	// segments before the cursor were read
+	for len(q.segments) > 0 && q.segments[0].seq < q.cursor.seq {
+		if err := q.remove(); err != nil {
+			return nil, err
+		}
+	}
+	for _, s := range q.segments {
+		q.total += s.size
+	}
+	if len(q.segments) > 0 && q.segments[0].seq != q.cursor.seq {
+		q.cursor = position{seq: q.segments[0].seq}
+	}
+	return q, nil
+}
+
+// path returns the path of the segment.
+func (q *queue) path(seq uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%s", seq, segmentSuffix))
+}
+
+// remove removes the first segment.
+func (q *queue) remove() error {
+	s := q.segments[0]
+	if err := os.Remove(q.path(s.seq)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	q.segments = q.segments[1:]
+	q.total -= s.size
+	return nil
+}
+
+// state returns whether all records were read and whether the queue is
+// closed.
+func (q *queue) state() (empty, closed bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.total-q.cursor.off <= 0, q.closed
+}
+
+// pending returns the size of the records not read yet.
+func (q *queue) pending() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.total - q.cursor.off
+}
+
+// append appends the records, or returns ErrFull if they would make the
+// queue exceed maxSize.
+func (q *queue) append(payloads [][]byte) error {
+	var buf []byte
+	for _, p := range payloads {
+		var header [headerSize]byte
+		binary.BigEndian.PutUint32(header[:4], uint32(len(p)))
+		binary.BigEndian.PutUint32(header[4:], crc32.ChecksumIEEE(p))
+		buf = append(buf, header[:]...)
+		buf = append(buf, p...)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return ErrClosed
+	}
+	if q.maxSize > 0 && q.total+int64(len(buf)) > q.maxSize {
+		return ErrFull
+	}
+
+	last := len(q.segments) - 1
+	if q.w == nil || q.segments[last].size >= q.segmentSize {
+		if err := q.create(); err != nil {
+			return err
+		}
+		last = len(q.segments) - 1
+	}
+
+	n, err := q.w.Write(buf)
+	q.segments[last].size += int64(n)
+	q.total += int64(n)
+	return err
+}
+
+// create creates a new last segment.
+func (q *queue) create() error {
+	seq := q.cursor.seq
+	if len(q.segments) > 0 {
+		seq = q.segments[len(q.segments)-1].seq + 1
+	}
+	if seq == 0 {
+		seq = 1
+	}
+
+	f, err := os.OpenFile(q.path(seq), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if q.w != nil {
+		_ = q.w.Close()
+	}
+	q.w = f
+	q.segments = append(q.segments, segment{seq: seq})
+	if len(q.segments) == 1 {
+		q.cursor = position{seq: seq}
+	}
+	return nil
+}
+
+// peek reads up to n records from the cursor, and returns them with the
+// position following them. The rest of a segment holding a corrupt record is
+// skipped.
+func (q *queue) peek(n int) ([][]byte, position, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for {
+		if len(q.segments) == 0 {
+			return nil, q.cursor, nil
+		}
+		s := q.segments[0]
+		if q.cursor.off >= s.size {
+			if len(q.segments) == 1 {
+				return nil, q.cursor, nil
+			}
+			if err := q.remove(); err != nil {
+				return nil, q.cursor, err
+			}
+			q.cursor = position{seq: q.segments[0].seq}
+			continue
+		}
+
+		payloads, next, err := q.read(s, n)
+		if err != nil {
+			return nil, q.cursor, err
+		}
+		if len(payloads) > 0 {
+			return payloads, next, nil
+		}
+		q.cursor = next
+	}
+}
+
+// read reads up to n records of the segment from the cursor.
+func (q *queue) read(s segment, n int) ([][]byte, position, error) {
+	f, err := os.Open(q.path(s.seq))
+	if err != nil {
+		return nil, q.cursor, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(q.cursor.off, io.SeekStart); err != nil {
+		return nil, q.cursor, err
+	}
+
+	r := bufio.NewReader(io.LimitReader(f, s.size-q.cursor.off))
+	next := q.cursor
+	var payloads [][]byte
+	for len(payloads) < n && next.off < s.size {
+		var header [headerSize]byte
+		_, err := io.ReadFull(r, header[:])
+		var p []byte
+		if err == nil {
+			size := int64(binary.BigEndian.Uint32(header[:4]))
+			if size > s.size-next.off-headerSize {
+				size = s.size - next.off // truncated or corrupt length, reported below
+			}
+			p = make([]byte, size)
+			_, err = io.ReadFull(r, p)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF || (err == nil && crc32.ChecksumIEEE(p) != binary.BigEndian.Uint32(header[4:])) {
+			stdlog.Printf("log/spool: skipping %d corrupt bytes of %s", s.size-next.off, q.path(s.seq))
+			next.off = s.size
+			break
+		}
+		if err != nil {
+			return nil, q.cursor, err
+		}
+		payloads = append(payloads, p)
+		next.off += int64(headerSize + len(p))
+	}
+	return payloads, next, nil
+}
+
+// advance moves the cursor to the position returned by peek and persists it.
+func (q *queue) advance(next position) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.cursor = next
+	for len(q.segments) > 1 && q.cursor.off >= q.segments[0].size {
+		if err := q.remove(); err != nil {
+			return err
+		}
+		q.cursor = position{seq: q.segments[0].seq}
+	}
+
+	tmp := filepath.Join(q.dir, cursorName+".tmp")
+	if err := ioutil.WriteFile(tmp, []byte(fmt.Sprintf("%d %d\n", q.cursor.seq, q.cursor.off)), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(q.dir, cursorName))
+}
+
+// close closes the last segment. Records can't be appended afterwards.
+func (q *queue) close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = true
+	if q.w == nil {
+		return nil
+	}
+	err := q.w.Close()
+	q.w = nil
+	return err
+}
@@ -0,0 +1,477 @@
+// Package spool implements wrappers persisting the entries their downstream
+// fails to deliver to an on-disk queue, and replaying them in order once it
+// recovers.
+//
+// New wraps handlers returning delivery errors from HandleLog, such as
+// graylog or papertrail:
+//
+//	h, err := spool.New(graylogHandler, &spool.Config{Dir: "/var/spool/app"})
+//
+// NewSink wraps the sinks of batch handlers such as es, see es.Config.Spool.
+//
+// Entries are appended to segment files of Dir, up to MaxSize bytes: beyond,
+// they are rejected with ErrFull. While entries are spooled, new entries are
+// spooled as well to keep them in order. A goroutine replays the spooled
+// entries, retrying with an exponential backoff, and the spool survives
+// restarts: the entries of a previous process are replayed on startup.
+//
+// Delivery errors are retried until the downstream recovers, the backoff
+// growing up to MaxBackoff. Only poison entries are appended to the
+// DeadLetter file, one per line: entries that can't be decoded, and entries
+// the downstream still rejects after MaxAttempts - see Rejected.
+package spool
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	stdlog "log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/eluv-io/apexlog-go"
+	"github.com/eluv-io/apexlog-go/handlers/batch"
+)
+
+// ErrClosed is returned when logging to a closed handler.
+var ErrClosed = errors.New("spool: handler closed")
+
+// ErrFull is returned when spooling entries would make the spool exceed
+// MaxSize.
+var ErrFull = errors.New("spool: full")
+
+// Config for handler.
+type Config struct {
+	Dir          string        // Dir is the directory of the spool, created if missing
+	SegmentSize  int64         // SegmentSize is the size of segment files beyond which a new one is started (default: 4MiB)
+	MaxSize      int64         // MaxSize is the max size of the segment files (default: 256MiB)
+	DeadLetter   string        // DeadLetter is the file of poison entries (default: "dead-letter.log" in Dir)
+	MaxAttempts  int           // MaxAttempts is the number of replays of rejected entries before they are dead-lettered (default: 10)
+	ReplayBatch  int           // ReplayBatch is the max number of entries replayed at once to a sink (default: 100)
+	RetryBackoff time.Duration // RetryBackoff is the delay before the first retry of a replay, doubled for each retry (default: 1s)
+	MaxBackoff   time.Duration // MaxBackoff is the max delay between retries (default: 1m)
+}
+
+// defaults applies defaults to the config.
+func (c *Config) defaults() {
+	if c.SegmentSize == 0 {
+		c.SegmentSize = 4 << 20
+	}
+
+	if c.MaxSize == 0 {
+		c.MaxSize = 256 << 20
+	}
+
+	if c.DeadLetter == "" {
+		c.DeadLetter = filepath.Join(c.Dir, "dead-letter.log")
+	}
+
+	if c.MaxAttempts == 0 {
+		c.MaxAttempts = 10
+	}
+
+	if c.ReplayBatch == 0 {
+		c.ReplayBatch = 100
+	}
+
+	if c.RetryBackoff == 0 {
+		c.RetryBackoff = time.Second
+	}
+
+	if c.MaxBackoff == 0 {
+		c.MaxBackoff = time.Minute
+	}
+}
+
+// poison is the error of entries that can't be delivered whatever the
+// downstream state.
+type poison struct {
+	error
+}
+
+// rejected is the error of entries rejected by the downstream.
+type rejected struct {
+	error
+}
+
+// Rejected marks err as the rejection of the entries by the downstream, e.g.
+// a mapping error of the document: replayed entries failing with it are
+// dead-lettered after MaxAttempts instead of being retried forever.
+func Rejected(err error) error {
+	return rejected{err}
+}
+
+// spool holds the queue and replays it.
+type spool struct {
+	*Config
+	queue   *queue
+	batch   int                           // batch is the max number of records replayed at once, ReplayBatch if 0
+	deliver func(payloads [][]byte) error // deliver delivers replayed records
+	letter  func(payload []byte) []byte   // letter returns the dead letter of a record
+
+	mu sync.Mutex // mu serializes the choice between delivering and spooling new entries
+
+	wake      chan struct{}
+	done      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+}
+
+// open opens the queue of the directory and starts replaying it.
+func open(config *Config, s *spool) error {
+	if config.Dir == "" {
+		return errors.New("spool: missing directory")
+	}
+	config.defaults()
+	if s.batch == 0 {
+		s.batch = config.ReplayBatch
+	}
+
+	q, err := openQueue(config.Dir, config.SegmentSize, config.MaxSize)
+	if err != nil {
+		return err
+	}
+
+	s.Config = config
+	s.queue = q
+	s.wake = make(chan struct{}, 1)
+	s.done = make(chan struct{})
+	s.stopped = make(chan struct{})
+	go s.loop()
+	return nil
+}
+
+// Pending returns the size of the spooled entries not replayed yet.
+func (s *spool) Pending() int64 {
+	return s.queue.pending()
+}
+
+// handle delivers new entries with send unless entries are spooled, and
+// spools the payloads returned by encode if it fails. The choice is made
+// under s.mu such that entries can't overtake the ones spooled concurrently.
+func (s *spool) handle(send func() error, encode func() ([][]byte, error)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	empty, closed := s.queue.state()
+	if closed {
+		return ErrClosed
+	}
+
+	var cause error
+	if empty {
+		if cause = send(); cause == nil {
+			return nil
+		}
+	}
+
+	payloads, err := encode()
+	if err != nil {
+		return err
+	}
+	return s.add(payloads, cause)
+}
+
+// add appends the records to the queue and wakes up the replay. s.mu must be
+// held by the caller.
+func (s *spool) add(payloads [][]byte, cause error) error {
+	if err := s.queue.append(payloads); err != nil {
+		return err
+	}
+	if cause != nil {
+		stdlog.Printf("log/spool: spooled %d logs: %s", len(payloads), cause)
+	}
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// loop replays the queue until the spool is closed.
+func (s *spool) loop() {
+	defer close(s.stopped)
+
+	backoff := s.RetryBackoff
+	attempts := 0
+	for {
+		payloads, next, err := s.queue.peek(s.batch)
+		if err != nil {
+			stdlog.Printf("log/spool: failed to read spool: %s", err)
+			if !s.sleep(s.MaxBackoff) {
+				return
+			}
+			continue
+		}
+
+		if len(payloads) == 0 {
+			select {
+			case <-s.wake:
+				continue
+			case <-s.done:
+				return
+			}
+		}
+
+		err = s.deliver(payloads)
+		if err != nil {
+			attempts++
+			if retry(err, attempts, s.MaxAttempts) {
+				if !s.sleep(backoff) {
+					return
+				}
+				backoff *= 2
+				if backoff > s.MaxBackoff {
+					backoff = s.MaxBackoff
+				}
+				continue
+			}
+			if err := s.deadLetter(payloads); err != nil {
+				stdlog.Printf("log/spool: failed to write dead letters: %s", err)
+			}
+			stdlog.Printf("log/spool: dead-lettered %d logs: %s", len(payloads), err)
+		}
+
+		attempts = 0
+		backoff = s.RetryBackoff
+		if err := s.queue.advance(next); err != nil {
+			stdlog.Printf("log/spool: failed to save spool cursor: %s", err)
+		}
+	}
+}
+
+// retry returns true if entries failing with err after the given number of
+// attempts must be replayed again: poison entries are never retried,
+// rejected ones up to maxAttempts times, others until they are delivered.
+func retry(err error, attempts, maxAttempts int) bool {
+	if _, ok := err.(poison); ok {
+		return false
+	}
+	var r rejected
+	if errors.As(err, &r) {
+		return attempts < maxAttempts
+	}
+	return true
+}
+
+// sleep sleeps for d and returns true, or returns false if the spool is
+// closed first.
+func (s *spool) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+// deadLetter appends the records to the dead letter file.
+func (s *spool) deadLetter(payloads [][]byte) error {
+	var buf bytes.Buffer
+	for _, p := range payloads {
+		buf.Write(s.letter(p))
+		buf.WriteByte('\n')
+	}
+
+	f, err := os.OpenFile(s.DeadLetter, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf.Bytes())
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// close stops the replay and closes the queue. Spooled entries are replayed
+// by the next process.
+func (s *spool) close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.done)
+		<-s.stopped
+		err = s.queue.close()
+	})
+	return err
+}
+
+// Handler implementation.
+type Handler struct {
+	spool
+	handler log.Handler
+}
+
+// New handler spooling the entries h fails to handle. Entries are spooled as
+// JSON: replayed entries have the fields of the original entries, with
+// values as decoded by encoding/json.
+func New(h log.Handler, config *Config) (*Handler, error) {
+	ret := &Handler{handler: h}
+	ret.batch = 1
+	ret.deliver = ret.replay
+	ret.letter = func(p []byte) []byte { return p }
+	if err := open(config, &ret.spool); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// HandleLog implements log.Handler. The entry is passed to the wrapped
+// handler unless entries are spooled, and spooled if it fails. Entries are
+// passed one at a time, to keep them in order.
+func (h *Handler) HandleLog(e *log.Entry) error {
+	return h.handle(func() error {
+		return h.handler.HandleLog(e)
+	}, func() ([][]byte, error) {
+		b, err := json.Marshal(e)
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{b}, nil
+	})
+}
+
+// replay decodes the spooled entry and passes it to the wrapped handler.
+func (h *Handler) replay(payloads [][]byte) error {
+	e, err := decodeEntry(payloads[0])
+	if err != nil {
+		return poison{err}
+	}
+	return h.handler.HandleLog(e)
+}
+
+// Close stops the replay, then closes the wrapped handler if it implements
+// Close() error.
+func (h *Handler) Close() error {
+	if err := h.spool.close(); err != nil {
+		return err
+	}
+	if c, ok := h.handler.(interface{ Close() error }); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// decodeEntry decodes an entry encoded as tagged in log.Entry, preserving
+// the order of fields.
+func decodeEntry(b []byte) (*log.Entry, error) {
+	var v struct {
+		Fields    json.RawMessage `json:"fields"`
+		Level     log.Level       `json:"level"`
+		Timestamp time.Time       `json:"timestamp"`
+		Message   string          `json:"message"`
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+
+	e := &log.Entry{Level: v.Level, Timestamp: v.Timestamp, Message: v.Message}
+	if len(v.Fields) == 0 || string(v.Fields) == "null" {
+		return e, nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(v.Fields))
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return nil, fmt.Errorf("spool: invalid fields")
+	}
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		var value interface{}
+		if err := dec.Decode(&value); err != nil {
+			return nil, err
+		}
+		e.Fields = append(e.Fields, &log.Field{Name: t.(string), Value: value})
+	}
+	return e, nil
+}
+
+// Sink implements batch.BatchSink, spooling the batches the wrapped sink
+// fails to send.
+type Sink struct {
+	spool
+	sink batch.BatchSink
+}
+
+// NewSink returns a sink spooling the batches s fails to send. Spooled
+// batches are replayed in batches of up to ReplayBatch records.
+func NewSink(s batch.BatchSink, config *Config) (*Sink, error) {
+	ret := &Sink{sink: s}
+	ret.deliver = ret.replay
+	ret.letter = func(p []byte) []byte {
+		if r, err := decodeRecord(p); err == nil {
+			return r.Data
+		}
+		return p
+	}
+	if err := open(config, &ret.spool); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// Encode implements batch.BatchSink.
+func (s *Sink) Encode(e *log.Entry) (batch.Record, error) {
+	return s.sink.Encode(e)
+}
+
+// Send implements batch.BatchSink. The batch is sent to the wrapped sink
+// unless batches are spooled, and spooled if it fails.
+func (s *Sink) Send(records []batch.Record) error {
+	return s.handle(func() error {
+		return s.sink.Send(records)
+	}, func() ([][]byte, error) {
+		payloads := make([][]byte, len(records))
+		for i, r := range records {
+			payloads[i] = encodeRecord(r)
+		}
+		return payloads, nil
+	})
+}
+
+// replay decodes the spooled records and sends them to the wrapped sink.
+func (s *Sink) replay(payloads [][]byte) error {
+	records := make([]batch.Record, len(payloads))
+	for i, p := range payloads {
+		r, err := decodeRecord(p)
+		if err != nil {
+			return poison{err}
+		}
+		records[i] = r
+	}
+	return s.sink.Send(records)
+}
+
+// Close stops the replay. Spooled batches are replayed by the next process.
+func (s *Sink) Close() error {
+	return s.spool.close()
+}
+
+// encodeRecord encodes the record as the length of its key, its key and its
+// data.
+func encodeRecord(r batch.Record) []byte {
+	b := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(r.Key)+len(r.Data))
+	b = b[:binary.PutUvarint(b, uint64(len(r.Key)))]
+	b = append(b, r.Key...)
+	return append(b, r.Data...)
+}
+
+// decodeRecord decodes a record encoded by encodeRecord.
+func decodeRecord(b []byte) (batch.Record, error) {
+	n, size := binary.Uvarint(b)
+	if size <= 0 || n > uint64(len(b)-size) {
+		return batch.Record{}, errors.New("spool: invalid record")
+	}
+	b = b[size:]
+	return batch.Record{Key: string(b[:n]), Data: b[n:]}, nil
+}
@@ -0,0 +1,269 @@
+package spool_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/eluv-io/apexlog-go"
+	"github.com/eluv-io/apexlog-go/handlers/batch"
+	"github.com/eluv-io/apexlog-go/handlers/spool"
+	"github.com/eluv-io/apexlog-go/logtest"
+)
+
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "spool")
+	require.NoError(t, err)
+	return dir, func() { _ = os.RemoveAll(dir) }
+}
+
+// downstream is a handler failing while down, and rejecting messages
+// "poison".
+type downstream struct {
+	mu       sync.Mutex
+	down     bool
+	failures int
+	entries  []*log.Entry
+}
+
+func (d *downstream) HandleLog(e *log.Entry) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if e.Message == "poison" {
+		return spool.Rejected(errors.New("invalid"))
+	}
+	if d.down {
+		d.failures++
+		return errors.New("unavailable")
+	}
+	d.entries = append(d.entries, e.Clone())
+	return nil
+}
+
+func (d *downstream) setDown(down bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.down = down
+}
+
+func (d *downstream) failed() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.failures
+}
+
+func (d *downstream) messages() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var ret []string
+	for _, e := range d.entries {
+		ret = append(ret, e.Message)
+	}
+	return ret
+}
+
+func config(dir string) *spool.Config {
+	return &spool.Config{
+		Dir:          dir,
+		SegmentSize:  100,
+		MaxAttempts:  3,
+		RetryBackoff: time.Millisecond,
+		MaxBackoff:   5 * time.Millisecond,
+	}
+}
+
+func TestHandler(t *testing.T) {
+	dir, done := tempDir(t)
+	defer done()
+
+	d := &downstream{down: true}
+	h, err := spool.New(d, config(dir))
+	require.NoError(t, err)
+
+	l := &log.Logger{Handler: h, Level: log.InfoLevel, Clock: logtest.NewClock(logtest.Timestamp)}
+	var expected []string
+	for i := 0; i < 10; i++ {
+		msg := strconv.Itoa(i)
+		l.Info(msg, "user", "tj", "n", i)
+		expected = append(expected, msg)
+		if i == 5 {
+			d.setDown(false) // later entries are still spooled to keep the order
+		}
+	}
+	require.Eventually(t, func() bool {
+		return h.Pending() == 0
+	}, 5*time.Second, time.Millisecond)
+	assert.Equal(t, expected, d.messages())
+
+	// replayed entries are decoded with their fields
+	e := d.entries[3]
+	assert.Equal(t, log.InfoLevel, e.Level)
+	assert.Equal(t, logtest.Timestamp, e.Timestamp)
+	assert.Equal(t, "tj", e.Fields.Get("user"))
+	assert.Equal(t, float64(3), e.Fields.Get("n"))
+
+	// read segments are removed, but the last one
+	segments, err := filepath.Glob(filepath.Join(dir, "*.seg"))
+	require.NoError(t, err)
+	assert.Len(t, segments, 1)
+
+	// delivered directly once the spool is empty
+	l.Info("direct")
+	assert.Equal(t, "direct", d.messages()[10])
+
+	require.NoError(t, h.Close())
+	assert.Equal(t, spool.ErrClosed, h.HandleLog(&log.Entry{}))
+}
+
+func TestHandler_restart(t *testing.T) {
+	dir, done := tempDir(t)
+	defer done()
+
+	d := &downstream{down: true}
+	h, err := spool.New(d, config(dir))
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		require.NoError(t, h.HandleLog(&log.Entry{Message: strconv.Itoa(i), Level: log.InfoLevel}))
+	}
+	require.NoError(t, h.Close())
+	assert.Empty(t, d.messages())
+
+	d.setDown(false)
+	h, err = spool.New(d, config(dir))
+	require.NoError(t, err)
+	defer h.Close()
+	require.Eventually(t, func() bool {
+		return len(d.messages()) == 2
+	}, 5*time.Second, time.Millisecond)
+	assert.Equal(t, []string{"0", "1"}, d.messages())
+}
+
+func TestHandler_deadLetter(t *testing.T) {
+	dir, done := tempDir(t)
+	defer done()
+
+	d := &downstream{}
+	h, err := spool.New(d, config(dir))
+	require.NoError(t, err)
+	defer h.Close()
+
+	require.NoError(t, h.HandleLog(&log.Entry{Message: "poison", Level: log.ErrorLevel, Timestamp: logtest.Timestamp}))
+	require.NoError(t, h.HandleLog(&log.Entry{Message: "ok", Level: log.InfoLevel}))
+	require.Eventually(t, func() bool {
+		return len(d.messages()) == 1
+	}, 5*time.Second, time.Millisecond)
+	assert.Equal(t, []string{"ok"}, d.messages())
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "dead-letter.log"))
+	require.NoError(t, err)
+	assert.Equal(t, `{"fields":{},"level":"error","timestamp":"2020-01-02T03:04:05Z","message":"poison"}`+"\n", string(b))
+}
+
+func TestHandler_outage(t *testing.T) {
+	dir, done := tempDir(t)
+	defer done()
+
+	d := &downstream{down: true}
+	h, err := spool.New(d, config(dir))
+	require.NoError(t, err)
+	defer h.Close()
+
+	// retried past MaxAttempts until the downstream recovers
+	require.NoError(t, h.HandleLog(&log.Entry{Message: "0", Level: log.InfoLevel}))
+	require.Eventually(t, func() bool {
+		return d.failed() > 2*3
+	}, 5*time.Second, time.Millisecond)
+	assert.Empty(t, d.messages())
+
+	d.setDown(false)
+	require.Eventually(t, func() bool {
+		return len(d.messages()) == 1
+	}, 5*time.Second, time.Millisecond)
+	_, err = os.Stat(filepath.Join(dir, "dead-letter.log"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestHandler_full(t *testing.T) {
+	dir, done := tempDir(t)
+	defer done()
+
+	d := &downstream{down: true}
+	c := config(dir)
+	c.MaxSize = 100
+	h, err := spool.New(d, c)
+	require.NoError(t, err)
+	defer h.Close()
+
+	require.NoError(t, h.HandleLog(&log.Entry{Message: "0", Level: log.InfoLevel}))
+	assert.Equal(t, spool.ErrFull, h.HandleLog(&log.Entry{Message: "1", Level: log.InfoLevel}))
+}
+
+// sink is a batch sink failing while down.
+type sink struct {
+	mu      sync.Mutex
+	down    bool
+	batches [][]string
+}
+
+func (s *sink) Encode(e *log.Entry) (batch.Record, error) {
+	return batch.Record{Key: "k", Data: []byte(e.Message)}, nil
+}
+
+func (s *sink) Send(records []batch.Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.down {
+		return errors.New("unavailable")
+	}
+	var msgs []string
+	for _, r := range records {
+		msgs = append(msgs, r.Key+":"+string(r.Data))
+	}
+	s.batches = append(s.batches, msgs)
+	return nil
+}
+
+func (s *sink) received() [][]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([][]string(nil), s.batches...)
+}
+
+func TestSink(t *testing.T) {
+	dir, done := tempDir(t)
+	defer done()
+
+	down := &sink{down: true}
+	s, err := spool.NewSink(down, config(dir))
+	require.NoError(t, err)
+	h := batch.New(s, &batch.Config{BatchSize: 2})
+
+	l := &log.Logger{Handler: h, Level: log.InfoLevel}
+	for i := 0; i < 4; i++ {
+		l.Info(strconv.Itoa(i))
+	}
+	require.NoError(t, h.Close())
+	require.NoError(t, s.Close())
+
+	// replayed by the next process in batches of ReplayBatch
+	up := &sink{}
+	c := config(dir)
+	c.ReplayBatch = 3
+	s, err = spool.NewSink(up, c)
+	require.NoError(t, err)
+	defer s.Close()
+	require.Eventually(t, func() bool {
+		return len(up.received()) == 2
+	}, 5*time.Second, time.Millisecond)
+	assert.Equal(t, [][]string{{"k:0", "k:1", "k:2"}, {"k:3"}}, up.received())
+}
@@ -0,0 +1,412 @@
+// Package syslog implements a syslog handler writing RFC 5424 or RFC 3164
+// messages over UDP, TCP, TLS or a unix socket.
+//
+// With RFC 5424, fields are written as structured data:
+//
+//	<14>1 2020-01-02T03:04:05.000006Z host api 42 - [fields@32473 user="tj"] hello
+//
+// With RFC 3164, they are appended to the message in the logfmt format:
+//
+//	<14>Jan  2 03:04:05 host api[42]: hello user=tj
+//
+// Messages are framed over stream transports: with octet counting (RFC 6587)
+// over tcp and tls, and terminated by a newline over unix sockets, as
+// expected by local daemons.
+package syslog
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-logfmt/logfmt"
+
+	"github.com/eluv-io/apexlog-go"
+)
+
+// Format is a syslog message format.
+type Format int
+
+// Message formats.
+const (
+	RFC5424 Format = iota // RFC5424 is the syslog protocol format
+	RFC3164               // RFC3164 is the legacy BSD syslog format
+)
+
+// Framing is the framing of messages over stream networks.
+type Framing int
+
+// Framings.
+const (
+	DefaultFraming Framing = iota // DefaultFraming is OctetCounting over TCP and TLS, and NewlineFraming over Unix
+	OctetCounting                 // OctetCounting prefixes messages with their length (RFC 6587)
+	NewlineFraming                // NewlineFraming terminates messages with a newline
+	NULFraming                    // NULFraming terminates messages with a NUL byte
+)
+
+// Facility is a syslog facility.
+type Facility int
+
+// Facilities. The kernel facility is reserved to kernel messages and not
+// available.
+const (
+	_ Facility = iota // kern
+	User
+	Mail
+	Daemon
+	Auth
+	Syslog
+	Lpr
+	News
+	Uucp
+	Cron
+	AuthPriv
+	Ftp
+	_ // ntp
+	_ // security
+	_ // console
+	_ // solaris-cron
+	Local0
+	Local1
+	Local2
+	Local3
+	Local4
+	Local5
+	Local6
+	Local7
+)
+
+// Severities.
+const (
+	Emergency = iota
+	Alert
+	Critical
+	Error
+	Warning
+	Notice
+	Informational
+	Debug
+)
+
+// Network names.
+const (
+	UDP      = "udp"
+	TCP      = "tcp"
+	TLS      = "tls"
+	Unix     = "unix"
+	Unixgram = "unixgram"
+)
+
+// localAddresses are the usual addresses of the local syslog daemon socket.
+var localAddresses = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+// Config for handler.
+type Config struct {
+	Network     string        // Network is one of UDP, TCP, TLS, Unix and Unixgram (default: Unixgram to the local syslog daemon)
+	Address     string        // Address is the host:port or socket path of the server (default: local syslog daemon socket)
+	TLSConfig   *tls.Config   // TLSConfig is the TLS configuration of the TLS network
+	DialTimeout time.Duration // DialTimeout is the timeout of connections (default: 10s)
+	Format      Format        // Format is the message format (default: RFC5424)
+	Framing     Framing       // Framing is the framing of messages over stream networks (default: DefaultFraming)
+	Facility    Facility      // Facility of messages (default: User)
+	AppName     string        // AppName is the app name or tag (default: the executable name)
+	Hostname    string        // Hostname (default: os.Hostname())
+	SDID        string        // SDID is the RFC 5424 structured data ID of fields (default: "fields@32473")
+}
+
+// defaults applies defaults to the config.
+func (c *Config) defaults() {
+	if c.Network == "" {
+		c.Network = Unixgram
+	}
+
+	if c.DialTimeout == 0 {
+		c.DialTimeout = 10 * time.Second
+	}
+
+	if c.Framing == DefaultFraming {
+		c.Framing = OctetCounting
+		if c.Network == Unix {
+			c.Framing = NewlineFraming
+		}
+	}
+
+	if c.Facility == 0 {
+		c.Facility = User
+	}
+
+	if c.AppName == "" && len(os.Args) > 0 {
+		c.AppName = filepath.Base(os.Args[0])
+	}
+
+	if c.Hostname == "" {
+		c.Hostname, _ = os.Hostname()
+	}
+
+	if c.SDID == "" {
+		c.SDID = "fields@32473"
+	}
+}
+
+// Handler implementation.
+type Handler struct {
+	*Config
+
+	pid string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// New handler. It returns an error if the connection to the server fails.
+func New(config *Config) (*Handler, error) {
+	config.defaults()
+	h := &Handler{
+		Config: config,
+		pid:    strconv.Itoa(os.Getpid()),
+	}
+	if err := h.connect(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Severity returns the syslog severity of the given level.
+func Severity(level log.Level) int {
+	switch level {
+	case log.TraceLevel, log.DebugLevel:
+		return Debug
+	case log.InfoLevel:
+		return Informational
+	case log.WarnLevel:
+		return Warning
+	case log.ErrorLevel:
+		return Error
+	case log.FatalLevel:
+		return Critical
+	}
+	return Notice
+}
+
+// HandleLog implements log.Handler.
+func (h *Handler) HandleLog(e *log.Entry) error {
+	var msg []byte
+	if h.Format == RFC3164 {
+		msg = h.appendRFC3164(nil, e)
+	} else {
+		msg = h.appendRFC5424(nil, e)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	err := h.write(msg)
+	if err != nil {
+		// the server may have closed the connection: reconnect once
+		if err = h.reconnect(); err == nil {
+			err = h.write(msg)
+		}
+	}
+	return err
+}
+
+// Close closes the connection to the server.
+func (h *Handler) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.conn == nil {
+		return nil
+	}
+	err := h.conn.Close()
+	h.conn = nil
+	return err
+}
+
+// stream returns true if the network is stream oriented.
+func (h *Handler) stream() bool {
+	switch h.Network {
+	case TCP, TLS, Unix:
+		return true
+	}
+	return false
+}
+
+// write writes the message to the connection, framed for stream networks.
+func (h *Handler) write(msg []byte) error {
+	if h.conn == nil {
+		return errors.New("syslog: not connected")
+	}
+	if h.stream() {
+		switch h.Framing {
+		case OctetCounting:
+			frame := make([]byte, 0, len(msg)+8)
+			frame = strconv.AppendInt(frame, int64(len(msg)), 10)
+			frame = append(frame, ' ')
+			msg = append(frame, msg...)
+		case NewlineFraming:
+			msg = append(msg, '\n')
+		case NULFraming:
+			msg = append(msg, 0)
+		}
+	}
+	_, err := h.conn.Write(msg)
+	return err
+}
+
+// reconnect closes the current connection and opens a new one.
+func (h *Handler) reconnect() error {
+	if h.conn != nil {
+		_ = h.conn.Close()
+		h.conn = nil
+	}
+	return h.connect()
+}
+
+// connect opens a connection to the server.
+func (h *Handler) connect() error {
+	conn, err := h.dial()
+	if err != nil {
+		return err
+	}
+	h.conn = conn
+	return nil
+}
+
+// dial connects to the configured server or the local syslog daemon.
+func (h *Handler) dial() (net.Conn, error) {
+	if h.Address == "" {
+		for _, addr := range localAddresses {
+			conn, err := net.DialTimeout(h.Network, addr, h.DialTimeout)
+			if err == nil {
+				return conn, nil
+			}
+		}
+		return nil, errors.New("syslog: local syslog daemon not found")
+	}
+
+	if h.Network == TLS {
+		dialer := &net.Dialer{Timeout: h.DialTimeout}
+		return tls.DialWithDialer(dialer, "tcp", h.Address, h.TLSConfig)
+	}
+	return net.DialTimeout(h.Network, h.Address, h.DialTimeout)
+}
+
+// appendPriority appends the priority of the entry.
+func (h *Handler) appendPriority(dst []byte, e *log.Entry) []byte {
+	dst = append(dst, '<')
+	dst = strconv.AppendInt(dst, int64(int(h.Facility)*8+Severity(e.Level)), 10)
+	return append(dst, '>')
+}
+
+// appendRFC5424 appends the entry formatted as a RFC 5424 message.
+func (h *Handler) appendRFC5424(dst []byte, e *log.Entry) []byte {
+	dst = h.appendPriority(dst, e)
+	dst = append(dst, '1', ' ')
+	dst = e.Timestamp.AppendFormat(dst, "2006-01-02T15:04:05.000000Z07:00")
+	dst = append(dst, ' ')
+	dst = appendHeaderField(dst, h.Hostname, 255)
+	dst = append(dst, ' ')
+	dst = appendHeaderField(dst, h.AppName, 48)
+	dst = append(dst, ' ')
+	dst = appendHeaderField(dst, h.pid, 128)
+	dst = append(dst, " - "...)
+
+	if len(e.Fields) == 0 {
+		dst = append(dst, '-')
+	} else {
+		dst = append(dst, '[')
+		dst = appendSDName(dst, h.SDID)
+		for _, f := range e.Fields {
+			dst = append(dst, ' ')
+			dst = appendSDName(dst, f.Name)
+			dst = append(dst, '=', '"')
+			dst = appendSDValue(dst, fmt.Sprint(f.Value))
+			dst = append(dst, '"')
+		}
+		dst = append(dst, ']')
+	}
+
+	if e.Message != "" {
+		dst = append(dst, ' ')
+		dst = append(dst, e.Message...)
+	}
+	return dst
+}
+
+// appendRFC3164 appends the entry formatted as a RFC 3164 message.
+func (h *Handler) appendRFC3164(dst []byte, e *log.Entry) []byte {
+	dst = h.appendPriority(dst, e)
+	dst = e.Timestamp.AppendFormat(dst, time.Stamp)
+	dst = append(dst, ' ')
+	dst = appendHeaderField(dst, h.Hostname, 255)
+	dst = append(dst, ' ')
+	dst = appendHeaderField(dst, h.AppName, 32)
+	dst = append(dst, '[')
+	dst = append(dst, h.pid...)
+	dst = append(dst, "]: "...)
+	dst = append(dst, e.Message...)
+
+	if len(e.Fields) > 0 {
+		var buf bytes.Buffer
+		enc := logfmt.NewEncoder(&buf)
+		for _, f := range e.Fields {
+			_ = enc.EncodeKeyval(f.Name, f.Value)
+		}
+		dst = append(dst, ' ')
+		dst = append(dst, buf.Bytes()...)
+	}
+	return dst
+}
+
+// appendHeaderField appends a header field: printable ASCII characters
+// without spaces, at most size characters, or "-" if empty.
+func appendHeaderField(dst []byte, s string, size int) []byte {
+	if s == "" {
+		return append(dst, '-')
+	}
+	for i := 0; i < len(s) && i < size; i++ {
+		c := s[i]
+		if c < 33 || c > 126 {
+			c = '_'
+		}
+		dst = append(dst, c)
+	}
+	return dst
+}
+
+// appendSDName appends a structured data ID or parameter name: printable
+// ASCII characters except '=', ' ', ']' and '"', at most 32 characters.
+func appendSDName(dst []byte, s string) []byte {
+	if s == "" {
+		return append(dst, '_')
+	}
+	for i := 0; i < len(s) && i < 32; i++ {
+		c := s[i]
+		if c < 33 || c > 126 || c == '=' || c == ']' || c == '"' {
+			c = '_'
+		}
+		dst = append(dst, c)
+	}
+	return dst
+}
+
+// appendSDValue appends a structured data parameter value, escaping '"', '\'
+// and ']'.
+func appendSDValue(dst []byte, s string) []byte {
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"', '\\', ']':
+			dst = append(dst, '\\', c)
+		default:
+			dst = append(dst, c)
+		}
+	}
+	return dst
+}
@@ -0,0 +1,277 @@
+package syslog_test
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/eluv-io/apexlog-go"
+	"github.com/eluv-io/apexlog-go/handlers/syslog"
+	"github.com/eluv-io/apexlog-go/logtest"
+)
+
+var pid = os.Getpid()
+
+func newLogger(h log.Handler) *log.Logger {
+	return &log.Logger{
+		Handler: h,
+		Level:   log.DebugLevel,
+		Clock:   logtest.NewClock(time.Date(2020, 1, 2, 3, 4, 5, 6000, time.UTC)),
+	}
+}
+
+// readPackets reads n datagrams from the connection.
+func readPackets(t *testing.T, conn net.PacketConn, n int) []string {
+	var ret []string
+	buf := make([]byte, 65536)
+	for i := 0; i < n; i++ {
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+		size, _, err := conn.ReadFrom(buf)
+		require.NoError(t, err)
+		ret = append(ret, string(buf[:size]))
+	}
+	return ret
+}
+
+// readFrames reads n octet-counted frames from the first connection accepted
+// by the listener.
+func readFrames(t *testing.T, ln net.Listener, n int) <-chan []string {
+	ch := make(chan []string, 1)
+	go func() {
+		var ret []string
+		defer func() { ch <- ret }()
+
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+
+		r := bufio.NewReader(conn)
+		for i := 0; i < n; i++ {
+			size, err := r.ReadString(' ')
+			if err != nil {
+				return
+			}
+			length, err := strconv.Atoi(strings.TrimSpace(size))
+			if err != nil {
+				return
+			}
+			msg := make([]byte, length)
+			if _, err := io.ReadFull(r, msg); err != nil {
+				return
+			}
+			ret = append(ret, string(msg))
+		}
+	}()
+	return ch
+}
+
+func TestHandler_udp(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	h, err := syslog.New(&syslog.Config{
+		Network:  syslog.UDP,
+		Address:  conn.LocalAddr().String(),
+		Facility: syslog.Local0,
+		AppName:  "api",
+		Hostname: "host",
+	})
+	require.NoError(t, err)
+	defer h.Close()
+	l := newLogger(h)
+
+	l.Info("hello", "user", "tj", "quote", `a "b" [c]`)
+	l.Error("boom")
+	l.Debug("details")
+
+	assert.Equal(t, []string{
+		fmt.Sprintf(`<134>1 2020-01-02T03:04:05.000006Z host api %d - [fields@32473 user="tj" quote="a \"b\" [c\]"] hello`, pid),
+		fmt.Sprintf(`<131>1 2020-01-02T03:04:05.000006Z host api %d - - boom`, pid),
+		fmt.Sprintf(`<135>1 2020-01-02T03:04:05.000006Z host api %d - - details`, pid),
+	}, readPackets(t, conn, 3))
+}
+
+func TestHandler_rfc3164(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	h, err := syslog.New(&syslog.Config{
+		Network:  syslog.UDP,
+		Address:  conn.LocalAddr().String(),
+		Format:   syslog.RFC3164,
+		AppName:  "api",
+		Hostname: "host",
+	})
+	require.NoError(t, err)
+	defer h.Close()
+
+	newLogger(h).Warn("careful", "user", "tj", "msg", "two words")
+
+	assert.Equal(t, []string{
+		fmt.Sprintf(`<12>Jan  2 03:04:05 host api[%d]: careful user=tj msg="two words"`, pid),
+	}, readPackets(t, conn, 1))
+}
+
+// readLines reads n messages terminated by delim from the first connection
+// accepted by the listener.
+func readLines(t *testing.T, ln net.Listener, n int, delim byte) <-chan []string {
+	ch := make(chan []string, 1)
+	go func() {
+		var ret []string
+		defer func() { ch <- ret }()
+
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+
+		r := bufio.NewReader(conn)
+		for i := 0; i < n; i++ {
+			msg, err := r.ReadString(delim)
+			if err != nil {
+				return
+			}
+			ret = append(ret, strings.TrimSuffix(msg, string(delim)))
+		}
+	}()
+	return ch
+}
+
+func TestHandler_tcp(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	frames := readFrames(t, ln, 2)
+
+	h, err := syslog.New(&syslog.Config{
+		Network:  syslog.TCP,
+		Address:  ln.Addr().String(),
+		AppName:  "api",
+		Hostname: "host",
+	})
+	require.NoError(t, err)
+	defer h.Close()
+	l := newLogger(h)
+
+	l.Info("multi\nline")
+	l.Info("world")
+
+	assert.Equal(t, []string{
+		fmt.Sprintf("<14>1 2020-01-02T03:04:05.000006Z host api %d - - multi\nline", pid),
+		fmt.Sprintf("<14>1 2020-01-02T03:04:05.000006Z host api %d - - world", pid),
+	}, <-frames)
+}
+
+func TestHandler_tls(t *testing.T) {
+	// borrow the certificate of a TLS test server
+	srv := httptest.NewTLSServer(nil)
+	defer srv.Close()
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", srv.TLS)
+	require.NoError(t, err)
+	defer ln.Close()
+	frames := readFrames(t, ln, 1)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+
+	h, err := syslog.New(&syslog.Config{
+		Network:   syslog.TLS,
+		Address:   ln.Addr().String(),
+		TLSConfig: &tls.Config{RootCAs: roots, ServerName: "example.com"},
+		AppName:   "api",
+		Hostname:  "host",
+	})
+	require.NoError(t, err)
+	defer h.Close()
+
+	newLogger(h).Info("secure")
+
+	assert.Equal(t, []string{
+		fmt.Sprintf("<14>1 2020-01-02T03:04:05.000006Z host api %d - - secure", pid),
+	}, <-frames)
+}
+
+func TestHandler_unixgram(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syslog")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	addr := filepath.Join(dir, "log.sock")
+	conn, err := net.ListenPacket("unixgram", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	h, err := syslog.New(&syslog.Config{
+		Network:  syslog.Unixgram,
+		Address:  addr,
+		Facility: syslog.Daemon,
+		AppName:  "api",
+		Hostname: "host",
+	})
+	require.NoError(t, err)
+	defer h.Close()
+
+	newLogger(h).Info("local")
+
+	assert.Equal(t, []string{
+		fmt.Sprintf("<30>1 2020-01-02T03:04:05.000006Z host api %d - - local", pid),
+	}, readPackets(t, conn, 1))
+}
+
+func TestHandler_unix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syslog")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for framing, delim := range map[syslog.Framing]byte{
+		syslog.DefaultFraming: '\n',
+		syslog.NULFraming:     0,
+	} {
+		addr := filepath.Join(dir, fmt.Sprintf("log-%d.sock", framing))
+		ln, err := net.Listen("unix", addr)
+		require.NoError(t, err)
+		lines := readLines(t, ln, 2, delim)
+
+		h, err := syslog.New(&syslog.Config{
+			Network:  syslog.Unix,
+			Address:  addr,
+			Framing:  framing,
+			AppName:  "api",
+			Hostname: "host",
+		})
+		require.NoError(t, err)
+		l := newLogger(h)
+
+		l.Info("hello")
+		l.Info("world")
+
+		assert.Equal(t, []string{
+			fmt.Sprintf("<14>1 2020-01-02T03:04:05.000006Z host api %d - - hello", pid),
+			fmt.Sprintf("<14>1 2020-01-02T03:04:05.000006Z host api %d - - world", pid),
+		}, <-lines)
+		require.NoError(t, h.Close())
+		require.NoError(t, ln.Close())
+	}
+}
@@ -14,9 +14,6 @@ import (
 // Default handler outputting to stderr.
 var Default = New(os.Stderr)
 
-// start time.
-var start = time.Now()
-
 // colors.
 const (
 	none   = 0
@@ -66,7 +63,8 @@ func (h *Handler) HandleLog(e *log.Entry) error {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
-	ts := time.Since(start) / time.Second
+	clock := e.Clock()
+	ts := clock.Now().Sub(clock.Start()) / time.Second
 	_, _ = fmt.Fprintf(h.Writer, "\033[%dm%6s\033[0m[%04d] %-25s", color, level, ts, e.Message)
 
 	for _, field := range e.Fields {
@@ -9,12 +9,11 @@ import (
 
 	"github.com/eluv-io/apexlog-go"
 	"github.com/eluv-io/apexlog-go/handlers/text"
+	"github.com/eluv-io/apexlog-go/logtest"
 )
 
 func init() {
-	log.Now = func() time.Time {
-		return time.Unix(0, 0)
-	}
+	log.SetClock(logtest.NewClock(time.Unix(0, 0)))
 }
 
 func Test(t *testing.T) {
@@ -29,3 +28,22 @@ func Test(t *testing.T) {
 
 	assert.Equal(t, expected, buf.String())
 }
+
+func TestClock(t *testing.T) {
+	var buf bytes.Buffer
+
+	clock := logtest.NewClock(time.Unix(1000, 0))
+	l := &log.Logger{
+		Handler: text.New(&buf),
+		Level:   log.InfoLevel,
+		Clock:   clock,
+	}
+
+	l.Info("hello")
+	clock.Add(75 * time.Second)
+	l.Info("world")
+
+	expected := "\x1b[34m  INFO\x1b[0m[0000] hello                    \n\x1b[34m  INFO\x1b[0m[0075] world                    \n"
+
+	assert.Equal(t, expected, buf.String())
+}
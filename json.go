@@ -0,0 +1,212 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// assert interface compliance.
+var _ Encoder = JSONEncoder{}
+
+// Encoder is implemented by types serializing log entries.
+type Encoder interface {
+	// AppendEntry appends the encoded entry to dst and returns the extended
+	// slice.
+	AppendEntry(dst []byte, e *Entry) ([]byte, error)
+}
+
+// JSONEncoder is an append-style JSON encoder for entries and fields. Values
+// of common types are encoded without reflection, other values are encoded
+// with the standard encoding/json package.
+//
+// AppendEntry encodes entries as tagged in the Entry struct:
+//
+//	{"fields":{"user":"tj"},"level":"info","timestamp":"1970-01-01T00:00:00Z","message":"hello"}
+type JSONEncoder struct {
+	EscapeHTML bool // EscapeHTML escapes the characters <, > and & in strings
+}
+
+// AppendEntry implements Encoder.
+func (j JSONEncoder) AppendEntry(dst []byte, e *Entry) ([]byte, error) {
+	var err error
+	dst = append(dst, `{"fields":`...)
+	if dst, err = j.AppendFields(dst, e.Fields); err != nil {
+		return dst, err
+	}
+	dst = append(dst, `,"level":`...)
+	dst = j.AppendString(dst, e.Level.String())
+	dst = append(dst, `,"timestamp":`...)
+	dst = j.AppendTime(dst, e.Timestamp)
+	dst = append(dst, `,"message":`...)
+	dst = j.AppendString(dst, e.Message)
+	return append(dst, '}'), nil
+}
+
+// AppendFields appends the fields as a JSON object.
+func (j JSONEncoder) AppendFields(dst []byte, fields Fields) ([]byte, error) {
+	var err error
+	dst = append(dst, '{')
+	for i, f := range fields {
+		if i > 0 {
+			dst = append(dst, ',')
+		}
+		dst = j.AppendKey(dst, f.Name)
+		if dst, err = j.AppendValue(dst, f.Value); err != nil {
+			return dst, err
+		}
+	}
+	return append(dst, '}'), nil
+}
+
+// AppendKey appends the given object key, followed by a colon.
+func (j JSONEncoder) AppendKey(dst []byte, key string) []byte {
+	dst = j.AppendString(dst, key)
+	return append(dst, ':')
+}
+
+// AppendTime appends the given time as a RFC 3339 string with nanoseconds,
+// like time.Time.MarshalJSON.
+func (j JSONEncoder) AppendTime(dst []byte, t time.Time) []byte {
+	dst = append(dst, '"')
+	dst = t.AppendFormat(dst, time.RFC3339Nano)
+	return append(dst, '"')
+}
+
+// AppendValue appends the JSON encoding of the given value.
+func (j JSONEncoder) AppendValue(dst []byte, v interface{}) ([]byte, error) {
+	switch val := v.(type) {
+	case nil:
+		return append(dst, "null"...), nil
+	case string:
+		return j.AppendString(dst, val), nil
+	case bool:
+		return strconv.AppendBool(dst, val), nil
+	case int:
+		return strconv.AppendInt(dst, int64(val), 10), nil
+	case int8:
+		return strconv.AppendInt(dst, int64(val), 10), nil
+	case int16:
+		return strconv.AppendInt(dst, int64(val), 10), nil
+	case int32:
+		return strconv.AppendInt(dst, int64(val), 10), nil
+	case int64:
+		return strconv.AppendInt(dst, val, 10), nil
+	case uint:
+		return strconv.AppendUint(dst, uint64(val), 10), nil
+	case uint8:
+		return strconv.AppendUint(dst, uint64(val), 10), nil
+	case uint16:
+		return strconv.AppendUint(dst, uint64(val), 10), nil
+	case uint32:
+		return strconv.AppendUint(dst, uint64(val), 10), nil
+	case uint64:
+		return strconv.AppendUint(dst, val, 10), nil
+	case float32:
+		return appendFloat(dst, float64(val), 32)
+	case float64:
+		return appendFloat(dst, val, 64)
+	case time.Duration:
+		return strconv.AppendInt(dst, int64(val), 10), nil
+	case time.Time:
+		return j.AppendTime(dst, val), nil
+	case Level:
+		return j.AppendString(dst, val.String()), nil
+	case Fields:
+		return j.AppendFields(dst, val)
+	}
+	return j.appendReflect(dst, v)
+}
+
+// appendReflect appends the value encoded with encoding/json.
+func (j JSONEncoder) appendReflect(dst []byte, v interface{}) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(j.EscapeHTML)
+	if err := enc.Encode(v); err != nil {
+		return dst, err
+	}
+	// remove the newline added by Encode
+	ret := buf.Bytes()
+	return ret[:len(ret)-1], nil
+}
+
+// appendFloat appends a float formatted like encoding/json does.
+func appendFloat(dst []byte, f float64, bits int) ([]byte, error) {
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		return dst, &json.UnsupportedValueError{Str: strconv.FormatFloat(f, 'g', -1, bits)}
+	}
+
+	abs := math.Abs(f)
+	format := byte('f')
+	if abs != 0 {
+		if bits == 64 && (abs < 1e-6 || abs >= 1e21) || bits == 32 && (float32(abs) < 1e-6 || float32(abs) >= 1e21) {
+			format = 'e'
+		}
+	}
+	dst = strconv.AppendFloat(dst, f, format, -1, bits)
+	if format == 'e' {
+		// clean up e-09 to e-9
+		n := len(dst)
+		if n >= 4 && dst[n-4] == 'e' && dst[n-3] == '-' && dst[n-2] == '0' {
+			dst[n-2] = dst[n-1]
+			dst = dst[:n-1]
+		}
+	}
+	return dst, nil
+}
+
+const hex = "0123456789abcdef"
+
+// AppendString appends s as a quoted JSON string, escaping quotes, control
+// characters, invalid UTF-8 and - if EscapeHTML is set - HTML characters.
+func (j JSONEncoder) AppendString(dst []byte, s string) []byte {
+	dst = append(dst, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		if b := s[i]; b < utf8.RuneSelf {
+			if b >= 0x20 && b != '"' && b != '\\' && (!j.EscapeHTML || (b != '<' && b != '>' && b != '&')) {
+				i++
+				continue
+			}
+			dst = append(dst, s[start:i]...)
+			switch b {
+			case '"', '\\':
+				dst = append(dst, '\\', b)
+			case '\n':
+				dst = append(dst, '\\', 'n')
+			case '\r':
+				dst = append(dst, '\\', 'r')
+			case '\t':
+				dst = append(dst, '\\', 't')
+			default:
+				dst = append(dst, '\\', 'u', '0', '0', hex[b>>4], hex[b&0xF])
+			}
+			i++
+			start = i
+			continue
+		}
+		c, size := utf8.DecodeRuneInString(s[i:])
+		if c == utf8.RuneError && size == 1 {
+			dst = append(dst, s[start:i]...)
+			dst = append(dst, "\ufffd"...)
+			i += size
+			start = i
+			continue
+		}
+		// U+2028 and U+2029 are valid JSON but break JSONP and javascript
+		if c == '\u2028' || c == '\u2029' {
+			dst = append(dst, s[start:i]...)
+			dst = append(dst, '\\', 'u', '2', '0', '2', hex[c&0xF])
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	dst = append(dst, s[start:]...)
+	return append(dst, '"')
+}
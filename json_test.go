@@ -0,0 +1,175 @@
+package log_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/eluv-io/apexlog-go"
+)
+
+func TestJSONEncoder_keys(t *testing.T) {
+	fields := log.Fields{
+		{Name: `say "hi"`, Value: 1},
+		{Name: `back\slash`, Value: 2},
+		{Name: "new\nline", Value: 3},
+	}
+
+	b, err := json.Marshal(fields)
+	require.NoError(t, err)
+	require.True(t, json.Valid(b), string(b))
+	assert.Equal(t, `{"say \"hi\"":1,"back\\slash":2,"new\nline":3}`, string(b))
+
+	var m map[string]interface{}
+	require.NoError(t, json.Unmarshal(b, &m))
+	assert.Equal(t, 1.0, m[`say "hi"`])
+	assert.Equal(t, 3.0, m["new\nline"])
+}
+
+func TestJSONEncoder_values(t *testing.T) {
+	type custom struct {
+		A string `json:"a"`
+	}
+	values := []interface{}{
+		nil,
+		"plain",
+		"quote \" backslash \\ tab \t control \x01 del \x7f",
+		"html <b>&</b>",
+		"unicode é 世界 \u2028 \u2029",
+		"invalid \xff utf8",
+		true,
+		int(-1), int8(-8), int16(-16), int32(-32), int64(-64),
+		uint(1), uint8(8), uint16(16), uint32(32), uint64(math.MaxUint64),
+		float32(1.5), 0.0, 3.14, 1e21, 1e-7, -1e-9, 123456789.0,
+		time.Second,
+		time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC),
+		log.WarnLevel,
+		custom{A: "<a>"},
+		[]string{"x", "y"},
+		map[string]int{"k": 1},
+		errors.New("boom"),
+	}
+
+	for _, escapeHTML := range []bool{false, true} {
+		enc := log.JSONEncoder{EscapeHTML: escapeHTML}
+		for _, v := range values {
+			var buf bytes.Buffer
+			std := json.NewEncoder(&buf)
+			std.SetEscapeHTML(escapeHTML)
+			require.NoError(t, std.Encode(v))
+			expected := bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+
+			got, err := enc.AppendValue(nil, v)
+			require.NoError(t, err)
+			assert.Equal(t, string(expected), string(got), "%#v escapeHTML=%t", v, escapeHTML)
+		}
+	}
+
+	_, err := log.JSONEncoder{}.AppendValue(nil, math.NaN())
+	assert.Error(t, err)
+}
+
+func TestJSONEncoder_AppendEntry(t *testing.T) {
+	e := &log.Entry{
+		Fields: log.Fields{
+			{Name: "user", Value: "tj"},
+			{Name: "nested", Value: log.Fields{{Name: "id", Value: 1}}},
+		},
+		Level:     log.InfoLevel,
+		Timestamp: time.Unix(0, 0).UTC(),
+		Message:   "hello",
+	}
+
+	got, err := log.JSONEncoder{}.AppendEntry(nil, e)
+	require.NoError(t, err)
+	assert.Equal(t, `{"fields":{"user":"tj","nested":{"id":1}},"level":"info","timestamp":"1970-01-01T00:00:00Z","message":"hello"}`, string(got))
+
+	expected, err := json.Marshal(e)
+	require.NoError(t, err)
+	assert.Equal(t, string(expected), string(got))
+}
+
+// legacyFieldsJSON is the encoding/json based implementation of
+// Fields.MarshalJSON the encoder replaced, kept for comparison.
+func legacyFieldsJSON(f log.Fields) ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0))
+	for i, field := range f {
+		var vb bytes.Buffer
+		enc := json.NewEncoder(&vb)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(field.Value); err != nil {
+			return nil, err
+		}
+		buf.WriteString(fmt.Sprintf("\"%s\": %v", field.Name, vb.String()))
+		if i < len(f)-1 {
+			buf.WriteString(",")
+		}
+	}
+	return []byte("{" + buf.String() + "}"), nil
+}
+
+var benchFields = log.Fields{
+	{Name: "user", Value: "tj"},
+	{Name: "id", Value: 123},
+	{Name: "duration", Value: 1.5},
+	{Name: "ok", Value: true},
+	{Name: "path", Value: "/api/v1/<resource>"},
+}
+
+func BenchmarkFieldsJSON_legacy(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		// the outer encoder compacts and validates the marshaler output
+		_, _ = json.Marshal(json.RawMessage(must(legacyFieldsJSON(benchFields))))
+	}
+}
+
+func BenchmarkFieldsJSON_marshal(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_, _ = benchFields.MarshalJSON()
+	}
+}
+
+func BenchmarkFieldsJSON_append(b *testing.B) {
+	b.ReportAllocs()
+	enc := log.JSONEncoder{}
+	for i := 0; i < b.N; i++ {
+		buf := log.GetBuffer()
+		buf.B, _ = enc.AppendFields(buf.B, benchFields)
+		buf.Release()
+	}
+}
+
+func BenchmarkEntryJSON_stdlib(b *testing.B) {
+	b.ReportAllocs()
+	e := &log.Entry{Fields: benchFields, Level: log.InfoLevel, Timestamp: time.Now(), Message: "hello"}
+	for i := 0; i < b.N; i++ {
+		_, _ = json.Marshal(e)
+	}
+}
+
+func BenchmarkEntryJSON_append(b *testing.B) {
+	b.ReportAllocs()
+	e := &log.Entry{Fields: benchFields, Level: log.InfoLevel, Timestamp: time.Now(), Message: "hello"}
+	enc := log.JSONEncoder{}
+	for i := 0; i < b.N; i++ {
+		buf := log.GetBuffer()
+		buf.B, _ = enc.AppendEntry(buf.B, e)
+		buf.Release()
+	}
+}
+
+func must(b []byte, err error) []byte {
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
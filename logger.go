@@ -1,11 +1,14 @@
 package log
 
 import (
-	"bytes"
 	"encoding/json"
+	"fmt"
 	stdlog "log"
+	"os"
 	"sort"
+	"sync/atomic"
 	"time"
+	"unsafe"
 )
 
 // assert interface compliance.
@@ -54,22 +57,17 @@ func (f Fields) Names() (v []string) {
 	return
 }
 
+// MarshalJSON implements json.Marshaler using JSONEncoder.
 func (f Fields) MarshalJSON() ([]byte, error) {
-	buf := bytes.NewBuffer(make([]byte, 0))
-	for i, field := range f {
-		bb, err := field.toJSON()
-		if err != nil {
-			return nil, err
-		}
-		_, err = buf.WriteString(string(bb))
-		if err != nil {
-			return nil, err
-		}
-		if i < len(f)-1 {
-			buf.WriteString(",")
-		}
+	buf := GetBuffer()
+	defer buf.Release()
+
+	var err error
+	buf.B, err = JSONEncoder{}.AppendFields(buf.B, f)
+	if err != nil {
+		return nil, err
 	}
-	return []byte("{" + string(buf.Bytes()) + "}"), nil
+	return append([]byte(nil), buf.B...), nil
 }
 
 func (f *Fields) UnmarshalJSON(b []byte) error {
@@ -116,25 +114,69 @@ type Handler interface {
 	HandleLog(*Entry) error
 }
 
-// Asynchronous is an optional interface for handlers that wish to keep log
-// entries (known implementation are in multi, es, memory)
+// Asynchronous is an optional interface for handlers that process log entries
+// after HandleLog returned.
+//
+// Deprecated: entries are always pooled, handlers processing them after
+// HandleLog returned must Retain them and Release them once done, see
+// Entry.Retain. The logger no longer checks Asynchronous.
 type Asynchronous interface {
-	// Asynchronous returns true if the handler takes responsibility for
-	// releasing log entries
+	// Asynchronous returns true if the handler processes entries after
+	// HandleLog returned.
 	Asynchronous() bool
 }
 
-// Logger represents a logger with configurable Level and Handler.
+// Logger represents a logger with configurable Level, Handler and Clock.
+//
+// Messages below the logger's level cost a single atomic comparison and no
+// allocation: key/value arguments are only processed once the level is
+// known to be enabled.
 type Logger struct {
 	Handler Handler
-	Level   Level
+
+	// Level is the minimum level of logged messages. It may be set directly
+	// before the logger is in use, SetLevel changes it while logging.
+	Level Level
+
+	Clock Clock // Clock used for timestamps (default: SystemClock)
+}
+
+// Enabled returns true if messages at the given level are logged.
+func (l *Logger) Enabled(level Level) bool {
+	if l == nil {
+		return false
+	}
+	return level >= Level(atomic.LoadUintptr(l.levelAddr()))
+}
+
+// levelAddr returns the address of Level for atomic access: Level is an int,
+// which has the size of an uintptr.
+func (l *Logger) levelAddr() *uintptr {
+	return (*uintptr)(unsafe.Pointer(&l.Level))
+}
+
+// clock returns the clock of the logger.
+func (l *Logger) clock() Clock {
+	if l == nil || l.Clock == nil {
+		return SystemClock
+	}
+	return l.Clock
+}
+
+// SetLevel sets the Level of the logger. It is safe to call while logging.
+func (l *Logger) SetLevel(level Level) {
+	atomic.StoreUintptr(l.levelAddr(), uintptr(level))
 }
 
 // WithFields returns a new entry with `fields` set.
 func (l *Logger) WithFields(fields Fielder) *Entry {
-	ret := l.newEntry()
-	defer ret.Release()
-	return ret.WithFields(fields.Fields())
+	ret := &Entry{
+		Logger: l,
+	}
+	if fields != nil {
+		ret.fields = fields.Fields()
+	}
+	return ret
 }
 
 // WithField returns a new entry with the `key` and `value` set.
@@ -142,110 +184,108 @@ func (l *Logger) WithFields(fields Fielder) *Entry {
 // Note that the `key` should not have spaces in it - use camel
 // case or underscores
 func (l *Logger) WithField(key string, value interface{}) *Entry {
-	ret := l.newEntry()
-	defer ret.Release()
-	return ret.WithField(key, value)
+	ret := &Entry{
+		Logger: l,
+		nkv:    1,
+	}
+	ret.kv[0] = Field{Name: key, Value: value}
+	return ret
 }
 
 // WithDuration returns a new entry with the "duration" field set
 // to the given duration in milliseconds.
 func (l *Logger) WithDuration(d time.Duration) *Entry {
-	ret := l.newEntry()
-	defer ret.Release()
-	return ret.WithDuration(d)
+	return l.WithField("duration", d.Milliseconds())
 }
 
 // WithError returns a new entry with the "error" set to `err`.
 func (l *Logger) WithError(err error) *Entry {
-	if err == nil {
-		return NewEntry(l)
-	}
-	ret := l.newEntry()
-	defer ret.Release()
-	return ret.WithError(err)
+	return NewEntry(l).WithError(err)
 }
 
 func (l *Logger) Trace(msg string, fields ...interface{}) {
-	e := l.newEntry()
-	defer e.Release()
-	e.Trace(msg, fields...)
+	if l.Enabled(TraceLevel) {
+		l.log(TraceLevel, nil, msg, fields)
+	}
 }
 
 // Debug level message.
 func (l *Logger) Debug(msg string, fields ...interface{}) {
-	e := l.newEntry()
-	defer e.Release()
-	e.Debug(msg, fields...)
+	if l.Enabled(DebugLevel) {
+		l.log(DebugLevel, nil, msg, fields)
+	}
 }
 
 // Info level message.
 func (l *Logger) Info(msg string, fields ...interface{}) {
-	e := l.newEntry()
-	defer e.Release()
-	e.Info(msg, fields...)
+	if l.Enabled(InfoLevel) {
+		l.log(InfoLevel, nil, msg, fields)
+	}
 }
 
 // Warn level message.
 func (l *Logger) Warn(msg string, fields ...interface{}) {
-	e := l.newEntry()
-	defer e.Release()
-	e.Warn(msg, fields...)
+	if l.Enabled(WarnLevel) {
+		l.log(WarnLevel, nil, msg, fields)
+	}
 }
 
 // Error level message.
 func (l *Logger) Error(msg string, fields ...interface{}) {
-	e := l.newEntry()
-	defer e.Release()
-	e.Error(msg, fields...)
+	if l.Enabled(ErrorLevel) {
+		l.log(ErrorLevel, nil, msg, fields)
+	}
 }
 
 // Fatal level message, followed by an exit.
 func (l *Logger) Fatal(msg string, fields ...interface{}) {
-	e := l.newEntry()
-	defer e.Release()
-	e.Fatal(msg, fields...)
+	if l.Enabled(FatalLevel) {
+		l.log(FatalLevel, nil, msg, fields)
+	}
+	os.Exit(1)
 }
 
 // Tracef level formatted message.
 func (l *Logger) Tracef(msg string, v ...interface{}) {
-	e := l.newEntry()
-	defer e.Release()
-	e.Tracef(msg, v...)
+	if l.Enabled(TraceLevel) {
+		l.log(TraceLevel, nil, fmt.Sprintf(msg, v...), nil)
+	}
 }
 
 // Debugf level formatted message.
 func (l *Logger) Debugf(msg string, v ...interface{}) {
-	e := l.newEntry()
-	defer e.Release()
-	e.Debugf(msg, v...)
+	if l.Enabled(DebugLevel) {
+		l.log(DebugLevel, nil, fmt.Sprintf(msg, v...), nil)
+	}
 }
 
 // Infof level formatted message.
 func (l *Logger) Infof(msg string, v ...interface{}) {
-	e := l.newEntry()
-	defer e.Release()
-	e.Infof(msg, v...)
+	if l.Enabled(InfoLevel) {
+		l.log(InfoLevel, nil, fmt.Sprintf(msg, v...), nil)
+	}
 }
 
 // Warnf level formatted message.
 func (l *Logger) Warnf(msg string, v ...interface{}) {
-	e := l.newEntry()
-	defer e.Release()
-	e.Warnf(msg, v...)
+	if l.Enabled(WarnLevel) {
+		l.log(WarnLevel, nil, fmt.Sprintf(msg, v...), nil)
+	}
 }
 
 // Errorf level formatted message.
 func (l *Logger) Errorf(msg string, v ...interface{}) {
-	e := l.newEntry()
-	defer e.Release()
-	e.Errorf(msg, v...)
+	if l.Enabled(ErrorLevel) {
+		l.log(ErrorLevel, nil, fmt.Sprintf(msg, v...), nil)
+	}
 }
 
 // Fatalf level formatted message, followed by an exit.
 func (l *Logger) Fatalf(msg string, v ...interface{}) {
-	e := l.newEntry()
-	defer e.Release()
-	e.Fatalf(msg, v...)
+	if l.Enabled(FatalLevel) {
+		l.log(FatalLevel, nil, fmt.Sprintf(msg, v...), nil)
+	}
+	os.Exit(1)
 }
 
 // Watch returns a new entry with a Stop method to fire off
@@ -254,34 +294,17 @@ func (l *Logger) Watch(msg string) *Entry {
 	return NewEntry(l).Watch(msg)
 }
 
-// log the message, invoking the handler. We clone the entry here
-// to bypass the overhead in Entry methods when the level is not met.
-func (l *Logger) log(level Level, e *Entry, msg string) {
-	if l == nil {
-		return
-	}
-	if level < l.Level {
-		return
+// log the message, invoking the handler. The fields of the given entry - if
+// any - and the key/value arguments are merged into a new entry passed to the
+// handler. Callers are expected to have checked the level with Enabled.
+func (l *Logger) log(level Level, e *Entry, msg string, kv []interface{}) {
+	if e == nil {
+		e = &Entry{Logger: l}
 	}
-	entry := e.finalize(level, msg, l.usePool())
+	entry := e.finalize(level, msg, kv, true)
 	defer entry.Release()
 
 	if err := l.Handler.HandleLog(entry); err != nil {
 		stdlog.Printf("error logging: %s", err)
 	}
 }
-
-func (l *Logger) newEntry() *Entry {
-	if l.usePool() {
-		return newEntry(l)
-	}
-	return NewEntry(l)
-}
-
-func (l *Logger) usePool() bool {
-	async := false
-	if fin, ok := l.Handler.(Asynchronous); ok {
-		async = fin.Asynchronous()
-	}
-	return !async
-}
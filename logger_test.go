@@ -3,10 +3,12 @@ package log_test
 import (
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/eluv-io/apexlog-go"
 	"github.com/eluv-io/apexlog-go/handlers/discard"
 	"github.com/eluv-io/apexlog-go/handlers/memory"
+	"github.com/eluv-io/apexlog-go/logtest"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -43,6 +45,45 @@ func TestLogger_levels(t *testing.T) {
 	assert.Equal(t, e.Level, log.InfoLevel)
 }
 
+func TestLogger_SetLevel(t *testing.T) {
+	h := memory.New()
+
+	l := &log.Logger{
+		Handler: h,
+		Level:   log.InfoLevel,
+	}
+
+	l.SetLevel(log.DebugLevel)
+	l.Debug("uploading")
+	l.SetLevel(log.TraceLevel)
+	l.Trace("uploading")
+	l.SetLevel(log.ErrorLevel)
+	l.Warn("upload slow")
+
+	assert.Equal(t, 2, len(h.Entries))
+	assert.True(t, l.Enabled(log.FatalLevel))
+	assert.False(t, l.Enabled(log.WarnLevel))
+}
+
+func TestLogger_SetLevel_field(t *testing.T) {
+	l := &log.Logger{
+		Handler: memory.New(),
+		Level:   log.InfoLevel,
+	}
+
+	l.SetLevel(log.ErrorLevel)
+	assert.Equal(t, log.ErrorLevel, l.Level)
+	assert.False(t, l.Enabled(log.WarnLevel))
+
+	l.Level = log.DebugLevel
+	assert.True(t, l.Enabled(log.DebugLevel))
+	assert.False(t, l.Enabled(log.TraceLevel))
+
+	l.SetLevel(log.TraceLevel)
+	assert.Equal(t, log.TraceLevel, l.Level)
+	assert.True(t, l.Enabled(log.TraceLevel))
+}
+
 func TestLogger_WithFields(t *testing.T) {
 	h := memory.New()
 
@@ -251,3 +292,134 @@ func BenchmarkLogger_large(b *testing.B) {
 		}).WithError(err).Error("upload failed")
 	}
 }
+
+func TestLogger_disabled_allocs(t *testing.T) {
+	l := &log.Logger{
+		Handler: discard.New(),
+		Level:   log.InfoLevel,
+	}
+	ctx := l.WithField("file", "sloth.png")
+	fields := log.Fields{{Name: "file", Value: "sloth.png"}}
+
+	cases := map[string]func(){
+		"logger":       func() { l.Debug("upload", "file", "sloth.png", "size", 42) },
+		"logger_f":     func() { l.Debugf("upload %s", "sloth.png") },
+		"entry":        func() { ctx.Debug("upload", "size", 42) },
+		"entry_f":      func() { ctx.Debugf("upload %s", "sloth.png") },
+		"with_field":   func() { l.WithField("file", "sloth.png").WithField("user", "Tobi").Debug("upload") },
+		"with_fields":  func() { l.WithFields(fields).WithField("user", "Tobi").Debug("upload") },
+		"with_chained": func() { ctx.WithField("user", "Tobi").WithField("id", "123").Debug("upload") },
+	}
+	for name, fn := range cases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, 0.0, testing.AllocsPerRun(100, fn))
+		})
+	}
+}
+
+func BenchmarkLogger_disabled(b *testing.B) {
+	l := &log.Logger{
+		Handler: discard.New(),
+		Level:   log.InfoLevel,
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		l.Debug("upload", "file", "sloth.png", "type", "image/png")
+	}
+}
+
+func BenchmarkLogger_disabled_printf(b *testing.B) {
+	l := &log.Logger{
+		Handler: discard.New(),
+		Level:   log.InfoLevel,
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		l.Debugf("upload %s", "sloth.png")
+	}
+}
+
+func BenchmarkLogger_disabled_withField(b *testing.B) {
+	l := &log.Logger{
+		Handler: discard.New(),
+		Level:   log.InfoLevel,
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		l.WithField("file", "sloth.png").WithField("type", "image/png").Debug("upload")
+	}
+}
+
+func BenchmarkLogger_disabled_context(b *testing.B) {
+	l := &log.Logger{
+		Handler: discard.New(),
+		Level:   log.InfoLevel,
+	}
+	ctx := l.WithFields(log.Fields{
+		{Name: "file", Value: "sloth.png"},
+		{Name: "type", Value: "image/png"},
+	})
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		ctx.WithField("size", "1M").Debug("upload", "user", "Tobi")
+	}
+}
+
+func BenchmarkLogger_enabled_withField(b *testing.B) {
+	l := &log.Logger{
+		Handler: discard.New(),
+		Level:   log.InfoLevel,
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		l.WithField("file", "sloth.png").WithField("type", "image/png").Info("upload")
+	}
+}
+
+func TestLogger_Retain(t *testing.T) {
+	var kept []*log.Entry
+	l := &log.Logger{
+		Handler: log.HandlerFunc(func(e *log.Entry) error {
+			kept = append(kept, e.Retain())
+			return nil
+		}),
+		Level: log.InfoLevel,
+	}
+
+	for i := 0; i < 10; i++ {
+		l.Info(fmt.Sprintf("upload %d", i), "id", i)
+	}
+
+	for i, e := range kept {
+		assert.Equal(t, fmt.Sprintf("upload %d", i), e.Message)
+		assert.Equal(t, i, e.Fields.Get("id"))
+		e.Release()
+	}
+}
+
+func TestLogger_Clock(t *testing.T) {
+	h := memory.New()
+	clock := logtest.NewClock(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+
+	l := &log.Logger{
+		Handler: h,
+		Level:   log.InfoLevel,
+		Clock:   clock,
+	}
+
+	func() (err error) {
+		defer l.Watch("upload").Stop(&err)
+		clock.Add(1500 * time.Millisecond)
+		return nil
+	}()
+
+	assert.Equal(t, 2, len(h.Entries))
+	assert.Equal(t, time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), h.Entries[0].Timestamp)
+	assert.Equal(t, time.Date(2020, 1, 2, 3, 4, 6, 500000000, time.UTC), h.Entries[1].Timestamp)
+	assert.Equal(t, int64(1500), h.Entries[1].Fields.Get("duration"))
+}
@@ -0,0 +1,119 @@
+package logtest
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/eluv-io/apexlog-go"
+)
+
+// assert interface compliance.
+var _ log.Clock = (*Clock)(nil)
+
+// Timestamp is an arbitrary fixed time for tests, e.g. the start of clocks.
+var Timestamp = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+// Clock is a fake log.Clock for tests: its time only changes when set or
+// advanced explicitly. The functions of AfterFunc are called by Set and Add
+// once the clock reaches their time, in order.
+//
+//	clock := logtest.NewClock(time.Unix(0, 0).UTC())
+//	logger := &log.Logger{Handler: h, Level: log.InfoLevel, Clock: clock}
+//	clock.Add(2 * time.Second)
+type Clock struct {
+	mu     sync.Mutex
+	start  time.Time
+	now    time.Time
+	timers []*timer
+}
+
+// timer is a timer of a Clock.
+type timer struct {
+	clock *Clock
+	at    time.Time
+	f     func()
+}
+
+// Stop implements log.Timer.
+func (t *timer) Stop() bool {
+	c := t.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, other := range c.timers {
+		if other == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// NewClock returns a clock started and frozen at the given time.
+func NewClock(t time.Time) *Clock {
+	return &Clock{
+		start: t,
+		now:   t,
+	}
+}
+
+// Now implements log.Clock.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Start implements log.Clock.
+func (c *Clock) Start() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.start
+}
+
+// AfterFunc implements log.Clock.
+func (c *Clock) AfterFunc(d time.Duration, f func()) log.Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &timer{clock: c, at: c.now.Add(d), f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Set sets the current time of the clock.
+func (c *Clock) Set(t time.Time) {
+	c.mu.Lock()
+	c.now = t
+	c.fire()
+}
+
+// Add advances the clock by the given duration.
+func (c *Clock) Add(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.fire()
+}
+
+// fire calls the functions of the timers whose time is reached, in order. c.mu
+// must be held, it is released.
+func (c *Clock) fire() {
+	var due []*timer
+	pending := c.timers[:0]
+	for _, t := range c.timers {
+		if t.at.After(c.now) {
+			pending = append(pending, t)
+		} else {
+			due = append(due, t)
+		}
+	}
+	for i := len(pending); i < len(c.timers); i++ {
+		c.timers[i] = nil
+	}
+	c.timers = pending
+	c.mu.Unlock()
+
+	sort.SliceStable(due, func(i, j int) bool { return due[i].at.Before(due[j].at) })
+	for _, t := range due {
+		t.f()
+	}
+}
@@ -0,0 +1,207 @@
+// Package logtest provides a logger capturing entries in memory together with
+// helpers to make assertions on them in tests.
+//
+//	c := logtest.New()
+//	doSomething(c.Logger)
+//	c.AssertLogged(t, logtest.All(logtest.Level(log.ErrorLevel), logtest.Field("user", "tj")))
+//	c.RequireNoErrors(t)
+package logtest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/eluv-io/apexlog-go"
+	"github.com/eluv-io/apexlog-go/handlers/memory"
+)
+
+// TestingT is the subset of testing.TB used by the assertion helpers.
+type TestingT interface {
+	Helper()
+	Errorf(format string, args ...interface{})
+	FailNow()
+}
+
+// Capture is a log.Handler keeping entries in memory, on top of a memory
+// handler. It embeds a Logger at trace level using itself as handler.
+type Capture struct {
+	*log.Logger
+	Memory *memory.Handler
+
+	mu      sync.Mutex
+	changed chan struct{}
+}
+
+// New returns a capture keeping all logged entries.
+func New() *Capture {
+	return newCapture(memory.New())
+}
+
+// NewBounded returns a capture keeping at most the given number of entries,
+// dropping the oldest first.
+func NewBounded(capacity int) *Capture {
+	return newCapture(memory.NewBounded(capacity))
+}
+
+func newCapture(m *memory.Handler) *Capture {
+	c := &Capture{
+		Memory:  m,
+		changed: make(chan struct{}),
+	}
+	c.Logger = &log.Logger{
+		Handler: c,
+		Level:   log.TraceLevel,
+	}
+	return c
+}
+
+// HandleLog implements log.Handler.
+func (c *Capture) HandleLog(e *log.Entry) error {
+	err := c.Memory.HandleLog(e)
+
+	c.mu.Lock()
+	close(c.changed)
+	c.changed = make(chan struct{})
+	c.mu.Unlock()
+
+	return err
+}
+
+// Entries returns the entries captured so far.
+func (c *Capture) Entries() []*log.Entry {
+	return c.Memory.Snapshot()
+}
+
+// Reset removes all captured entries.
+func (c *Capture) Reset() {
+	c.Memory.Reset()
+}
+
+// Find returns the captured entries matched by m.
+func (c *Capture) Find(m Matcher) []*log.Entry {
+	var ret []*log.Entry
+	for _, e := range c.Entries() {
+		if m.Match(e) {
+			ret = append(ret, e)
+		}
+	}
+	return ret
+}
+
+// FindByField returns the captured entries having a field with the given name
+// and value.
+func (c *Capture) FindByField(name string, value interface{}) []*log.Entry {
+	return c.Find(Field(name, value))
+}
+
+// WaitFor blocks until an entry matched by m has been captured - possibly
+// before the call - and returns it. It returns the context's error if the
+// context is done first.
+func (c *Capture) WaitFor(ctx context.Context, m Matcher) (*log.Entry, error) {
+	for {
+		c.mu.Lock()
+		changed := c.changed
+		c.mu.Unlock()
+
+		if found := c.Find(m); len(found) > 0 {
+			return found[0], nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("logtest: waiting for entry %s: %w", m, ctx.Err())
+		}
+	}
+}
+
+// AssertLogged checks that at least one captured entry is matched by m and
+// reports an error listing the captured entries otherwise.
+func (c *Capture) AssertLogged(t TestingT, m Matcher) bool {
+	t.Helper()
+	entries := c.Entries()
+	for _, e := range entries {
+		if m.Match(e) {
+			return true
+		}
+	}
+	t.Errorf("no entry matching: %s\n%s", m, c.report(m, entries))
+	return false
+}
+
+// AssertNotLogged checks that no captured entry is matched by m.
+func (c *Capture) AssertNotLogged(t TestingT, m Matcher) bool {
+	t.Helper()
+	found := c.Find(m)
+	if len(found) == 0 {
+		return true
+	}
+	t.Errorf("unexpected entries matching: %s\n%s", m, formatEntries(found, -1))
+	return false
+}
+
+// RequireLogged is like AssertLogged but stops the test on failure.
+func (c *Capture) RequireLogged(t TestingT, m Matcher) {
+	t.Helper()
+	if !c.AssertLogged(t, m) {
+		t.FailNow()
+	}
+}
+
+// RequireNoErrors stops the test if any entry at error level or above was
+// captured.
+func (c *Capture) RequireNoErrors(t TestingT) {
+	t.Helper()
+	if !c.AssertNotLogged(t, MinLevel(log.ErrorLevel)) {
+		t.FailNow()
+	}
+}
+
+// report lists the given entries and details how the closest one differs from
+// the matcher.
+func (c *Capture) report(m Matcher, entries []*log.Entry) string {
+	if len(entries) == 0 {
+		return "no entries captured"
+	}
+
+	closest := -1
+	var reasons []string
+	for i, e := range entries {
+		r := mismatches(m, e)
+		if closest < 0 || len(r) < len(reasons) {
+			closest = i
+			reasons = r
+		}
+	}
+
+	var b bytes.Buffer
+	_, _ = fmt.Fprintf(&b, "captured %d entries", len(entries))
+	if dropped := c.Memory.Dropped(); dropped > 0 {
+		_, _ = fmt.Fprintf(&b, " (%d older entries dropped)", dropped)
+	}
+	_, _ = fmt.Fprintf(&b, ":\n%s", formatEntries(entries, closest))
+	_, _ = fmt.Fprintf(&b, "closest entry [%d] differs in:\n", closest)
+	for _, r := range reasons {
+		_, _ = fmt.Fprintf(&b, "  - %s\n", r)
+	}
+	return b.String()
+}
+
+// formatEntries formats entries one per line, marking the one at index mark.
+func formatEntries(entries []*log.Entry, mark int) string {
+	var b bytes.Buffer
+	for i, e := range entries {
+		prefix := "   "
+		if i == mark {
+			prefix = "-> "
+		}
+		_, _ = fmt.Fprintf(&b, "%s[%d] %-5s %q", prefix, i, e.Level, e.Message)
+		for _, f := range e.Fields {
+			_, _ = fmt.Fprintf(&b, " %s=%#v", f.Name, f.Value)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,137 @@
+package logtest_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/eluv-io/apexlog-go"
+	"github.com/eluv-io/apexlog-go/logtest"
+)
+
+// fakeT records failures instead of failing the test.
+type fakeT struct {
+	errors []string
+	failed bool
+}
+
+func (t *fakeT) Helper() {}
+
+func (t *fakeT) Errorf(format string, args ...interface{}) {
+	t.errors = append(t.errors, fmt.Sprintf(format, args...))
+}
+
+func (t *fakeT) FailNow() {
+	t.failed = true
+}
+
+func TestCapture_AssertLogged(t *testing.T) {
+	c := logtest.New()
+	c.WithField("user", "alice").Info("hello")
+	c.Error("boom", "user", "bob")
+
+	c.AssertLogged(t, logtest.Message("hello"))
+	c.AssertLogged(t, logtest.All(logtest.Level(log.ErrorLevel), logtest.Field("user", "bob")))
+	c.AssertNotLogged(t, logtest.MessageContains("world"))
+
+	ft := &fakeT{}
+	ok := c.AssertLogged(ft, logtest.All(logtest.Level(log.ErrorLevel), logtest.Field("user", "tj")))
+	assert.False(t, ok)
+	require.Len(t, ft.errors, 1)
+	assert.Equal(t, `no entry matching: level=error && field user="tj"
+captured 2 entries:
+   [0] info  "hello" user="alice"
+-> [1] error "boom" user="bob"
+closest entry [1] differs in:
+  - field user="tj": got "bob"
+`, ft.errors[0])
+}
+
+func TestCapture_RequireNoErrors(t *testing.T) {
+	c := logtest.New()
+	c.Info("hello")
+	c.RequireNoErrors(t)
+
+	c.Warn("careful")
+	c.Error("boom")
+
+	ft := &fakeT{}
+	c.RequireNoErrors(ft)
+	assert.True(t, ft.failed)
+	require.Len(t, ft.errors, 1)
+	assert.Contains(t, ft.errors[0], `[0] error "boom"`)
+
+	c.Reset()
+	assert.Empty(t, c.Entries())
+}
+
+func TestCapture_FindByField(t *testing.T) {
+	c := logtest.New()
+	c.Info("a", "tenant", "acme")
+	c.Info("b", "tenant", "other")
+	c.Info("c", "tenant", "acme")
+
+	found := c.FindByField("tenant", "acme")
+	require.Len(t, found, 2)
+	assert.Equal(t, "a", found[0].Message)
+	assert.Equal(t, "c", found[1].Message)
+}
+
+func TestCapture_WaitFor(t *testing.T) {
+	c := logtest.New()
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		c.Info("ready", "port", 8080)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	e, err := c.WaitFor(ctx, logtest.Message("ready"))
+	require.NoError(t, err)
+	assert.Equal(t, 8080, e.Fields.Get("port"))
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err = c.WaitFor(ctx, logtest.Message("never"))
+	assert.Equal(t, context.DeadlineExceeded, errors.Unwrap(err))
+}
+
+func TestCapture_bounded(t *testing.T) {
+	c := logtest.NewBounded(2)
+	c.Info("one")
+	c.Info("two")
+	c.Info("three")
+
+	entries := c.Entries()
+	require.Len(t, entries, 2)
+	assert.Equal(t, "two", entries[0].Message)
+	assert.Equal(t, "three", entries[1].Message)
+
+	ft := &fakeT{}
+	c.AssertLogged(ft, logtest.Message("one"))
+	require.Len(t, ft.errors, 1)
+	assert.Contains(t, ft.errors[0], "captured 2 entries (1 older entries dropped)")
+}
+
+func TestClock_AfterFunc(t *testing.T) {
+	clock := logtest.NewClock(logtest.Timestamp)
+	var fired []string
+	clock.AfterFunc(2*time.Second, func() { fired = append(fired, "b") })
+	clock.AfterFunc(time.Second, func() { fired = append(fired, "a") })
+	stopped := clock.AfterFunc(time.Second, func() { fired = append(fired, "stopped") })
+	assert.True(t, stopped.Stop())
+
+	clock.Add(500 * time.Millisecond)
+	assert.Empty(t, fired)
+	clock.Add(2 * time.Second)
+	assert.Equal(t, []string{"a", "b"}, fired)
+	assert.False(t, stopped.Stop())
+}
@@ -0,0 +1,210 @@
+package logtest
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/eluv-io/apexlog-go"
+)
+
+// Matcher selects log entries.
+type Matcher interface {
+	// Match returns true if the entry is selected by the matcher.
+	Match(e *log.Entry) bool
+	// String describes the matcher, used in failure messages.
+	String() string
+}
+
+// explainer is an optional interface for matchers able to tell why an entry
+// does not match.
+type explainer interface {
+	explain(e *log.Entry) string
+}
+
+// MatcherFunc is an adapter to use an ordinary function as a Matcher.
+func MatcherFunc(desc string, fn func(e *log.Entry) bool) Matcher {
+	return &funcMatcher{desc: desc, fn: fn}
+}
+
+type funcMatcher struct {
+	desc string
+	fn   func(e *log.Entry) bool
+}
+
+func (m *funcMatcher) Match(e *log.Entry) bool { return m.fn(e) }
+func (m *funcMatcher) String() string          { return m.desc }
+
+// Any matches all entries.
+func Any() Matcher {
+	return MatcherFunc("any", func(*log.Entry) bool { return true })
+}
+
+// Level matches entries with the given level.
+func Level(l log.Level) Matcher {
+	return &levelMatcher{level: l}
+}
+
+// MinLevel matches entries with the given level or above.
+func MinLevel(l log.Level) Matcher {
+	return &levelMatcher{level: l, min: true}
+}
+
+type levelMatcher struct {
+	level log.Level
+	min   bool
+}
+
+func (m *levelMatcher) Match(e *log.Entry) bool {
+	if m.min {
+		return e.Level >= m.level
+	}
+	return e.Level == m.level
+}
+
+func (m *levelMatcher) String() string {
+	if m.min {
+		return "level>=" + m.level.String()
+	}
+	return "level=" + m.level.String()
+}
+
+func (m *levelMatcher) explain(e *log.Entry) string {
+	return fmt.Sprintf("%s: got %s", m, e.Level)
+}
+
+// Message matches entries with exactly the given message.
+func Message(msg string) Matcher {
+	return &messageMatcher{
+		desc: fmt.Sprintf("message=%q", msg),
+		fn:   func(s string) bool { return s == msg },
+	}
+}
+
+// MessageContains matches entries whose message contains the given string.
+func MessageContains(sub string) Matcher {
+	return &messageMatcher{
+		desc: fmt.Sprintf("message contains %q", sub),
+		fn:   func(s string) bool { return strings.Contains(s, sub) },
+	}
+}
+
+// MessageMatches matches entries whose message matches the given regular
+// expression. It panics if the expression does not compile.
+func MessageMatches(expr string) Matcher {
+	re := regexp.MustCompile(expr)
+	return &messageMatcher{
+		desc: fmt.Sprintf("message =~ %q", expr),
+		fn:   re.MatchString,
+	}
+}
+
+type messageMatcher struct {
+	desc string
+	fn   func(string) bool
+}
+
+func (m *messageMatcher) Match(e *log.Entry) bool { return m.fn(e.Message) }
+func (m *messageMatcher) String() string          { return m.desc }
+
+func (m *messageMatcher) explain(e *log.Entry) string {
+	return fmt.Sprintf("%s: got %q", m.desc, e.Message)
+}
+
+// Field matches entries having a field with the given name and value. Values
+// are compared with reflect.DeepEqual.
+func Field(name string, value interface{}) Matcher {
+	return &fieldMatcher{name: name, value: value}
+}
+
+// HasField matches entries having a field with the given name, whatever its
+// value.
+func HasField(name string) Matcher {
+	return &fieldMatcher{name: name, any: true}
+}
+
+type fieldMatcher struct {
+	name  string
+	value interface{}
+	any   bool
+}
+
+func (m *fieldMatcher) Match(e *log.Entry) bool {
+	f := findField(e.Fields, m.name)
+	if f == nil {
+		return false
+	}
+	return m.any || reflect.DeepEqual(f.Value, m.value)
+}
+
+func (m *fieldMatcher) String() string {
+	if m.any {
+		return "has field " + m.name
+	}
+	return fmt.Sprintf("field %s=%#v", m.name, m.value)
+}
+
+func (m *fieldMatcher) explain(e *log.Entry) string {
+	f := findField(e.Fields, m.name)
+	if f == nil {
+		return fmt.Sprintf("%s: field missing", m)
+	}
+	return fmt.Sprintf("%s: got %#v", m, f.Value)
+}
+
+func findField(fields log.Fields, name string) *log.Field {
+	for _, f := range fields {
+		if f.Name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// All matches entries matched by all the given matchers.
+func All(ms ...Matcher) Matcher {
+	return allMatcher(ms)
+}
+
+type allMatcher []Matcher
+
+func (m allMatcher) Match(e *log.Entry) bool {
+	for _, mm := range m {
+		if !mm.Match(e) {
+			return false
+		}
+	}
+	return true
+}
+
+func (m allMatcher) String() string {
+	s := make([]string, len(m))
+	for i, mm := range m {
+		s[i] = mm.String()
+	}
+	return strings.Join(s, " && ")
+}
+
+// Not matches entries that are not matched by the given matcher.
+func Not(m Matcher) Matcher {
+	return MatcherFunc("!("+m.String()+")", func(e *log.Entry) bool { return !m.Match(e) })
+}
+
+// mismatches returns the reasons why the given entry is not matched by m.
+func mismatches(m Matcher, e *log.Entry) []string {
+	var ret []string
+	if all, ok := m.(allMatcher); ok {
+		for _, mm := range all {
+			ret = append(ret, mismatches(mm, e)...)
+		}
+		return ret
+	}
+	if m.Match(e) {
+		return nil
+	}
+	if ex, ok := m.(explainer); ok {
+		return []string{ex.explain(e)}
+	}
+	return []string{m.String()}
+}
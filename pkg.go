@@ -16,17 +16,24 @@ func SetHandler(h Handler) {
 	}
 }
 
-// SetLevel sets the log level. This is not thread-safe.
+// SetLevel sets the log level.
 func SetLevel(l Level) {
 	if logger, ok := Log.(*Logger); ok {
-		logger.Level = l
+		logger.SetLevel(l)
 	}
 }
 
-// SetLevelFromString sets the log level from a string, panicing when invalid. This is not thread-safe.
+// SetLevelFromString sets the log level from a string, panicing when invalid.
 func SetLevelFromString(s string) {
 	if logger, ok := Log.(*Logger); ok {
-		logger.Level = MustParseLevel(s)
+		logger.SetLevel(MustParseLevel(s))
+	}
+}
+
+// SetClock sets the clock. This is not thread-safe.
+func SetClock(c Clock) {
+	if logger, ok := Log.(*Logger); ok {
+		logger.Clock = c
 	}
 }
 